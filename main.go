@@ -1,29 +1,509 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/caoakleyii/cloud-jumper/src/admin"
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/certs"
+	"github.com/caoakleyii/cloud-jumper/src/cli"
+	"github.com/caoakleyii/cloud-jumper/src/cluster"
+	"github.com/caoakleyii/cloud-jumper/src/concurrency"
+	"github.com/caoakleyii/cloud-jumper/src/config"
+	"github.com/caoakleyii/cloud-jumper/src/gossip"
 	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/hasher"
+	"github.com/caoakleyii/cloud-jumper/src/health"
+	"github.com/caoakleyii/cloud-jumper/src/jobs"
+	"github.com/caoakleyii/cloud-jumper/src/logfile"
+	"github.com/caoakleyii/cloud-jumper/src/middleware"
+	"github.com/caoakleyii/cloud-jumper/src/peer"
+	"github.com/caoakleyii/cloud-jumper/src/proxy"
+	"github.com/caoakleyii/cloud-jumper/src/raft"
+	"github.com/caoakleyii/cloud-jumper/src/ratelimit"
+	"github.com/caoakleyii/cloud-jumper/src/replication"
 	"github.com/caoakleyii/cloud-jumper/src/server"
 )
 
 func main() {
+	cfg, args, err := config.Load(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// any arguments are a sub command run against a running server
+	if len(args) > 0 {
+		if err := cli.Run(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	hasher.SetPolicy(hashPolicy(cfg))
+
+	app := server.NewApp(time.Duration(cfg.Server.ShutdownTimeout))
+	// systemd's watchdog restarts the process once its liveness checks fail
+	app.Alive = func(ctx context.Context) error {
+		if report := health.Default.Liveness(ctx); !report.Healthy() {
+			return errors.New("liveness checks failed")
+		}
+		return nil
+	}
+
+	// reload with the same arguments, picking up changes to the config file and environment
+	reloader := server.NewReloader(cfg, func() (*config.Config, error) {
+		cfg, _, err := config.Load(os.Args[1:], os.Getenv)
+		return cfg, err
+	})
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		p := hashPolicy(c)
+		return func() { hasher.SetPolicy(p) }, nil
+	})
+
+	// the server log goes through slog, whose level a reload can change,
+	// lines written with the log package are logged at info
+	var level slog.LevelVar
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &level})))
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			return nil, err
+		}
+		return func() { level.Set(l) }, nil
+	})
+
+	peer.SetSecret(cfg.Cluster.Secret)
+	if cfg.Storage.Follow != "" {
+		replication.Follow(cfg.Storage.Follow, cache.InMemoryPasswordStorage)
+	}
+
+	self := strings.TrimRight(cfg.Cluster.Self, "/")
+	if len(cfg.Cluster.Peers) > 0 {
+		cluster.Configure(self, cfg.Cluster.Peers)
+	}
+
+	if cfg.Storage.Backend == config.Raft {
+		var members []string
+		if !cfg.Storage.RaftJoin {
+			members = cfg.Storage.RaftMembers
+		}
+
+		node, err := raft.NewNode(raft.Config{
+			ID:      self,
+			Members: members,
+			DataDir: cfg.Storage.RaftDir,
+			Store:   cache.InMemoryPasswordStorage,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		cache.PasswordStorage = node
+		app.OnStart(server.Hook{Name: "raft", Fn: func(context.Context) error {
+			node.Start()
+			return nil
+		}})
+		app.OnStop(server.Hook{Name: "raft", Order: server.ServersOrder + 2, Fn: func(context.Context) error {
+			node.Stop()
+			return nil
+		}})
+	}
+
+	if cfg.Cluster.Gossip != "" {
+		gcfg := gossip.Config{
+			Name:     self,
+			BindAddr: cfg.Cluster.Gossip,
+			Seeds:    cfg.Cluster.GossipSeeds,
+			Secret:   cfg.Cluster.Secret,
+		}
+		app.OnStart(server.Hook{Name: "gossip", Fn: func(context.Context) error {
+			return gossip.Join(gcfg)
+		}})
+		// leave once the servers have stopped, so peers stop routing here last
+		app.OnStop(server.Hook{Name: "gossip", Order: server.ServersOrder + 2, Fn: func(context.Context) error {
+			gossip.Leave()
+			return nil
+		}})
+
+		// route ids owned by dead peers to the next peer on the ring
+		cluster.SetUnavailable(gossip.IsDead)
+	}
+
+	jobs.Default.FlushFile = cfg.Storage.FlushFile
+
+	// trusted proxies are validated when the config is loaded
+	trusted, _ := proxy.ParseTrusted(cfg.Proxy.Trusted)
+	proxy.SetTrusted(trusted)
+	proxy.SetHeader(cfg.Proxy.Header)
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		trusted, err := proxy.ParseTrusted(c.Proxy.Trusted)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			proxy.SetTrusted(trusted)
+			proxy.SetHeader(c.Proxy.Header)
+		}, nil
+	})
+
+	middleware.SetSink(panicSink(cfg))
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		sink := panicSink(c)
+		return func() { middleware.SetSink(sink) }, nil
+	})
+
 	h := handler.New()
 
 	server.UseRoutes(h)
-	server.UseMiddleware(h)
+	server.UseMiddleware(h, cfg.Middleware)
+	server.UseHealthChecks(health.Default)
+
+	cert := &certs.Certificate{}
+	tlsCfg, err := certs.TLSConfig(publicTLS(cfg), cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		if (tlsCfg != nil && !cfg.TLS.Dev) != (c.TLS.Cert != "") {
+			return nil, errors.New("turning tls on or off requires a restart")
+		}
+		if c.TLS.Cert == "" {
+			return func() {}, nil
+		}
+		return cert.Prepare(c.TLS.Cert, c.TLS.Key)
+	})
+
+	limiter, err := ratelimit.New(rateLimit(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		return limiter.Prepare(rateLimit(c))
+	})
+
+	capper, err := concurrency.New(concurrencyLimits(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		return capper.Prepare(concurrencyLimits(c))
+	})
+
+	timeouts, err := middleware.NewTimeouts(cfg.Middleware.Timeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		return timeouts.Prepare(c.Middleware.Timeouts)
+	})
+
+	public := middleware.Timeout(h, timeouts)
+	public = middleware.RateLimit(middleware.Concurrency(compressed(cfg, public), capper), limiter)
+	if cfg.AccessLog.File != "" {
+		w, err := accessLog(cfg.AccessLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.OnStop(server.Hook{Name: "access log", Order: server.ServersOrder + 1, Fn: func(context.Context) error {
+			return w.Close()
+		}})
+
+		public, err = middleware.AccessLog(public, w, middleware.AccessLogConfig{
+			Format:  cfg.AccessLog.Format,
+			Sample:  cfg.AccessLog.Sample,
+			Exclude: cfg.AccessLog.Exclude,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	s := &http.Server{
-		Addr:    ":8080",
-		Handler: h,
+		Addr:              cfg.Addr,
+		Handler:           middleware.RequestID(middleware.Recover(public)),
+		TLSConfig:         tlsCfg,
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		Protocols:         protocols(cfg),
+		HTTP2:             http2Config(cfg),
 	}
 
-	// Start Server
-	go func() {
-		log.Printf("Sever Started on %v", s.Addr)
-		s.ListenAndServe()
-	}()
+	adminCfg := adminConfig(cfg)
+
+	ah := handler.New()
+	server.UseAdminRoutes(ah)
+	guard, err := admin.NewGuard(adminCfg, ah)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		return guard.Prepare(adminConfig(c))
+	})
+
+	adminCert := &certs.Certificate{}
+	adminTLSCfg, err := admin.TLSConfig(adminCfg, adminCert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reloader.OnReload(func(c *config.Config) (func(), error) {
+		if (adminTLSCfg != nil) != (c.Admin.Cert != "") {
+			return nil, errors.New("turning admin tls on or off requires a restart")
+		}
+		if adminTLSCfg == nil {
+			return func() {}, nil
+		}
+		return adminCert.Prepare(c.Admin.Cert, c.Admin.Key)
+	})
+
+	// pick up renewed certificates without a reload
+	watching, stopWatching := context.WithCancel(context.Background())
+	app.OnStart(server.Hook{Name: "certificates", Fn: func(context.Context) error {
+		go cert.Watch(watching, time.Duration(cfg.TLS.ReloadInterval))
+		go adminCert.Watch(watching, time.Duration(cfg.TLS.ReloadInterval))
+		return nil
+	}})
+	app.OnStop(server.Hook{Name: "certificates", Order: server.ServersOrder + 1, Fn: func(context.Context) error {
+		stopWatching()
+		return nil
+	}})
+
+	// admin requests such as imports may take longer than public ones,
+	// so only the header timeout applies
+	as := &http.Server{
+		Addr:              adminCfg.Addr,
+		Handler:           middleware.RequestID(middleware.Recover(compressed(cfg, guard))),
+		TLSConfig:         adminTLSCfg,
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		Protocols:         protocols(cfg),
+		HTTP2:             http2Config(cfg),
+	}
+
+	for _, l := range listeners(cfg, cfg.Addr, cfg.Listen.Public, cfg.Proxy.Protocol) {
+		app.Listen(s, l)
+	}
+	for _, l := range listeners(cfg, adminCfg.Addr, cfg.Listen.Admin, false) {
+		app.Listen(as, l)
+	}
+
+	// other nodes call the peer api with the cluster secret, it serves
+	// long lived streams such as the replication log like the admin api
+	if cfg.Cluster.PeerAddr != "" {
+		ph := handler.New()
+		server.UsePeerRoutes(ph)
+		ps := &http.Server{
+			Addr:              cfg.Cluster.PeerAddr,
+			Handler:           middleware.RequestID(middleware.Recover(compressed(cfg, peer.Guard(ph)))),
+			TLSConfig:         peerTLS(tlsCfg),
+			ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+			IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+			MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+			Protocols:         protocols(cfg),
+			HTTP2:             http2Config(cfg),
+		}
+		for _, l := range listeners(cfg, cfg.Cluster.PeerAddr, nil, false) {
+			app.Listen(ps, l)
+		}
+	}
+	server.UseGracefulShutdown(app)
 
-	server.UseGracefulShutdown(s)
+	admin.SetReloader(reloader.Reload)
+	app.Handle(syscall.SIGHUP, func() {
+		report, err := reloader.Reload()
+		if err != nil {
+			log.Printf("Reload failed, keeping the running configuration: %v", err)
+			return
+		}
+		log.Printf("Reloaded, applied: %v requires restart: %v", report.Applied, report.RequiresRestart)
+	})
+
+	// only the listeners are passed on, so refuse upgrades that would lose
+	// the store or have both processes own the same raft log or gossip port
+	app.Upgradable = func() error {
+		switch {
+		case cfg.Storage.Backend == config.Raft:
+			return errors.New("the raft node can't be run by both processes")
+		case cfg.Cluster.Gossip != "":
+			return errors.New("the gossip port can't be bound by both processes")
+		case !replication.IsFollower():
+			return errors.New("the passwords held in memory would be lost")
+		}
+		return nil
+	}
+
+	// hand the listeners to a new process started from the executable, e.g. once
+	// it has been replaced by a new release, then drain and exit
+	app.Handle(syscall.SIGUSR2, func() {
+		if err := app.Upgrade(); err != nil {
+			log.Printf("Upgrade failed, carrying on serving: %v", err)
+			return
+		}
+		app.Shutdown()
+	})
+
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func hashPolicy(c *config.Config) hasher.Policy {
+	return hasher.Policy{
+		SaltLength: c.Hashing.SaltLength,
+		IDLength:   c.Hashing.IDLength,
+		StoreDelay: time.Duration(c.Hashing.StoreDelay),
+	}
+}
+
+// accessLog opens the file the access log is written to, rotated by size, or stdout
+func accessLog(c config.AccessLog) (io.WriteCloser, error) {
+	if c.File == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return logfile.Open(c.File, int64(c.MaxSize), c.MaxBackups)
+}
+
+// nopCloser leaves stdout open when the access log is closed
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// compressed wraps the handler to compress its responses, unless compression is disabled
+func compressed(c *config.Config, h http.Handler) http.Handler {
+	if !c.Compression.Enabled {
+		return h
+	}
+	compress, err := middleware.Compress(h, middleware.CompressConfig{
+		Level:   c.Compression.Level,
+		MinSize: c.Compression.MinSize,
+		Types:   c.Compression.Types,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return compress
+}
+
+// rateLimit returns the rate limits of the public api
+func rateLimit(c *config.Config) ratelimit.Config {
+	return ratelimit.Config{Rules: c.RateLimit.Rules, Key: c.RateLimit.Key}
+}
+
+// concurrencyLimits returns the caps on requests the public api serves at once
+func concurrencyLimits(c *config.Config) concurrency.Config {
+	return concurrency.Config{
+		Rules:        c.Concurrency.Rules,
+		Priority:     c.Concurrency.Priority,
+		QueueTimeout: time.Duration(c.Concurrency.QueueTimeout),
+		Adaptive:     c.Concurrency.Adaptive,
+	}
+}
+
+// panicSink returns the sink recovered panics are reported to, if any
+func panicSink(c *config.Config) middleware.Sink {
+	if c.Middleware.PanicWebhook == "" {
+		return nil
+	}
+	return middleware.WebhookSink(c.Middleware.PanicWebhook)
+}
+
+// protocols returns the protocols the servers speak, HTTP/1 always
+// and HTTP/2 as configured
+func protocols(c *config.Config) *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	p.SetHTTP2(c.HTTP2.Enabled)
+	p.SetUnencryptedHTTP2(c.HTTP2.H2C)
+	return p
+}
+
+func http2Config(c *config.Config) *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxConcurrentStreams: c.HTTP2.MaxConcurrentStreams,
+		MaxReadFrameSize:     c.HTTP2.MaxReadFrameSize,
+	}
+}
+
+// publicTLS returns the TLS configuration of the public api, a self signed
+// certificate in development is valid for loopback and the host of cluster.self
+func publicTLS(c *config.Config) certs.Config {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if u, err := url.Parse(c.Cluster.Self); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+
+	return certs.Config{
+		CertFile:     c.TLS.Cert,
+		KeyFile:      c.TLS.Key,
+		ClientCAFile: c.TLS.ClientCA,
+		ClientAuth:   c.TLS.ClientAuth,
+		MinVersion:   c.TLS.MinVersion,
+		Ciphers:      c.TLS.Ciphers,
+		SelfSigned:   c.TLS.Dev,
+		Hosts:        hosts,
+	}
+}
+
+// peerTLS returns the public listener's tls config for the peer listener,
+// without client certificates as nodes authenticate with the cluster secret
+func peerTLS(public *tls.Config) *tls.Config {
+	if public == nil {
+		return nil
+	}
+	c := public.Clone()
+	c.ClientAuth = tls.NoClientCert
+	c.ClientCAs = nil
+	return c
+}
+
+// listeners returns the listeners of a router's address and further addresses,
+// with the socket permissions configured
+func listeners(c *config.Config, addr string, more []string, proxyProtocol bool) []server.Listener {
+	// the mode is validated when the config is loaded
+	mode, _ := c.Listen.Mode()
+
+	var listeners []server.Listener
+	for _, a := range append([]string{addr}, more...) {
+		if a != "" {
+			listeners = append(listeners, server.Listener{
+				Addr:          a,
+				Mode:          mode,
+				Owner:         c.Listen.SocketOwner,
+				Group:         c.Listen.SocketGroup,
+				ProxyProtocol: proxyProtocol,
+			})
+		}
+	}
+	return listeners
+}
+
+func adminConfig(c *config.Config) admin.Config {
+	return admin.Config{
+		Addr:         c.Admin.Addr,
+		Tokens:       c.Admin.Tokens,
+		TokenFile:    c.Admin.TokenFile,
+		CertFile:     c.Admin.Cert,
+		KeyFile:      c.Admin.Key,
+		ClientCAFile: c.Admin.ClientCA,
+		Allow:        c.Admin.Allow,
+		AuditLog:     c.Admin.AuditLog,
+	}
 }
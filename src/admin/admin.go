@@ -0,0 +1,330 @@
+/*
+Package admin implements the admin control plane of the server.
+
+	Admin routes are served on a listener separate from the public API.
+	Every request must come from an allowed address and authenticate with
+	a bearer token or a client certificate, and is recorded in an audit log.
+	The package also holds the operational state the admin routes change:
+	draining, maintenance mode and the reloader of the configuration.
+*/
+package admin
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/certs"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// DefaultAddr is the address the admin listener binds to when none is configured,
+// only reachable from this host
+const DefaultAddr = "127.0.0.1:8081"
+
+// loopback is allowed when a Config has no allowlist
+var loopback = []string{"127.0.0.0/8", "::1/128"}
+
+// Config configures the admin listener
+type Config struct {
+	// Addr is the address to listen on
+	Addr string
+	// Tokens are the bearer tokens accepted
+	Tokens []string
+	// TokenFile holds further bearer tokens, one per line, and is re-read on reload
+	TokenFile string
+	// CertFile and KeyFile serve the admin listener over TLS
+	CertFile string
+	KeyFile  string
+	// ClientCAFile authenticates requests with a client certificate signed by one
+	// of its CAs, requires CertFile and KeyFile
+	ClientCAFile string
+	// Allow are the IPs or CIDRs allowed to reach the admin listener,
+	// by default only loopback addresses
+	Allow []string
+	// AuditLog is the file audit entries are appended to, by default stderr
+	AuditLog string
+}
+
+// Guard is an http.Handler that only passes allowed
+// and authenticated requests to the next handler, auditing every request
+type Guard struct {
+	cfg   Config
+	next  http.Handler
+	audit *log.Logger
+
+	mu     sync.RWMutex
+	tokens [][]byte
+	allow  []*net.IPNet
+}
+
+// NewGuard returns a new reference to a Guard protecting the handler provided
+func NewGuard(cfg Config, next http.Handler) (*Guard, error) {
+	g := &Guard{cfg: cfg, next: next}
+
+	var w io.Writer = os.Stderr
+	if cfg.AuditLog != "" {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	g.audit = log.New(w, "admin audit: ", log.LstdFlags|log.LUTC)
+
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload re-reads the token file and allowlist,
+// keeping the current ones if either is invalid
+func (g *Guard) Reload() error {
+	g.mu.RLock()
+	cfg := g.cfg
+	g.mu.RUnlock()
+
+	apply, err := g.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare reads the tokens and allowlist of the config, returning
+// a func that switches the Guard to them
+func (g *Guard) Prepare(cfg Config) (func(), error) {
+	tokens := make([][]byte, 0, len(cfg.Tokens))
+	for _, t := range cfg.Tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, []byte(t))
+		}
+	}
+
+	if cfg.TokenFile != "" {
+		f, err := os.Open(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if t := strings.TrimSpace(scanner.Text()); t != "" && !strings.HasPrefix(t, "#") {
+				tokens = append(tokens, []byte(t))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	allow, err := ParseAllow(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	// without authentication only this host may reach the admin routes
+	if len(tokens) == 0 && cfg.ClientCAFile == "" && !loopbackOnly(allow) {
+		return nil, errors.New("an admin allowlist beyond loopback requires admin tokens or a client CA")
+	}
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.cfg.Tokens = cfg.Tokens
+		g.cfg.TokenFile = cfg.TokenFile
+		g.cfg.Allow = cfg.Allow
+		g.tokens = tokens
+		g.allow = allow
+	}, nil
+}
+
+// ServeHTTP implements the http.Handler interface
+func (g *Guard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	identity := "-"
+
+	defer func() {
+		g.audit.Printf("remote=%v identity=%v method=%v path=%q status=%v duration=%v request_id=%v",
+			r.RemoteAddr, identity, r.Method, r.URL.Path, rec.status, time.Since(start), requestid.From(r.Context()))
+	}()
+
+	if !g.allowed(r) {
+		http.Error(rec, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, ok := g.authenticate(r)
+	if !ok {
+		rec.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(rec, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	identity = id
+
+	g.next.ServeHTTP(rec, r)
+}
+
+// allowed reports whether the request comes from an allowed address,
+// those over a unix domain socket are restricted by the socket's permissions
+// instead, and those over an abstract socket, which has none, are refused
+func (g *Guard) allowed(r *http.Request) bool {
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		return !strings.HasPrefix(local.String(), "@")
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, n := range g.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the identity of the client certificate or bearer token
+// the request authenticated with
+func (g *Guard) authenticate(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+
+	if !g.authenticates() {
+		return "anonymous", true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	ok := false
+	for _, t := range g.tokens {
+		// compare against every token so timing doesn't reveal which matched
+		if subtle.ConstantTimeCompare(t, token) == 1 {
+			ok = true
+		}
+	}
+	if !ok {
+		return "", false
+	}
+
+	// identify the token without logging it
+	sum := sha256.Sum256(token)
+	return "token:" + hex.EncodeToString(sum[:4]), true
+}
+
+// authenticates reports whether requests must present a token or client certificate
+func (g *Guard) authenticates() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.tokens) > 0 || g.cfg.ClientCAFile != ""
+}
+
+// TLSConfig returns the TLS configuration of the admin listener serving
+// the certificate provided, or nil when it serves plain HTTP
+func TLSConfig(cfg Config, cert *certs.Certificate) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.ClientCAFile != "" {
+		return nil, errors.New("admin client CA requires a certificate and key")
+	}
+
+	// token authenticated clients may still connect without a certificate
+	return certs.TLSConfig(certs.Config{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		ClientCAFile: cfg.ClientCAFile,
+		ClientAuth:   certs.Optional,
+	}, cert)
+}
+
+// ParseAllow parses IPs and CIDRs, defaulting to loopback addresses
+func ParseAllow(allow []string) ([]*net.IPNet, error) {
+	if len(allow) == 0 {
+		allow = loopback
+	}
+
+	nets := make([]*net.IPNet, 0, len(allow))
+	for _, a := range allow {
+		a = strings.TrimSpace(a)
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid admin allowlist address %q", a)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin allowlist cidr %q", a)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// loopbackOnly reports whether every address of the networks is a loopback address
+func loopbackOnly(nets []*net.IPNet) bool {
+	for _, n := range nets {
+		ones, bits := n.Mask.Size()
+		if !n.IP.IsLoopback() || (bits == 8*net.IPv4len && ones < 8) || (bits == 8*net.IPv6len && ones < bits) {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder records the status for the audit log. It can't be the
+// handler package's Response, which imports this package
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming admin routes such as exports flush through the recorder
+func (r *statusRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap lets an http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
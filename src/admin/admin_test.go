@@ -0,0 +1,166 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestGuard(t *testing.T, cfg Config) (*Guard, *bytes.Buffer) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	g, err := NewGuard(cfg, ok)
+	if err != nil {
+		t.Fatalf("NewGuard errored \n\n %v", err)
+	}
+
+	var audit bytes.Buffer
+	g.audit = log.New(&audit, "", 0)
+	return g, &audit
+}
+
+func request(g *Guard, remote, token string) int {
+	r := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+	r.RemoteAddr = remote
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestGuardAllowlist(t *testing.T) {
+	g, audit := newTestGuard(t, Config{})
+
+	if code := request(g, "127.0.0.1:5000", ""); code != http.StatusOK {
+		t.Errorf("Guard rejected a loopback request. Returned: %v", code)
+	}
+	if code := request(g, "10.0.0.1:5000", ""); code != http.StatusForbidden {
+		t.Errorf("Guard did not forbid a request from outside the allowlist. Returned: %v", code)
+	}
+
+	g, _ = newTestGuard(t, Config{Tokens: []string{"token"}, Allow: []string{"10.0.0.0/8", "192.168.1.1"}})
+	if code := request(g, "10.1.2.3:5000", "token"); code != http.StatusOK {
+		t.Errorf("Guard rejected a request from an allowed cidr. Returned: %v", code)
+	}
+	if code := request(g, "192.168.1.2:5000", "token"); code != http.StatusForbidden {
+		t.Errorf("Guard allowed a request from outside the allowlist. Returned: %v", code)
+	}
+
+	// unix domain socket peers have no address, abstract sockets no permissions
+	for name, expected := range map[string]int{"/run/admin.sock": http.StatusOK, "@admin": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+		r.RemoteAddr = "@"
+		r.Header.Set("Authorization", "Bearer token")
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: name, Net: "unix"}))
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("Guard responded %v to a request over %v, expected %v", w.Code, name, expected)
+		}
+	}
+
+	if !bytes.Contains(audit.Bytes(), []byte("status=403")) {
+		t.Errorf("Guard did not audit the forbidden request. Audit: %v", audit.String())
+	}
+
+	if _, err := ParseAllow([]string{"not an ip"}); err == nil {
+		t.Errorf("ParseAllow did not error on an invalid address")
+	}
+}
+
+func TestGuardRequiresAuthentication(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, allow := range [][]string{{"10.0.0.0/8"}, {"127.0.0.1", "0.0.0.0/0"}, {"::/0"}, {"0.0.0.0/1"}} {
+		if _, err := NewGuard(Config{Allow: allow}, ok); err == nil {
+			t.Errorf("NewGuard did not error without authentication allowing %v", allow)
+		}
+	}
+	if _, err := NewGuard(Config{Allow: []string{"127.0.0.1", "127.0.0.0/8", "::1"}}, ok); err != nil {
+		t.Errorf("NewGuard errored without authentication allowing only loopback \n\n %v", err)
+	}
+
+	// a reload can't widen the allowlist of an unauthenticated guard either
+	g, _ := newTestGuard(t, Config{})
+	if _, err := g.Prepare(Config{Allow: []string{"10.0.0.0/8"}}); err == nil {
+		t.Errorf("Prepare did not error without authentication allowing 10.0.0.0/8")
+	}
+}
+
+func TestGuardTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf("unable to create a temp directory \n\n %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(file, []byte("# comment\nsecond\n"), 0600)
+
+	g, audit := newTestGuard(t, Config{Tokens: []string{"first"}, TokenFile: file})
+
+	if code := request(g, "127.0.0.1:5000", ""); code != http.StatusUnauthorized {
+		t.Errorf("Guard did not require a token. Returned: %v", code)
+	}
+	if code := request(g, "127.0.0.1:5000", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Guard accepted a wrong token. Returned: %v", code)
+	}
+	if code := request(g, "127.0.0.1:5000", "first"); code != http.StatusOK {
+		t.Errorf("Guard rejected a configured token. Returned: %v", code)
+	}
+	if code := request(g, "127.0.0.1:5000", "second"); code != http.StatusOK {
+		t.Errorf("Guard rejected a token from the token file. Returned: %v", code)
+	}
+
+	// reloading picks up tokens added to and removed from the file
+	ioutil.WriteFile(file, []byte("third\n"), 0600)
+	if err := g.Reload(); err != nil {
+		t.Fatalf("Reload errored \n\n %v", err)
+	}
+	if code := request(g, "127.0.0.1:5000", "second"); code != http.StatusUnauthorized {
+		t.Errorf("Guard accepted a token removed from the token file. Returned: %v", code)
+	}
+	if code := request(g, "127.0.0.1:5000", "third"); code != http.StatusOK {
+		t.Errorf("Guard rejected a token added to the token file. Returned: %v", code)
+	}
+
+	if bytes.Contains(audit.Bytes(), []byte("third")) {
+		t.Errorf("Guard wrote a token to the audit log. Audit: %v", audit.String())
+	}
+	if !bytes.Contains(audit.Bytes(), []byte("identity=token:")) {
+		t.Errorf("Guard did not audit the token identity. Audit: %v", audit.String())
+	}
+}
+
+func TestGuardResponseController(t *testing.T) {
+	g, audit := newTestGuard(t, Config{})
+	g.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// long running admin routes, e.g. exports, extend their write deadline
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/admin/export", "", nil)
+	if err != nil {
+		t.Fatalf("POST /admin/export errored \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Guard hid the underlying writer from a response controller. Returned: %v", resp.StatusCode)
+	}
+	if !bytes.Contains(audit.Bytes(), []byte("status=202")) {
+		t.Errorf("Guard did not audit the status. Audit: %v", audit.String())
+	}
+}
@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	mu          sync.RWMutex
+	draining    bool
+	maintenance bool
+	reloader    func() (ReloadReport, error)
+)
+
+// Drain stops this instance accepting new work,
+// it keeps draining until resumed or the process exits
+func Drain() {
+	mu.Lock()
+	defer mu.Unlock()
+	draining = true
+}
+
+// Resume accepts new work again after draining
+func Resume() {
+	mu.Lock()
+	defer mu.Unlock()
+	draining = false
+}
+
+// Draining reports whether this instance is draining
+func Draining() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return draining
+}
+
+// SetMaintenance turns maintenance mode on or off
+func SetMaintenance(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	maintenance = enabled
+}
+
+// Maintenance reports whether this instance is in maintenance mode
+func Maintenance() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return maintenance
+}
+
+// ReloadReport lists the settings a reload changed
+type ReloadReport struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+// SetReloader registers fn to be called on every reload
+func SetReloader(fn func() (ReloadReport, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	reloader = fn
+}
+
+// Reload calls the registered reloader
+func Reload() (ReloadReport, error) {
+	mu.RLock()
+	fn := reloader
+	mu.RUnlock()
+
+	if fn == nil {
+		return ReloadReport{}, errors.New("reloading is not supported")
+	}
+	return fn()
+}
@@ -1,10 +1,268 @@
 // Package cache is our usage of in memory data state and storage
 package cache
 
-import "time"
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-// InMemoryPasswordStorage maps the id of a hash password as the key and the hash as a value
-var InMemoryPasswordStorage = map[string]string{"abc123": "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZP ZklJz0Fd7su2A+gf7Q=="}
+// Record represents a hashed password and its metadata
+type Record struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Change operations
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Change is an entry of the store's change log. Offsets start at 1
+// and increase by one with every record put in or deleted from the store
+type Change struct {
+	Offset uint64 `json:"offset"`
+	Op     string `json:"op"`
+	Record Record `json:"record"`
+}
+
+// DefaultRetain is the number of changes a Store keeps in its log by default
+const DefaultRetain = 10000
+
+// ErrCompacted is returned reading changes that have been compacted out of the log
+var ErrCompacted = errors.New("cache: changes compacted")
+
+// Storage is the storage records are written through. Put returns
+// once the backend has accepted the record
+type Storage interface {
+	Get(id string) (Record, bool)
+	Put(r Record) error
+	Range(fn func(Record) bool)
+}
+
+// ContextPutter is a Storage whose writes stop when the context is done.
+// A write given up on before the backend accepted it isn't stored
+type ContextPutter interface {
+	PutContext(ctx context.Context, r Record) error
+}
+
+// Store is a concurrency safe in memory storage of password records
+// which keeps a log of its latest changes for replication
+type Store struct {
+	mu      sync.RWMutex
+	records map[string]Record
+	log     []Change
+	// compacted is the offset of the last change dropped from the log
+	compacted uint64
+	retain    int
+	notify    chan struct{}
+}
+
+// NewStore returns a new reference to an empty Store
+func NewStore() *Store {
+	return &Store{
+		records: make(map[string]Record),
+		retain:  DefaultRetain,
+		notify:  make(chan struct{}),
+	}
+}
+
+// SetRetain sets the number of changes kept in the log,
+// readers further behind must start over from a Snapshot
+func (s *Store) SetRetain(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retain = n
+	s.compact()
+}
+
+// Get returns the record stored under id
+// and whether or not it was found
+func (s *Store) Get(id string) (Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.records[id]
+	return r, ok
+}
+
+// Put stores the record, replacing any record with the same id,
+// and appends it to the change log
+// It never fails, the error is to satisfy Storage
+func (s *Store) Put(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[r.ID] = r
+	s.appendChange(OpPut, r)
+	return nil
+}
+
+// Delete removes the record stored under id,
+// appending the deletion to the change log if it existed
+func (s *Store) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return
+	}
+	delete(s.records, id)
+	s.appendChange(OpDelete, r)
+}
+
+// Replace replaces the contents of the store with the records provided,
+// logging the changes it takes. Readers see either the old or new contents
+func (s *Store) Replace(records []Record) {
+	next := make(map[string]Record, len(records))
+	for _, r := range records {
+		next[r.ID] = r
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, r := range s.records {
+		if _, ok := next[id]; !ok {
+			s.appendChange(OpDelete, r)
+		}
+	}
+	for _, r := range records {
+		s.appendChange(OpPut, r)
+	}
+	s.records = next
+}
+
+// Apply applies a change, usually from another store's change log
+func (s *Store) Apply(c Change) {
+	if c.Op == OpDelete {
+		s.Delete(c.Record.ID)
+		return
+	}
+	s.Put(c.Record)
+}
+
+// appendChange logs the change and wakes anyone waiting on one
+// The caller must hold the write lock
+func (s *Store) appendChange(op string, r Record) {
+	s.log = append(s.log, Change{s.compacted + uint64(len(s.log)) + 1, op, r})
+	// compacting once the log is twice what's kept keeps appends cheap
+	if len(s.log) >= 2*s.retain {
+		s.compact()
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// compact drops all but the changes retained from the log
+// The caller must hold the write lock
+func (s *Store) compact() {
+	if drop := len(s.log) - s.retain; drop > 0 {
+		s.log = append([]Change(nil), s.log[drop:]...)
+		s.compacted += uint64(drop)
+	}
+}
+
+// Offset returns the offset of the last change in the log
+func (s *Store) Offset() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.compacted + uint64(len(s.log))
+}
+
+// Compacted returns the offset of the last change dropped from the log,
+// changes after it can still be read
+func (s *Store) Compacted() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.compacted
+}
+
+// ChangesSince returns up to limit changes after the offset provided,
+// or ErrCompacted when some of them have been dropped from the log
+func (s *Store) ChangesSince(offset uint64, limit int) ([]Change, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if offset < s.compacted {
+		return nil, ErrCompacted
+	}
+	if offset >= s.compacted+uint64(len(s.log)) {
+		return nil, nil
+	}
+
+	changes := s.log[offset-s.compacted:]
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return append([]Change(nil), changes...), nil
+}
+
+// Snapshot returns every record stored and the offset of the last change they include
+func (s *Store) Snapshot() ([]Record, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	return records, s.compacted + uint64(len(s.log))
+}
+
+// Changed returns a channel that is closed on the next change to the store
+func (s *Store) Changed() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.notify
+}
+
+// Len returns the number of records stored
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.records)
+}
+
+// Range calls fn for every record ordered by id, until fn returns false.
+// The store is only locked while reading each record, so slow
+// consumers like a streaming export do not block writers
+func (s *Store) Range(fn func(Record) bool) {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.records))
+	for id := range s.records {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		r, ok := s.Get(id)
+		if !ok {
+			continue
+		}
+		if !fn(r) {
+			return
+		}
+	}
+}
+
+// InMemoryPasswordStorage maps the id of a hash password as the key and the record as a value
+var InMemoryPasswordStorage = NewStore()
+
+// PasswordStorage is the backend handlers read and write passwords through,
+// by default the in memory store
+var PasswordStorage Storage = InMemoryPasswordStorage
 
 // InMemoryRequestLog maps api request durations
 var InMemoryRequestLog = make(map[int]time.Duration)
+
+// RecoveredPanics counts the panics recovered while serving requests
+var RecoveredPanics atomic.Int64
+
+func init() {
+	InMemoryPasswordStorage.Put(Record{
+		ID:   "abc123",
+		Hash: "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZP ZklJz0Fd7su2A+gf7Q==",
+	})
+}
@@ -0,0 +1,329 @@
+/*
+Package certs configures serving over TLS.
+
+	A Certificate holds the certificate served, loaded from a certificate
+	and key file and reloaded when either file changes, so renewed
+	certificates are picked up without a restart. Clients may be required
+	to present a certificate signed by a CA bundle, and in development a
+	self signed certificate can be generated at startup instead.
+*/
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cipher policies
+const (
+	// Modern only allows AEAD ciphers with forward secrecy
+	Modern = "modern"
+	// Compatible also allows CBC ciphers for older clients
+	Compatible = "compatible"
+)
+
+// Client certificate policies
+const (
+	// Optional verifies a client certificate when one is presented
+	Optional = "optional"
+	// Require rejects clients without a verified certificate
+	Require = "require"
+)
+
+// DefaultReloadInterval is how often certificate files are checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// versions are the minimum TLS versions that may be configured
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ciphers are the TLS 1.2 cipher suites of each policy, TLS 1.3 suites aren't configurable
+var ciphers = map[string][]uint16{
+	Modern: {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	},
+	Compatible: {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	},
+}
+
+// Config configures a TLS listener
+type Config struct {
+	// CertFile and KeyFile are the certificate served
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies client certificates against its CAs
+	ClientCAFile string
+	// ClientAuth is Optional or Require, by default Require
+	ClientAuth string
+	// MinVersion is 1.2 or 1.3, by default 1.2
+	MinVersion string
+	// Ciphers is Modern or Compatible, by default Modern
+	Ciphers string
+	// SelfSigned serves a certificate generated for Hosts
+	// instead of one loaded from files, for development only
+	SelfSigned bool
+	Hosts      []string
+}
+
+// Enabled reports whether the config serves TLS
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.SelfSigned
+}
+
+// Validate returns every problem with the config joined in one error
+func (c Config) Validate() error {
+	var errs []error
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, errors.New("a certificate and key must be set together"))
+	}
+	if c.SelfSigned && c.CertFile != "" {
+		errs = append(errs, errors.New("a self signed certificate can't be used with a certificate file"))
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		errs = append(errs, errors.New("a client ca requires a certificate"))
+	}
+	if c.ClientAuth != "" && c.ClientAuth != Optional && c.ClientAuth != Require {
+		errs = append(errs, fmt.Errorf("client auth must be %v or %v, got %q", Optional, Require, c.ClientAuth))
+	}
+	if _, ok := versions[c.MinVersion]; c.MinVersion != "" && !ok {
+		errs = append(errs, fmt.Errorf("min version must be 1.2 or 1.3, got %q", c.MinVersion))
+	}
+	if _, ok := ciphers[c.Ciphers]; c.Ciphers != "" && !ok {
+		errs = append(errs, fmt.Errorf("ciphers must be %v or %v, got %q", Modern, Compatible, c.Ciphers))
+	}
+	return errors.Join(errs...)
+}
+
+// TLSConfig returns the TLS configuration serving the certificate provided,
+// loading it from the config's files or generating a self signed one,
+// or nil when the config doesn't serve TLS
+func TLSConfig(cfg Config, cert *Certificate) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.SelfSigned {
+		generated, err := SelfSigned(cfg.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		cert.set(&generated, "", "", fileTimes{})
+		log.Printf("Serving a self signed certificate for %v, sha256 fingerprint %v", cfg.Hosts, Fingerprint(generated.Leaf))
+	} else {
+		apply, err := cert.Prepare(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		apply()
+	}
+
+	c := &tls.Config{
+		GetCertificate: cert.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites:   ciphers[Modern],
+	}
+	if cfg.MinVersion != "" {
+		c.MinVersion = versions[cfg.MinVersion]
+	}
+	if cfg.Ciphers != "" {
+		c.CipherSuites = ciphers[cfg.Ciphers]
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", cfg.ClientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.ClientAuth == Optional {
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return c, nil
+}
+
+// fileTimes are the modification times of a certificate and key file
+type fileTimes struct {
+	cert, key time.Time
+}
+
+// Certificate holds the certificate served, which can be replaced while serving
+type Certificate struct {
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	loaded   fileTimes
+}
+
+// Prepare loads the certificate and key, returning a func that switches
+// to serving them
+func (c *Certificate) Prepare(certFile, keyFile string) (func(), error) {
+	times, err := stat(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { c.set(&cert, certFile, keyFile, times) }, nil
+}
+
+func (c *Certificate) set(cert *tls.Certificate, certFile, keyFile string, times fileTimes) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = cert
+	c.certFile = certFile
+	c.keyFile = keyFile
+	c.loaded = times
+}
+
+// GetCertificate implements the tls.Config GetCertificate func
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate whenever its files change, checking every interval
+// until the context is done. A certificate that fails to load, e.g. as it is
+// half written, is logged and retried once the files change again
+func (c *Certificate) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.reload()
+		}
+	}
+}
+
+// reload loads the certificate again when its files have changed since it was loaded
+func (c *Certificate) reload() {
+	c.mu.RLock()
+	certFile, keyFile, loaded := c.certFile, c.keyFile, c.loaded
+	c.mu.RUnlock()
+
+	if certFile == "" {
+		return
+	}
+	times, err := stat(certFile, keyFile)
+	if err != nil || times == loaded {
+		return
+	}
+
+	apply, err := c.Prepare(certFile, keyFile)
+	if err != nil {
+		log.Printf("Certificate %v changed but failed to load, still serving the previous one: %v", certFile, err)
+		c.mu.Lock()
+		c.loaded = times
+		c.mu.Unlock()
+		return
+	}
+	apply()
+	log.Printf("Reloaded certificate %v", certFile)
+}
+
+func stat(certFile, keyFile string) (fileTimes, error) {
+	ci, err := os.Stat(certFile)
+	if err != nil {
+		return fileTimes{}, err
+	}
+	ki, err := os.Stat(keyFile)
+	if err != nil {
+		return fileTimes{}, err
+	}
+	return fileTimes{ci.ModTime(), ki.ModTime()}, nil
+}
+
+// SelfSigned generates a certificate for the host names and IPs provided,
+// valid for a year
+func SelfSigned(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"cloud-jumper development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,201 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue returns a certificate signed by the parent, or self signed when parent is nil
+func issue(t *testing.T, cn string, parent *tls.Certificate, ca bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate a key \n\n %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("unable to create a certificate \n\n %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// write writes the certificate and key as PEM files named after it, returning their paths
+func write(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("unable to marshal the key \n\n %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	return certFile, keyFile
+}
+
+// serve serves TLS on a new listener, responding with the client's certificate common name
+func serve(t *testing.T, c *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen \n\n %v", err)
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			fmt.Fprint(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		}
+	})}
+	go s.Serve(tls.NewListener(l, c))
+	t.Cleanup(func() { s.Close() })
+	return "https://" + l.Addr().String()
+}
+
+func get(url string, c *tls.Config) (*http.Response, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+	return client.Get(url)
+}
+
+func TestSelfSigned(t *testing.T) {
+	cert := &Certificate{}
+	c, err := TLSConfig(Config{SelfSigned: true, Hosts: []string{"127.0.0.1"}, MinVersion: "1.3"}, cert)
+	if err != nil {
+		t.Fatalf("TLSConfig errored \n\n %v", err)
+	}
+	url := serve(t, c)
+
+	served, _ := cert.GetCertificate(nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(served.Leaf)
+
+	resp, err := get(url, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("TestSelfSigned did not verify the generated certificate \n\n %v", err)
+	}
+	resp.Body.Close()
+
+	// the minimum version is enforced
+	if _, err := get(url, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Errorf("TestSelfSigned accepted a version below the minimum")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "test ca", nil, true)
+	caFile, _ := write(t, dir, "ca", ca)
+	certFile, keyFile := write(t, dir, "server", issue(t, "server", &ca, false))
+
+	c, err := TLSConfig(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}, &Certificate{})
+	if err != nil {
+		t.Fatalf("TLSConfig errored \n\n %v", err)
+	}
+	url := serve(t, c)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	if _, err := get(url, &tls.Config{RootCAs: roots}); err == nil {
+		t.Errorf("TestClientAuth accepted a client without a certificate")
+	}
+
+	client := issue(t, "client-a", &ca, false)
+	resp, err := get(url, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatalf("TestClientAuth rejected a client with a certificate \n\n %v", err)
+	}
+	defer resp.Body.Close()
+	var body [32]byte
+	n, _ := resp.Body.Read(body[:])
+	if string(body[:n]) != "client-a" {
+		t.Errorf("TestClientAuth did not expose the client identity. Returned: %q", body[:n])
+	}
+
+	// a certificate from another CA is rejected
+	other := issue(t, "other", nil, false)
+	if _, err := get(url, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{other}}); err == nil {
+		t.Errorf("TestClientAuth accepted a certificate from an unknown CA")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := write(t, dir, "server", issue(t, "first", nil, false))
+
+	cert := &Certificate{}
+	apply, err := cert.Prepare(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Prepare errored \n\n %v", err)
+	}
+	apply()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cert.Watch(ctx, 10*time.Millisecond)
+
+	// a half written certificate keeps the previous one
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	time.Sleep(50 * time.Millisecond)
+	if served, _ := cert.GetCertificate(nil); served.Leaf.Subject.CommonName != "first" {
+		t.Errorf("TestWatch replaced the certificate with one that failed to load")
+	}
+
+	write(t, dir, "server", issue(t, "second", nil, false))
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+
+	for i := 0; i < 100; i++ {
+		if served, _ := cert.GetCertificate(nil); served.Leaf.Subject.CommonName == "second" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("TestWatch did not reload the changed certificate")
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []Config{
+		{CertFile: "cert.pem"},
+		{SelfSigned: true, CertFile: "cert.pem", KeyFile: "key.pem"},
+		{ClientCAFile: "ca.pem"},
+		{SelfSigned: true, ClientAuth: "sometimes"},
+		{SelfSigned: true, MinVersion: "1.0"},
+		{SelfSigned: true, Ciphers: "legacy"},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate accepted an invalid config %+v", c)
+		}
+	}
+}
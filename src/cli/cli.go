@@ -0,0 +1,191 @@
+/*
+Package cli implements the cloud-jumper sub commands.
+
+	Sub commands are clients of the admin api of a running server, e.g.
+
+	cloud-jumper export -format csv -o backup.csv
+	cloud-jumper import -conflict overwrite -dry-run backup.csv
+*/
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/caoakleyii/cloud-jumper/src/transfer"
+)
+
+const defaultAddr = "http://localhost:8081"
+
+// Run executes the sub command named by args[0]
+// with the remaining args as its flags
+func Run(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing sub command, expected export or import")
+	}
+
+	switch args[0] {
+	case "export":
+		return export(args[1:], os.Stdout)
+	case "import":
+		return importFile(args[1:], os.Stdin, os.Stdout)
+	}
+	return fmt.Errorf("unknown sub command %q, expected export or import", args[0])
+}
+
+// adminToken reads the admin token from the environment the way the server
+// does, preferring CLOUD_JUMPER_ADMIN_TOKEN over the bare ADMIN_TOKEN
+func adminToken() string {
+	if t := os.Getenv("CLOUD_JUMPER_ADMIN_TOKEN"); t != "" {
+		return t
+	}
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// export streams the store of the server to a file or stdout
+func export(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	addr := fs.String("addr", defaultAddr, "base url of the server's admin api, or unix:/path of its socket")
+	token := fs.String("token", adminToken(), "bearer token for the admin api, defaults to $CLOUD_JUMPER_ADMIN_TOKEN or $ADMIN_TOKEN")
+	format := fs.String("format", "", "ndjson or csv, defaults to the output file extension or ndjson")
+	out := fs.String("o", "", "output file, defaults to stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f := formatOf(*format, *out)
+	base, client := target(*addr)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%v/admin/export?format=%v", base, url.QueryEscape(f)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := do(client, req, *token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	w := stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// importFile streams a file or stdin to the import endpoint of the server
+// and writes the report to stdout
+func importFile(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	addr := fs.String("addr", defaultAddr, "base url of the server's admin api, or unix:/path of its socket")
+	token := fs.String("token", adminToken(), "bearer token for the admin api, defaults to $CLOUD_JUMPER_ADMIN_TOKEN or $ADMIN_TOKEN")
+	format := fs.String("format", "", "ndjson or csv, defaults to the input file extension or ndjson")
+	conflict := fs.String("conflict", transfer.Skip, "skip, overwrite or fail when an id already exists")
+	dryRun := fs.Bool("dry-run", false, "report the changes without storing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	in := fs.Arg(0)
+	r := stdin
+	if in != "" && in != "-" {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	f := formatOf(*format, in)
+	q := url.Values{}
+	q.Set("format", f)
+	q.Set("conflict", *conflict)
+	q.Set("dry_run", strconv.FormatBool(*dryRun))
+
+	base, client := target(*addr)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/admin/import?%v", base, q.Encode()), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", transfer.ContentType(f))
+	resp, err := do(client, req, *token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return responseError(resp)
+	}
+
+	if _, err = io.Copy(stdout, resp.Body); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout)
+
+	if resp.StatusCode == http.StatusConflict {
+		return transfer.ErrConflict
+	}
+	return nil
+}
+
+// formatOf returns the format if provided,
+// otherwise it is based on the file extension
+func formatOf(format, file string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		return transfer.CSV
+	}
+	return transfer.NDJSON
+}
+
+// target returns the base url of the admin api and the client reaching it,
+// which connects to the socket of a unix:/path or unix:@name address
+func target(addr string) (string, *http.Client) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return strings.TrimRight(addr, "/"), http.DefaultClient
+	}
+
+	return "http://unix", &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// do sends the request with the client, authenticating with the token if provided
+func do(client *http.Client, req *http.Request, token string) (*http.Response, error) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
+
+func responseError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("server responded %v: %v", resp.Status, strings.TrimSpace(string(b)))
+}
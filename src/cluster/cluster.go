@@ -0,0 +1,243 @@
+/*
+Package cluster implements sharding of the password store across a cluster of nodes.
+
+	Every node is configured with the base url of its own peer listener and a
+	static list of those of its peers. Ids are mapped to their owning node with
+	a consistent hashing ring, so any node can accept a request and forward it
+	to the owner's peer listener. When peers are added, a rebalance moves
+	records to their new owners.
+*/
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/peer"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// Headers set on requests forwarded between nodes, only honoured
+// on requests authenticated by the peer listener
+const (
+	// ForwardedHeader holds the node that forwarded the request,
+	// a forwarded request is always handled by the node receiving it
+	ForwardedHeader = "X-Cluster-Forwarded"
+	// IDHeader holds the id the forwarding node generated for a new password
+	IDHeader = "X-Cluster-Id"
+)
+
+// RecordsPath is the path nodes receive records on during a rebalance
+const RecordsPath = "/cluster/records"
+
+// rebalanceBatch is the most records sent to an owner in one request
+const rebalanceBatch = 500
+
+var (
+	mu          sync.RWMutex
+	self        string
+	ring        *Ring
+	unavailable func(peer string) bool
+	// requests forwarded for a client pass on its request id
+	client = &http.Client{Timeout: 30 * time.Second, Transport: &peer.Transport{Base: &requestid.Transport{}}}
+)
+
+// Status describes this node's view of the cluster
+type Status struct {
+	Self  string   `json:"self"`
+	Peers []string `json:"peers"`
+}
+
+// Report summarizes the result of a rebalance
+type Report struct {
+	Kept  int `json:"kept"`
+	Moved int `json:"moved"`
+	// Skipped are the records the owner already held another record under
+	// the id of, so it kept its own and they're kept here too
+	Skipped int      `json:"skipped"`
+	Failed  int      `json:"failed"`
+	Errors  []string `json:"errors"`
+}
+
+// Configure enables cluster mode with the base url of this node
+// and the base urls of its peers, replacing any previous configuration
+func Configure(selfURL string, peers []string) {
+	selfURL = normalize(selfURL)
+	all := []string{selfURL}
+	for _, p := range peers {
+		if p = normalize(p); p != "" {
+			all = append(all, p)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	self = selfURL
+	ring = NewRing(DefaultReplicas, all...)
+}
+
+// Enabled reports whether this node is part of a cluster
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return ring != nil
+}
+
+// CurrentStatus returns this node's view of the cluster
+func CurrentStatus() Status {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ring == nil {
+		return Status{Peers: []string{}}
+	}
+	return Status{self, ring.Peers()}
+}
+
+// SetUnavailable registers fn to report peers that are unavailable,
+// such as those failure detection has declared dead, so ids they own
+// are routed to the next peer on the ring instead
+func SetUnavailable(fn func(peer string) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	unavailable = fn
+}
+
+// Owner returns the node owning the id and whether it is this node.
+// Without a cluster every id is owned by this node
+func Owner(id string) (string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if ring == nil {
+		return self, true
+	}
+
+	owner := ring.OwnerFunc(id, func(peer string) bool {
+		return peer != self && unavailable != nil && unavailable(peer)
+	})
+	return owner, owner == self
+}
+
+// IsForwarded reports whether the request was forwarded by another node,
+// which only requests the peer listener authenticated can be
+func IsForwarded(r *http.Request) bool {
+	return peer.Authenticated(r) && r.Header.Get(ForwardedHeader) != ""
+}
+
+// Forward sends the request to the peer with the body and headers provided,
+// marking it as forwarded by this node. The caller must close the response body
+func Forward(peer string, r *http.Request, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, peer+r.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	mu.RLock()
+	req.Header.Set(ForwardedHeader, self)
+	mu.RUnlock()
+
+	return client.Do(req)
+}
+
+// Rebalance moves every record in s that is owned by another node to its owner,
+// deleting each record locally once its owner has stored it
+func Rebalance(s *cache.Store) Report {
+	report := Report{Errors: []string{}}
+	moving := make(map[string][]cache.Record)
+
+	s.Range(func(r cache.Record) bool {
+		owner, local := Owner(r.ID)
+		if local {
+			report.Kept++
+		} else {
+			moving[owner] = append(moving[owner], r)
+		}
+		return true
+	})
+
+	for owner, records := range moving {
+		for len(records) > 0 {
+			n := len(records)
+			if n > rebalanceBatch {
+				n = rebalanceBatch
+			}
+			batch := records[:n]
+			records = records[n:]
+
+			skipped, err := send(owner, batch)
+			if err != nil {
+				report.Failed += len(batch)
+				report.Errors = append(report.Errors, fmt.Sprintf("%v: %v", owner, err))
+				continue
+			}
+
+			for _, r := range batch {
+				if skipped[r.ID] {
+					report.Skipped++
+					continue
+				}
+				s.Delete(r.ID)
+				report.Moved++
+			}
+		}
+	}
+	return report
+}
+
+// send posts the records as ndjson to the owner's records path,
+// returning the ids of those it skipped as it already held them
+func send(owner string, records []cache.Record) (map[string]bool, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, owner+RecordsPath, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	mu.RLock()
+	req.Header.Set(ForwardedHeader, self)
+	mu.RUnlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("owner responded %v: %v", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	// the owner imports with the skip policy, so its conflicts are skipped
+	var result struct {
+		Conflicts []string `json:"conflicts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("owner's report unreadable: %v", err)
+	}
+	skipped := make(map[string]bool, len(result.Conflicts))
+	for _, id := range result.Conflicts {
+		skipped[id] = true
+	}
+	return skipped, nil
+}
+
+func normalize(peer string) string {
+	return strings.TrimRight(strings.TrimSpace(peer), "/")
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/peer"
+)
+
+func TestRebalance(t *testing.T) {
+	received := cache.NewStore()
+	l, err := net.Listen("tcp", ":9997")
+	if err != nil {
+		t.Fatalf("unable to listen for the test server \n\n %v", err)
+	}
+	peer.SetSecret("shared")
+	defer peer.SetSecret("")
+	server := &http.Server{Handler: peer.Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsForwarded(r) {
+			http.Error(w, "Not Forwarded", http.StatusBadRequest)
+			return
+		}
+		conflicts := []string{}
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var rec cache.Record
+			if err := dec.Decode(&rec); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, ok := received.Get(rec.ID); ok {
+				conflicts = append(conflicts, rec.ID)
+				continue
+			}
+			received.Put(rec)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"conflicts": conflicts})
+	}))}
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+
+	Configure("http://localhost:9996", []string{"http://localhost:9997/"})
+	defer func() {
+		mu.Lock()
+		ring = nil
+		mu.Unlock()
+	}()
+
+	s := cache.NewStore()
+	taken := ""
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("id%v", i)
+		s.Put(cache.Record{ID: id, Hash: "hash"})
+		if _, local := Owner(id); !local && taken == "" {
+			taken = id
+		}
+	}
+	// the owner already holds another record under one of the ids
+	received.Put(cache.Record{ID: taken, Hash: "other"})
+
+	report := Rebalance(s)
+	if report.Failed != 0 || report.Moved == 0 || report.Kept == 0 || report.Skipped != 1 {
+		t.Errorf("Rebalance did not move records between both nodes. Report: %+v", report)
+	}
+	if r, ok := s.Get(taken); !ok || r.Hash != "hash" {
+		t.Errorf("Rebalance deleted a record the owner skipped")
+	}
+
+	if report.Moved != received.Len()-1 || report.Kept+report.Skipped != s.Len() {
+		t.Errorf("Rebalance report did not match the records moved. Report: %+v | Received: %v | Kept: %v", report, received.Len(), s.Len())
+	}
+
+	received.Range(func(r cache.Record) bool {
+		if owner, local := Owner(r.ID); local || owner != "http://localhost:9997" {
+			t.Errorf("Rebalance moved %v to a node that does not own it", r.ID)
+		}
+		return true
+	})
+}
+
+func TestIsForwarded(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/hash", nil)
+	r.Header.Set(ForwardedHeader, "http://a")
+	if IsForwarded(r) {
+		t.Errorf("IsForwarded trusted a request the peer listener did not authenticate")
+	}
+
+	peer.SetSecret("shared")
+	defer peer.SetSecret("")
+	r.Header.Set("Authorization", "Bearer shared")
+	forwarded := false
+	peer.Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = IsForwarded(r)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if !forwarded {
+		t.Errorf("IsForwarded did not trust a request from another node")
+	}
+}
+
+func TestOwnerUnavailable(t *testing.T) {
+	Configure("http://a", []string{"http://b"})
+	defer func() {
+		mu.Lock()
+		ring, unavailable = nil, nil
+		mu.Unlock()
+	}()
+
+	SetUnavailable(func(p string) bool { return true })
+	for i := 0; i < 100; i++ {
+		if owner, local := Owner(fmt.Sprintf("key%v", i)); !local {
+			t.Errorf("Owner routed to an unavailable peer. Returned: %v", owner)
+		}
+	}
+}
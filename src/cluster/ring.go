@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of virtual nodes each peer has on a ring
+const DefaultReplicas = 128
+
+// Ring is a consistent hashing ring mapping keys to peers.
+// Each peer is placed on the ring many times as virtual nodes,
+// so keys spread evenly and adding a peer only moves the keys it takes over
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+	peers    []string
+}
+
+// NewRing returns a new reference to a Ring of the peers provided
+// with the number of virtual nodes per peer provided
+func NewRing(replicas int, peers ...string) *Ring {
+	if replicas < 1 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{replicas: replicas, owners: make(map[uint32]string)}
+	for _, p := range peers {
+		r.add(p)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func (r *Ring) add(peer string) {
+	for _, p := range r.peers {
+		if p == peer {
+			return
+		}
+	}
+	r.peers = append(r.peers, peer)
+
+	for i := 0; i < r.replicas; i++ {
+		h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + peer))
+		// on the rare collision the first peer keeps the virtual node
+		if _, ok := r.owners[h]; ok {
+			continue
+		}
+		r.owners[h] = peer
+		r.hashes = append(r.hashes, h)
+	}
+}
+
+// Peers returns the peers on the ring
+func (r *Ring) Peers() []string {
+	return append([]string(nil), r.peers...)
+}
+
+// Owner returns the peer owning the key provided,
+// or an empty string if the ring has no peers
+func (r *Ring) Owner(key string) string {
+	return r.OwnerFunc(key, nil)
+}
+
+// OwnerFunc returns the first peer clockwise of the key provided
+// that skip reports false for, so unavailable peers can be passed over
+func (r *Ring) OwnerFunc(key string, skip func(peer string) bool) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for n := 0; n < len(r.hashes); n++ {
+		p := r.owners[r.hashes[(i+n)%len(r.hashes)]]
+		if skip == nil || !skip(p) {
+			return p
+		}
+	}
+	return ""
+}
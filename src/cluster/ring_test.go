@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwner(t *testing.T) {
+	r := NewRing(DefaultReplicas, "http://a", "http://b", "http://c")
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%v", i)
+		owner := r.Owner(key)
+		if owner != r.Owner(key) {
+			t.Errorf("Ring.Owner did not return the same owner for %v", key)
+		}
+		counts[owner]++
+	}
+
+	for _, p := range r.Peers() {
+		if counts[p] < 500 {
+			t.Errorf("Ring.Owner did not spread keys evenly. Peer %v owns %v of 3000", p, counts[p])
+		}
+	}
+
+	if NewRing(DefaultReplicas).Owner("key") != "" {
+		t.Errorf("Ring.Owner returned an owner for an empty ring")
+	}
+}
+
+func TestRingAddPeer(t *testing.T) {
+	before := NewRing(DefaultReplicas, "http://a", "http://b", "http://c")
+	after := NewRing(DefaultReplicas, "http://a", "http://b", "http://c", "http://d")
+
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%v", i)
+		if o := after.Owner(key); o != before.Owner(key) && o != "http://d" {
+			t.Errorf("Ring moved %v between existing peers when a peer was added", key)
+		}
+	}
+}
+
+func TestRingOwnerFunc(t *testing.T) {
+	r := NewRing(DefaultReplicas, "http://a", "http://b")
+	skipA := func(p string) bool { return p == "http://a" }
+
+	for i := 0; i < 100; i++ {
+		if o := r.OwnerFunc(fmt.Sprintf("key%v", i), skipA); o != "http://b" {
+			t.Errorf("Ring.OwnerFunc did not skip the peer. Returned: %v", o)
+		}
+	}
+}
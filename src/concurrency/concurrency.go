@@ -0,0 +1,338 @@
+/*
+Package concurrency limits the requests a route serves at once, shedding the excess.
+
+	A rule caps the requests in flight to the paths under a prefix, optionally
+	only those of a method. Requests over the cap wait in a bounded queue for a
+	slot, first come first served, and are shed once the queue is full or they
+	have waited the queue timeout. Priority routes such as health checks are
+	never held back, so a node under load still answers its probes.
+
+	In adaptive mode each rule's cap moves between 1 and its configured maximum
+	by AIMD: every window the average latency is compared with the lowest seen.
+	Latency grown past the tolerance means the route is saturated and the cap is
+	cut by a fraction, otherwise a cap that was reached is raised by one.
+*/
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+)
+
+// ErrShed is returned for requests shed rather than served
+var ErrShed = errors.New("concurrency: request shed")
+
+// Adaptive mode
+const (
+	// Window is how often an adaptive cap is adjusted
+	Window = time.Second
+	// Tolerance is how many times the lowest average latency seen the
+	// average latency may reach before the cap is cut
+	Tolerance = 2.0
+	// Backoff is the fraction of the cap kept when it's cut
+	Backoff = 0.9
+	// forget is the fraction of the way the lowest latency seen moves up
+	// towards a higher average each window, so it follows the route slowing
+	forget = 0.05
+)
+
+// Rule caps the requests in flight to its target
+type Rule struct {
+	pathrule.Target
+	// Max is the most requests served at once
+	Max int
+	// Queue is the most requests waiting for a slot
+	Queue int
+}
+
+// ParseRule parses a rule written [METHOD ]/prefix=max[:queue], e.g. POST /hash=8:32
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	target, limit, err := pathrule.Parse(s, "max[:queue]")
+	if err != nil {
+		return r, fmt.Errorf("concurrency limit %q %v", s, err)
+	}
+	r.Target = target
+
+	n, queue, hasQueue := strings.Cut(limit, ":")
+	if r.Max, err = strconv.Atoi(n); err != nil || r.Max < 1 {
+		return r, fmt.Errorf("concurrency limit %q must allow at least 1 request", s)
+	}
+	if hasQueue {
+		if r.Queue, err = strconv.Atoi(queue); err != nil || r.Queue < 0 {
+			return r, fmt.Errorf("concurrency limit %q must have a queue of at least 0", s)
+		}
+	}
+	return r, nil
+}
+
+// String returns the rule as parsed by ParseRule
+func (r Rule) String() string {
+	return fmt.Sprintf("%v=%v:%v", r.Target, r.Max, r.Queue)
+}
+
+// Config configures a Limiter
+type Config struct {
+	// Rules are checked in order, the first matching a request caps it
+	Rules []string
+	// Priority are the path prefixes of requests never held back
+	Priority []string
+	// QueueTimeout is the longest a request waits for a slot, 0 for never waiting
+	QueueTimeout time.Duration
+	// Adaptive adjusts each rule's cap from the latency observed
+	Adaptive bool
+}
+
+// Limiter caps the requests in flight by rule
+type Limiter struct {
+	mu       sync.RWMutex
+	cfg      Config
+	limits   []*limit
+	priority []string
+	// now is replaced by tests
+	now func() time.Time
+}
+
+// New returns a new reference to a Limiter
+func New(cfg Config) (*Limiter, error) {
+	l := &Limiter{now: time.Now}
+	apply, err := l.Prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	return l, nil
+}
+
+// Validate returns an error when a rule or priority prefix is invalid
+func Validate(cfg Config) error {
+	_, err := parse(cfg)
+	return err
+}
+
+func parse(cfg Config) ([]Rule, error) {
+	rules := make([]Rule, 0, len(cfg.Rules))
+	for _, s := range cfg.Rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	for _, p := range cfg.Priority {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("concurrency priority %q is not a /prefix", p)
+		}
+	}
+	if cfg.QueueTimeout < 0 {
+		return nil, fmt.Errorf("concurrency queue timeout must not be negative, got %v", cfg.QueueTimeout)
+	}
+	return rules, nil
+}
+
+// Prepare parses the config, returning a func that switches the Limiter to it.
+// Rules left unchanged keep their requests in flight, queue and adaptive cap
+func (l *Limiter) Prepare(cfg Config) (func(), error) {
+	rules, err := parse(cfg)
+	if err != nil {
+		return nil, err
+	}
+	priority := make([]string, len(cfg.Priority))
+	for i, p := range cfg.Priority {
+		priority[i] = pathrule.Clean(p)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		kept := make(map[Rule]*limit)
+		for _, lim := range l.limits {
+			kept[lim.rule] = lim
+		}
+		limits := make([]*limit, len(rules))
+		for i, r := range rules {
+			if limits[i] = kept[r]; limits[i] == nil {
+				limits[i] = &limit{rule: r, cap: float64(r.Max)}
+			}
+			limits[i].configure(cfg.Adaptive)
+		}
+		l.cfg, l.limits, l.priority = cfg, limits, priority
+	}, nil
+}
+
+// Acquire takes a slot for the request from the first rule matching it, waiting in
+// the rule's queue while every slot is taken, and returns the func releasing it.
+// It fails with ErrShed when the queue is full or the wait times out, and with the
+// context's error when the request is cancelled. Requests to priority routes and
+// those no rule matches don't take a slot
+func (l *Limiter) Acquire(r *http.Request) (func(), error) {
+	l.mu.RLock()
+	var lim *limit
+	for _, p := range l.priority {
+		if pathrule.Under(r.URL.Path, p) {
+			l.mu.RUnlock()
+			return func() {}, nil
+		}
+	}
+	for _, candidate := range l.limits {
+		if candidate.rule.Matches(r) {
+			lim = candidate
+			break
+		}
+	}
+	timeout, now := l.cfg.QueueTimeout, l.now
+	l.mu.RUnlock()
+
+	if lim == nil {
+		return func() {}, nil
+	}
+	if err := lim.acquire(r.Context(), timeout); err != nil {
+		return nil, err
+	}
+
+	start := now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			end := now()
+			lim.release(end, end.Sub(start))
+		})
+	}, nil
+}
+
+// limit holds the slots of a rule
+type limit struct {
+	rule Rule
+
+	mu       sync.Mutex
+	adaptive bool
+	cap      float64
+	inflight int
+	waiting  list.List
+
+	// the adaptive window being observed
+	windowStart time.Time
+	samples     int
+	total       time.Duration
+	saturated   bool
+	lowest      time.Duration
+}
+
+// configure switches adaptive mode, a fixed cap being the rule's maximum
+func (lim *limit) configure(adaptive bool) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.adaptive != adaptive {
+		lim.adaptive = adaptive
+		lim.cap = float64(lim.rule.Max)
+		lim.windowStart, lim.samples, lim.total, lim.saturated, lim.lowest = time.Time{}, 0, 0, false, 0
+	}
+}
+
+// limit returns the whole number of requests allowed in flight
+func (lim *limit) limit() int {
+	return int(lim.cap)
+}
+
+func (lim *limit) acquire(ctx context.Context, timeout time.Duration) error {
+	lim.mu.Lock()
+	if lim.inflight < lim.limit() && lim.waiting.Len() == 0 {
+		lim.take()
+		lim.mu.Unlock()
+		return nil
+	}
+	if lim.waiting.Len() >= lim.rule.Queue || timeout == 0 {
+		lim.mu.Unlock()
+		return ErrShed
+	}
+	// a waiter is handed its slot by the request releasing it
+	ready := make(chan struct{})
+	e := lim.waiting.PushBack(ready)
+	lim.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-t.C:
+		err = ErrShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	select {
+	case <-ready:
+		// handed a slot while giving up, pass it on
+		lim.handOff()
+	default:
+		lim.waiting.Remove(e)
+	}
+	return err
+}
+
+// take counts a request in flight, noting when it reaches the cap
+func (lim *limit) take() {
+	lim.inflight++
+	if lim.inflight >= lim.limit() {
+		lim.saturated = true
+	}
+}
+
+// handOff gives slots freed to the requests waiting longest. It's called with the lock held
+func (lim *limit) handOff() {
+	lim.inflight--
+	for lim.inflight < lim.limit() && lim.waiting.Len() > 0 {
+		close(lim.waiting.Remove(lim.waiting.Front()).(chan struct{}))
+		lim.take()
+	}
+}
+
+func (lim *limit) release(now time.Time, latency time.Duration) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.adaptive {
+		lim.observe(now, latency)
+	}
+	lim.handOff()
+}
+
+// observe records the latency of a request, adjusting the cap once the window is over
+func (lim *limit) observe(now time.Time, latency time.Duration) {
+	if lim.windowStart.IsZero() {
+		lim.windowStart = now
+	}
+	lim.samples++
+	lim.total += latency
+	if now.Sub(lim.windowStart) < Window {
+		return
+	}
+
+	avg := lim.total / time.Duration(lim.samples)
+	if lim.lowest == 0 || avg < lim.lowest {
+		lim.lowest = avg
+	}
+	switch {
+	case float64(avg) > Tolerance*float64(lim.lowest):
+		lim.cap = max(1, lim.cap*Backoff)
+	case lim.saturated:
+		lim.cap = min(float64(lim.rule.Max), lim.cap+1)
+	}
+	if avg > lim.lowest {
+		lim.lowest += time.Duration(float64(avg-lim.lowest) * forget)
+	}
+	lim.windowStart, lim.samples, lim.total, lim.saturated = now, 0, 0, lim.inflight >= lim.limit()
+}
@@ -0,0 +1,196 @@
+package concurrency
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Rule
+		err      string
+	}{
+		{"POST /hash=8:32", Rule{pathrule.Target{Method: "POST", Prefix: "/hash"}, 8, 32}, ""},
+		{"/=100", Rule{pathrule.Target{}, 100, 0}, ""},
+		{"/hash", Rule{}, "is not"},
+		{"hash=1", Rule{}, "no /prefix"},
+		{"/hash=0:1", Rule{}, "at least 1 request"},
+		{"/hash=1:-1", Rule{}, "queue of at least 0"},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRule(test.s)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: ParseRule did not error with %q. Errored: %v", test.s, test.err, err)
+			}
+			continue
+		}
+		if err != nil || r != test.expected {
+			t.Errorf("%q: ParseRule returned %+v %v, expected %+v", test.s, r, err, test.expected)
+		}
+		if again, _ := ParseRule(r.String()); again != r {
+			t.Errorf("%q: String did not round trip. Returned: %q", test.s, r.String())
+		}
+	}
+}
+
+func request(method, path string) *http.Request {
+	r, _ := http.NewRequest(method, "http://localhost"+path, nil)
+	return r
+}
+
+// acquire acquires a slot in the background, sending the release func or error once done
+func acquire(l *Limiter, r *http.Request) chan interface{} {
+	done := make(chan interface{}, 1)
+	go func() {
+		release, err := l.Acquire(r)
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- release
+	}()
+	return done
+}
+
+func TestAcquire(t *testing.T) {
+	l, err := New(Config{Rules: []string{"POST /hash=1:1"}, Priority: []string{"/health"}, QueueTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("New errored \n\n %v", err)
+	}
+
+	release, err := l.Acquire(request("POST", "/hash"))
+	if err != nil {
+		t.Fatalf("Acquire errored with a slot free \n\n %v", err)
+	}
+
+	waiting := acquire(l, request("POST", "/hash"))
+	for l.limits[0].queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is full, whatever the case of the path
+	if _, err := l.Acquire(request("POST", "/HASH")); err != ErrShed {
+		t.Errorf("Acquire did not shed a request over the queue. Errored: %v", err)
+	}
+	// priority and unmatched requests aren't held back
+	for _, r := range []*http.Request{request("POST", "/Health"), request("GET", "/hash")} {
+		if _, err := l.Acquire(r); err != nil {
+			t.Errorf("%v %v: Acquire held back the request. Errored: %v", r.Method, r.URL.Path, err)
+		}
+	}
+
+	release()
+	release()
+	select {
+	case v := <-waiting:
+		next, ok := v.(func())
+		if !ok {
+			t.Fatalf("The waiting request failed. Errored: %v", v)
+		}
+		if n := l.limits[0].inFlight(); n != 1 {
+			t.Errorf("Releasing twice freed two slots. In flight: %v", n)
+		}
+		next()
+	case <-time.After(time.Second):
+		t.Fatalf("The waiting request was not handed the slot released")
+	}
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	l, _ := New(Config{Rules: []string{"/=1:5"}, QueueTimeout: 10 * time.Millisecond})
+	release, _ := l.Acquire(request("GET", "/"))
+	defer release()
+
+	if _, err := l.Acquire(request("GET", "/")); err != ErrShed {
+		t.Errorf("Acquire did not shed a request waiting past the timeout. Errored: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(request("GET", "/").WithContext(ctx)); err != context.Canceled {
+		t.Errorf("Acquire did not stop waiting for a cancelled request. Errored: %v", err)
+	}
+	if n := l.limits[0].queued(); n != 0 {
+		t.Errorf("Requests that gave up were left queued. Queued: %v", n)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	l, _ := New(Config{Rules: []string{"/=10"}, Adaptive: true})
+	lim := l.limits[0]
+	now := time.Unix(0, 0)
+	// window closes a window of requests served with the latency
+	window := func(latency time.Duration) {
+		now = now.Add(Window)
+		lim.observe(now, latency)
+	}
+
+	lim.observe(now, 10*time.Millisecond)
+	window(10 * time.Millisecond)
+	if lim.limit() != 10 || lim.lowest != 10*time.Millisecond {
+		t.Fatalf("The first window changed the cap. Cap: %v | Lowest: %v", lim.cap, lim.lowest)
+	}
+
+	// latency past the tolerance cuts the cap
+	for _, expected := range []int{9, 8} {
+		window(50 * time.Millisecond)
+		if lim.limit() != expected {
+			t.Errorf("The cap was not cut once latency rose. Cap: %v", lim.cap)
+		}
+	}
+
+	// latency back to normal while the cap is reached raises it by one
+	lim.saturated = true
+	window(10 * time.Millisecond)
+	if lim.limit() != 9 {
+		t.Errorf("The cap was not raised. Cap: %v", lim.cap)
+	}
+
+	// a cap not reached isn't raised
+	window(10 * time.Millisecond)
+	if lim.limit() != 9 {
+		t.Errorf("An unused cap was raised. Cap: %v", lim.cap)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	l, _ := New(Config{Rules: []string{"/hash=1", "/stats=1"}})
+	release, _ := l.Acquire(request("POST", "/hash"))
+	defer release()
+
+	if _, err := l.Prepare(Config{Priority: []string{"health"}}); err == nil {
+		t.Errorf("Prepare accepted a priority without a /prefix")
+	}
+
+	apply, err := l.Prepare(Config{Rules: []string{"/hash=1", "/stats=2"}})
+	if err != nil {
+		t.Fatalf("Prepare errored \n\n %v", err)
+	}
+	apply()
+	if _, err := l.Acquire(request("POST", "/hash")); err != ErrShed {
+		t.Errorf("Prepare dropped the requests in flight of an unchanged rule")
+	}
+	if l.limits[1].rule.Max != 2 {
+		t.Errorf("Prepare did not apply the changed rule")
+	}
+}
+
+func (lim *limit) queued() int {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.waiting.Len()
+}
+
+func (lim *limit) inFlight() int {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.inflight
+}
@@ -0,0 +1,811 @@
+/*
+Package config loads the configuration of the server.
+
+	Settings are layered, each overriding the last: defaults, a JSON config
+	file, environment variables and finally command line flags. Every setting
+	has a flag, e.g. -hash-delay, and an environment variable named after it,
+	e.g. CLOUD_JUMPER_HASH_DELAY. The config file is named with -config or
+	CLOUD_JUMPER_CONFIG.
+
+	The admin token and cluster secret have no flag, they're only read from
+	CLOUD_JUMPER_ADMIN_TOKEN and CLOUD_JUMPER_CLUSTER_SECRET, or the unprefixed
+	ADMIN_TOKEN and CLUSTER_SECRET when those aren't set.
+*/
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/admin"
+	"github.com/caoakleyii/cloud-jumper/src/certs"
+	"github.com/caoakleyii/cloud-jumper/src/concurrency"
+	"github.com/caoakleyii/cloud-jumper/src/middleware"
+	"github.com/caoakleyii/cloud-jumper/src/proxy"
+	"github.com/caoakleyii/cloud-jumper/src/ratelimit"
+)
+
+// EnvPrefix prefixes the environment variable of every setting
+const EnvPrefix = "CLOUD_JUMPER_"
+
+// Storage backends
+const (
+	Memory = "memory"
+	Raft   = "raft"
+)
+
+// Config is the configuration of the server
+type Config struct {
+	Addr string `json:"addr"`
+	// LogLevel is the lowest level of the server log written, debug, info, warn or error
+	LogLevel    string      `json:"log_level"`
+	Listen      Listen      `json:"listen"`
+	Server      Server      `json:"server"`
+	HTTP2       HTTP2       `json:"http2"`
+	TLS         TLS         `json:"tls"`
+	Hashing     Hashing     `json:"hashing"`
+	Storage     Storage     `json:"storage"`
+	Cluster     Cluster     `json:"cluster"`
+	Admin       Admin       `json:"admin"`
+	Middleware  Middleware  `json:"middleware"`
+	Proxy       Proxy       `json:"proxy"`
+	AccessLog   AccessLog   `json:"access_log"`
+	RateLimit   RateLimit   `json:"rate_limit"`
+	Concurrency Concurrency `json:"concurrency"`
+	Compression Compression `json:"compression"`
+}
+
+// Listen configures further addresses the api and admin api listen on,
+// a TCP host:port, unix:/path for a unix domain socket or unix:@name for an abstract socket
+type Listen struct {
+	Public []string `json:"public"`
+	Admin  []string `json:"admin"`
+	// SocketMode, SocketOwner and SocketGroup set the permissions of every unix domain socket
+	SocketMode  string `json:"socket_mode"`
+	SocketOwner string `json:"socket_owner"`
+	SocketGroup string `json:"socket_group"`
+}
+
+// Server configures the http servers
+type Server struct {
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	// WriteTimeout is off by default, it would cut off
+	// the replication stream and exports
+	WriteTimeout    Duration `json:"write_timeout"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	MaxHeaderBytes  int      `json:"max_header_bytes"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// HTTP2 configures serving HTTP/2, negotiated over tls
+// and with h2c by prior knowledge over plaintext connections
+type HTTP2 struct {
+	Enabled              bool `json:"enabled"`
+	H2C                  bool `json:"h2c"`
+	MaxConcurrentStreams int  `json:"max_concurrent_streams"`
+	MaxReadFrameSize     int  `json:"max_read_frame_size"`
+}
+
+// TLS configures serving the public api over tls
+type TLS struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+	// ClientAuth is optional or require, applying when ClientCA is set
+	ClientAuth     string   `json:"client_auth"`
+	MinVersion     string   `json:"min_version"`
+	Ciphers        string   `json:"ciphers"`
+	ReloadInterval Duration `json:"reload_interval"`
+	// Dev serves a self signed certificate generated at startup
+	Dev bool `json:"dev"`
+}
+
+// Hashing configures how passwords are hashed and stored
+type Hashing struct {
+	StoreDelay Duration `json:"store_delay"`
+	SaltLength int      `json:"salt_length"`
+	IDLength   int      `json:"id_length"`
+}
+
+// Storage configures where passwords are stored
+type Storage struct {
+	// Backend is memory or raft, by default raft when raft members are configured
+	Backend     string   `json:"backend"`
+	FlushFile   string   `json:"flush_file"`
+	Follow      string   `json:"follow"`
+	RaftMembers []string `json:"raft_members"`
+	RaftJoin    bool     `json:"raft_join"`
+	RaftDir     string   `json:"raft_dir"`
+}
+
+// Cluster configures sharding and membership
+type Cluster struct {
+	Self  string   `json:"self"`
+	Peers []string `json:"peers"`
+	// PeerAddr is the address the routes only other nodes call are served on
+	PeerAddr string `json:"peer_addr"`
+	// Secret authenticates the requests nodes send each other
+	Secret      string   `json:"secret"`
+	Gossip      string   `json:"gossip"`
+	GossipSeeds []string `json:"gossip_seeds"`
+}
+
+// Admin configures the admin listener
+type Admin struct {
+	Addr      string   `json:"addr"`
+	Tokens    []string `json:"tokens"`
+	TokenFile string   `json:"token_file"`
+	Cert      string   `json:"cert"`
+	Key       string   `json:"key"`
+	ClientCA  string   `json:"client_ca"`
+	Allow     []string `json:"allow"`
+	AuditLog  string   `json:"audit_log"`
+}
+
+// Proxy configures the load balancers and reverse proxies in front of the public api
+type Proxy struct {
+	// Protocol reads the PROXY protocol header every public connection starts with
+	Protocol bool `json:"protocol"`
+	// Trusted are the IPs or CIDRs of the proxies trusted to send PROXY protocol
+	// and forwarding headers
+	Trusted []string `json:"trusted"`
+	// Header is the forwarding header the trusted proxies set, X-Forwarded-For or Forwarded
+	Header string `json:"header"`
+}
+
+// AccessLog configures logging the requests to the public api
+type AccessLog struct {
+	// File is where requests are logged, - for stdout or empty for nowhere
+	File string `json:"file"`
+	// Format is json, text, common or combined
+	Format string `json:"format"`
+	// Sample is the fraction of requests logged, server errors always are
+	Sample  float64  `json:"sample"`
+	Exclude []string `json:"exclude"`
+	// MaxSize is the size in bytes the file is rotated at, 0 for never
+	MaxSize    int `json:"max_size"`
+	MaxBackups int `json:"max_backups"`
+}
+
+// RateLimit configures limiting the rate of requests each client makes to the public api
+type RateLimit struct {
+	// Rules are written [METHOD ]/prefix=rate:burst, the first matching a request limits it
+	Rules []string `json:"rules"`
+	// Key tells clients apart, ip or header:Name e.g. header:X-API-Key
+	Key string `json:"key"`
+}
+
+// Concurrency configures capping the requests the public api serves at once
+type Concurrency struct {
+	// Rules are written [METHOD ]/prefix=max[:queue], the first matching a request caps it
+	Rules []string `json:"rules"`
+	// Priority are the path prefixes of requests never held back
+	Priority     []string `json:"priority"`
+	QueueTimeout Duration `json:"queue_timeout"`
+	// Adaptive moves each cap between 1 and its max from the latency observed
+	Adaptive bool `json:"adaptive"`
+}
+
+// Compression configures compressing responses with gzip or deflate
+type Compression struct {
+	Enabled bool `json:"enabled"`
+	// Level is from 1 for the fastest to 9 for the smallest, 0 for none or -1 for the default
+	Level int `json:"level"`
+	// MinSize is the fewest bytes of body compressed
+	MinSize int `json:"min_size"`
+	// Types are the media types compressed, e.g. application/json or text/*
+	Types []string `json:"types"`
+}
+
+// Middleware configures the middleware of the public api
+type Middleware struct {
+	Statistics bool `json:"statistics"`
+	// PanicWebhook is posted a JSON report of every panic recovered
+	PanicWebhook string `json:"panic_webhook"`
+	// Timeouts are written [METHOD ]/prefix=duration, the first matching a request setting its deadline
+	Timeouts []string `json:"timeouts"`
+}
+
+// Default returns the configuration used for anything left unset
+func Default() Config {
+	return Config{
+		Addr:     ":8080",
+		LogLevel: "info",
+		Server: Server{
+			ReadTimeout:       Duration(time.Minute),
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			IdleTimeout:       Duration(2 * time.Minute),
+			MaxHeaderBytes:    1 << 20,
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		Proxy: Proxy{
+			Header: proxy.XForwardedFor,
+		},
+		AccessLog: AccessLog{
+			File:       "-",
+			Format:     middleware.JSON,
+			Sample:     1,
+			MaxSize:    100 << 20,
+			MaxBackups: 5,
+		},
+		RateLimit: RateLimit{
+			Key: ratelimit.IP,
+		},
+		Compression: Compression{
+			Enabled: true,
+			Level:   -1,
+			MinSize: 1024,
+			Types:   []string{"application/json", "application/x-ndjson", "text/csv", "text/plain"},
+		},
+		Concurrency: Concurrency{
+			Priority:     []string{"/health", "/livez", "/readyz"},
+			QueueTimeout: Duration(time.Second),
+		},
+		HTTP2: HTTP2{
+			Enabled:              true,
+			MaxConcurrentStreams: 250,
+			MaxReadFrameSize:     1 << 20,
+		},
+		TLS: TLS{
+			ClientAuth:     certs.Require,
+			MinVersion:     "1.2",
+			Ciphers:        certs.Modern,
+			ReloadInterval: Duration(certs.DefaultReloadInterval),
+		},
+		Hashing: Hashing{
+			StoreDelay: Duration(5 * time.Second),
+			SaltLength: 32,
+			IDLength:   8,
+		},
+		Admin: Admin{
+			Addr: admin.DefaultAddr,
+		},
+		Middleware: Middleware{
+			Statistics: true,
+		},
+	}
+}
+
+type setting struct {
+	name  string
+	usage string
+	value func(*Config) flag.Value
+	// reload is set for settings applied by a reload without a restart
+	reload bool
+}
+
+// env returns the environment variable of the setting
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+var settings = []setting{
+	{"addr", "address to listen on, a host:port, unix:/path or unix:@name, empty for none when -listen is set", func(c *Config) flag.Value { return (*stringValue)(&c.Addr) }, false},
+	{"log-level", "lowest level of the server log written, debug, info, warn or error", func(c *Config) flag.Value { return (*stringValue)(&c.LogLevel) }, true},
+	{"listen", "comma separated further addresses to serve the api on", func(c *Config) flag.Value { return (*listValue)(&c.Listen.Public) }, false},
+	{"admin-listen", "comma separated further addresses to serve the admin api on", func(c *Config) flag.Value { return (*listValue)(&c.Listen.Admin) }, false},
+	{"socket-mode", "octal file mode of unix domain sockets, e.g. 0660", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.SocketMode) }, false},
+	{"socket-owner", "user owning unix domain sockets", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.SocketOwner) }, false},
+	{"socket-group", "group owning unix domain sockets", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.SocketGroup) }, false},
+	{"read-timeout", "longest time to read a request", func(c *Config) flag.Value { return &c.Server.ReadTimeout }, false},
+	{"read-header-timeout", "longest time to read request headers", func(c *Config) flag.Value { return &c.Server.ReadHeaderTimeout }, false},
+	{"write-timeout", "longest time to write a response, 0 for none", func(c *Config) flag.Value { return &c.Server.WriteTimeout }, false},
+	{"idle-timeout", "longest time an idle keep alive connection stays open", func(c *Config) flag.Value { return &c.Server.IdleTimeout }, false},
+	{"max-header-bytes", "largest request headers accepted", func(c *Config) flag.Value { return (*intValue)(&c.Server.MaxHeaderBytes) }, false},
+	{"shutdown-timeout", "how long a graceful shutdown waits for requests and background hash jobs", func(c *Config) flag.Value { return &c.Server.ShutdownTimeout }, false},
+	{"http2", "serve http/2 to clients negotiating it over tls", func(c *Config) flag.Value { return (*boolValue)(&c.HTTP2.Enabled) }, false},
+	{"h2c", "serve http/2 without tls to clients with prior knowledge", func(c *Config) flag.Value { return (*boolValue)(&c.HTTP2.H2C) }, false},
+	{"http2-max-concurrent-streams", "most http/2 requests a connection may have in flight", func(c *Config) flag.Value { return (*intValue)(&c.HTTP2.MaxConcurrentStreams) }, false},
+	{"http2-max-read-frame-size", "largest http/2 frame read, between 16384 and 16777215 bytes", func(c *Config) flag.Value { return (*intValue)(&c.HTTP2.MaxReadFrameSize) }, false},
+	{"tls-cert", "certificate file to serve the api over tls, reloaded when it changes", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Cert) }, true},
+	{"tls-key", "key file to serve the api over tls, reloaded when it changes", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Key) }, true},
+	{"tls-client-ca", "ca file client certificates are verified against", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.ClientCA) }, false},
+	{"tls-client-auth", "optional or require a client certificate when tls-client-ca is set", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.ClientAuth) }, false},
+	{"tls-min-version", "lowest tls version accepted, 1.2 or 1.3", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.MinVersion) }, false},
+	{"tls-ciphers", "tls 1.2 cipher policy, modern or compatible", func(c *Config) flag.Value { return (*stringValue)(&c.TLS.Ciphers) }, false},
+	{"tls-reload-interval", "how often the certificate files are checked for changes", func(c *Config) flag.Value { return &c.TLS.ReloadInterval }, false},
+	{"tls-dev", "serve a self signed certificate generated at startup, for development only", func(c *Config) flag.Value { return (*boolValue)(&c.TLS.Dev) }, false},
+	{"hash-delay", "how long after responding a hashed password is stored", func(c *Config) flag.Value { return &c.Hashing.StoreDelay }, true},
+	{"salt-length", "random bytes salting each password hash", func(c *Config) flag.Value { return (*intValue)(&c.Hashing.SaltLength) }, true},
+	{"id-length", "random bytes in a password id", func(c *Config) flag.Value { return (*intValue)(&c.Hashing.IDLength) }, true},
+	{"storage", "storage backend, memory or raft", func(c *Config) flag.Value { return (*stringValue)(&c.Storage.Backend) }, false},
+	{"flush-file", "file hash jobs still pending at the shutdown timeout are saved to as ndjson, to be imported after a restart", func(c *Config) flag.Value { return (*stringValue)(&c.Storage.FlushFile) }, false},
+	{"follow", "base url of a primary to replicate from as a read only follower", func(c *Config) flag.Value { return (*stringValue)(&c.Storage.Follow) }, false},
+	{"raft", "comma separated base urls of the peer listeners of every raft member, including this node", func(c *Config) flag.Value { return (*listValue)(&c.Storage.RaftMembers) }, false},
+	{"raft-join", "start as a raft member waiting to be added to an existing cluster", func(c *Config) flag.Value { return (*boolValue)(&c.Storage.RaftJoin) }, false},
+	{"raft-dir", "directory the raft log and snapshots are persisted to", func(c *Config) flag.Value { return (*stringValue)(&c.Storage.RaftDir) }, false},
+	{"self", "base url other cluster nodes reach this node's peer listener on", func(c *Config) flag.Value { return (*stringValue)(&c.Cluster.Self) }, false},
+	{"peers", "comma separated base urls of the peer listeners of the other cluster nodes", func(c *Config) flag.Value { return (*listValue)(&c.Cluster.Peers) }, false},
+	{"peer-addr", "address the peer api other nodes call is served on, e.g. :8082", func(c *Config) flag.Value { return (*stringValue)(&c.Cluster.PeerAddr) }, false},
+	{"gossip", "udp address to gossip cluster membership on, e.g. :7946", func(c *Config) flag.Value { return (*stringValue)(&c.Cluster.Gossip) }, false},
+	{"gossip-seeds", "comma separated udp addresses of members to join through", func(c *Config) flag.Value { return (*listValue)(&c.Cluster.GossipSeeds) }, false},
+	{"admin-addr", "address the admin api listens on, empty for none when -admin-listen is set", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.Addr) }, false},
+	{"admin-token-file", "file of bearer tokens accepted by the admin api, one per line", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.TokenFile) }, true},
+	{"admin-cert", "certificate file to serve the admin api over tls", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.Cert) }, true},
+	{"admin-key", "key file to serve the admin api over tls", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.Key) }, true},
+	{"admin-client-ca", "ca file client certificates authenticating with the admin api are verified against", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.ClientCA) }, false},
+	{"admin-allow", "comma separated ips or cidrs allowed to reach the admin api, defaults to loopback", func(c *Config) flag.Value { return (*listValue)(&c.Admin.Allow) }, true},
+	{"admin-audit-log", "file admin requests are audited to, defaults to stderr", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.AuditLog) }, false},
+	{"proxy-protocol", "read the proxy protocol header of every connection to the api", func(c *Config) flag.Value { return (*boolValue)(&c.Proxy.Protocol) }, false},
+	{"trusted-proxies", "comma separated ips or cidrs of the proxies trusted to send proxy protocol and forwarding headers", func(c *Config) flag.Value { return (*listValue)(&c.Proxy.Trusted) }, true},
+	{"forwarded-header", "forwarding header the trusted proxies set, X-Forwarded-For or Forwarded", func(c *Config) flag.Value { return (*stringValue)(&c.Proxy.Header) }, true},
+	{"access-log", "file requests to the api are logged to, - for stdout or empty for none", func(c *Config) flag.Value { return (*stringValue)(&c.AccessLog.File) }, false},
+	{"access-log-format", "access log format, json, text, common or combined", func(c *Config) flag.Value { return (*stringValue)(&c.AccessLog.Format) }, false},
+	{"access-log-sample", "fraction of requests logged between 0 and 1, server errors always are", func(c *Config) flag.Value { return (*floatValue)(&c.AccessLog.Sample) }, false},
+	{"access-log-exclude", "comma separated paths whose requests aren't logged, e.g. /health", func(c *Config) flag.Value { return (*listValue)(&c.AccessLog.Exclude) }, false},
+	{"access-log-max-size", "bytes the access log file is rotated at, 0 for never", func(c *Config) flag.Value { return (*intValue)(&c.AccessLog.MaxSize) }, false},
+	{"access-log-max-backups", "rotated access log files kept", func(c *Config) flag.Value { return (*intValue)(&c.AccessLog.MaxBackups) }, false},
+	{"rate-limit", "comma separated rate limits, [METHOD ]/prefix=requests per second:burst e.g. POST /hash=0.5:10", func(c *Config) flag.Value { return (*listValue)(&c.RateLimit.Rules) }, true},
+	{"rate-limit-key", "what rate limited clients are told apart by, ip or header:Name e.g. header:X-API-Key", func(c *Config) flag.Value { return (*stringValue)(&c.RateLimit.Key) }, true},
+	{"concurrency-limit", "comma separated caps on requests served at once, [METHOD ]/prefix=max[:queue] e.g. POST /hash=8:32", func(c *Config) flag.Value { return (*listValue)(&c.Concurrency.Rules) }, true},
+	{"concurrency-priority", "comma separated path prefixes of requests never held back by concurrency limits", func(c *Config) flag.Value { return (*listValue)(&c.Concurrency.Priority) }, true},
+	{"concurrency-queue-timeout", "longest a request waits for a concurrency limited slot before it's shed, 0 for never waiting", func(c *Config) flag.Value { return &c.Concurrency.QueueTimeout }, true},
+	{"concurrency-adaptive", "adjust concurrency limits from the latency observed, up to their max", func(c *Config) flag.Value { return (*boolValue)(&c.Concurrency.Adaptive) }, true},
+	{"compress", "compress responses for clients accepting gzip or deflate", func(c *Config) flag.Value { return (*boolValue)(&c.Compression.Enabled) }, false},
+	{"compress-level", "compression level from 1 for the fastest to 9 for the smallest, -1 for the default", func(c *Config) flag.Value { return (*intValue)(&c.Compression.Level) }, false},
+	{"compress-min-size", "fewest bytes of response body compressed", func(c *Config) flag.Value { return (*intValue)(&c.Compression.MinSize) }, false},
+	{"compress-types", "comma separated media types of responses compressed, e.g. application/json or text/*", func(c *Config) flag.Value { return (*listValue)(&c.Compression.Types) }, false},
+	{"statistics", "record the duration of hash requests for /stats", func(c *Config) flag.Value { return (*boolValue)(&c.Middleware.Statistics) }, false},
+	{"request-timeout", "comma separated deadlines of requests, [METHOD ]/prefix=duration e.g. POST /hash=10s", func(c *Config) flag.Value { return (*listValue)(&c.Middleware.Timeouts) }, true},
+	{"panic-webhook", "url posted a json report of every panic recovered while serving a request", func(c *Config) flag.Value { return (*stringValue)(&c.Middleware.PanicWebhook) }, true},
+}
+
+// Load layers the config file, environment and flags in args over the defaults,
+// returning the validated configuration and the arguments left after the flags
+func Load(args []string, getenv func(string) string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("cloud-jumper", flag.ContinueOnError)
+	file := fs.String("config", getenv(EnvPrefix+"CONFIG"), "json config file, env "+EnvPrefix+"CONFIG")
+
+	// flags are parsed into a scratch config, so only those set on
+	// the command line are layered over the file and environment
+	scratch := Default()
+	for _, s := range settings {
+		fs.Var(s.value(&scratch), s.name, fmt.Sprintf("%v, env %v", s.usage, s.env()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+
+	cfg, err := Parse(*file, getenv, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// secretEnv reads the prefixed environment variable name, falling back to the
+// bare name earlier versions read
+func secretEnv(getenv func(string) string, name string) string {
+	if v := getenv(EnvPrefix + name); v != "" {
+		return v
+	}
+	return getenv(name)
+}
+
+// Parse layers the config file, environment and the flag values provided
+// by setting name over the defaults, then validates the result
+func Parse(file string, getenv func(string) string, flags map[string]string) (*Config, error) {
+	cfg := Default()
+
+	if file != "" {
+		if err := readFile(file, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v := getenv(s.env()); v != "" {
+			if err := s.value(&cfg).Set(v); err != nil {
+				return nil, fmt.Errorf("config: %v: %w", s.env(), err)
+			}
+		}
+	}
+	// the admin token and cluster secret are kept out of flags, where other users could see them
+	if t := secretEnv(getenv, "ADMIN_TOKEN"); t != "" {
+		cfg.Admin.Tokens = append(cfg.Admin.Tokens, t)
+	}
+	if s := secretEnv(getenv, "CLUSTER_SECRET"); s != "" {
+		cfg.Cluster.Secret = s
+	}
+
+	for _, s := range settings {
+		if v, ok := flags[s.name]; ok {
+			if err := s.value(&cfg).Set(v); err != nil {
+				return nil, fmt.Errorf("config: -%v: %w", s.name, err)
+			}
+		}
+	}
+
+	if cfg.Storage.Backend == "" {
+		cfg.Storage.Backend = Memory
+		if len(cfg.Storage.RaftMembers) > 0 || cfg.Storage.RaftJoin {
+			cfg.Storage.Backend = Raft
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// readFile decodes the JSON config file over the config,
+// rejecting any unknown field so typos don't go unnoticed
+func readFile(file string, cfg *Config) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config: %v: %w", file, err)
+	}
+	return nil
+}
+
+// tokensSetting and secretSetting name the admin tokens and cluster secret,
+// which have no flag so they aren't visible to other users of the host
+const (
+	tokensSetting = "admin-tokens"
+	secretSetting = "cluster-secret"
+)
+
+// Changes returns the names of the settings that differ between the configs,
+// split into those a reload applies and those requiring a restart
+func Changes(running, loaded *Config) (reloadable, restart []string) {
+	for _, s := range settings {
+		if s.value(running).String() == s.value(loaded).String() {
+			continue
+		}
+		if s.reload {
+			reloadable = append(reloadable, s.name)
+		} else {
+			restart = append(restart, s.name)
+		}
+	}
+	if strings.Join(running.Admin.Tokens, "\n") != strings.Join(loaded.Admin.Tokens, "\n") {
+		reloadable = append(reloadable, tokensSetting)
+	}
+	if running.Cluster.Secret != loaded.Cluster.Secret {
+		restart = append(restart, secretSetting)
+	}
+	return reloadable, restart
+}
+
+// Merge returns a copy of the running config with the reloadable settings of the loaded one
+func Merge(running, loaded *Config) *Config {
+	merged := *running
+	for _, s := range settings {
+		if s.reload {
+			s.value(&merged).Set(s.value(loaded).String())
+		}
+	}
+	merged.Admin.Tokens = loaded.Admin.Tokens
+	return &merged
+}
+
+// Validate returns every problem with the configuration joined in one error
+func (c *Config) Validate() error {
+	var errs []error
+	problem := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("config: "+format, a...))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		problem("log_level must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if c.Addr != "" || len(c.Listen.Public) == 0 {
+		if err := validAddr(c.Addr); err != nil {
+			problem("addr %v", err)
+		}
+	}
+	if c.Admin.Addr != "" || len(c.Listen.Admin) == 0 {
+		if err := validAddr(c.Admin.Addr); err != nil {
+			problem("admin addr %v", err)
+		}
+	}
+	if c.Cluster.PeerAddr != "" {
+		if err := validAddr(c.Cluster.PeerAddr); err != nil {
+			problem("cluster.peer_addr %v", err)
+		}
+	}
+	for _, a := range append(append([]string(nil), c.Listen.Public...), c.Listen.Admin...) {
+		if err := validAddr(a); err != nil {
+			problem("listen %v", err)
+		}
+	}
+	// admin requests over a unix domain socket are restricted by its permissions,
+	// which abstract sockets don't have
+	for _, a := range append([]string{c.Admin.Addr}, c.Listen.Admin...) {
+		if strings.HasPrefix(a, "unix:@") {
+			problem("admin listen %q is an abstract socket, which any local process can connect to", a)
+		}
+	}
+	if c.Listen.SocketMode != "" {
+		if _, err := c.Listen.Mode(); err != nil {
+			problem("listen.socket_mode must be an octal file mode like 0660, got %q", c.Listen.SocketMode)
+		}
+	}
+
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+		{"hashing.store_delay", c.Hashing.StoreDelay},
+		{"concurrency.queue_timeout", c.Concurrency.QueueTimeout},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			problem("%v must not be negative, got %v", d.name, &d.d)
+		}
+	}
+	if c.Server.MaxHeaderBytes < 0 {
+		problem("server.max_header_bytes must not be negative, got %v", c.Server.MaxHeaderBytes)
+	}
+
+	if c.HTTP2.H2C && !c.HTTP2.Enabled {
+		problem("http2.h2c requires http2.enabled")
+	}
+	if c.HTTP2.MaxConcurrentStreams < 1 {
+		problem("http2.max_concurrent_streams must be at least 1, got %v", c.HTTP2.MaxConcurrentStreams)
+	}
+	if c.HTTP2.MaxReadFrameSize < 1<<14 || c.HTTP2.MaxReadFrameSize > 1<<24-1 {
+		problem("http2.max_read_frame_size must be between 16384 and 16777215 bytes, got %v", c.HTTP2.MaxReadFrameSize)
+	}
+
+	if c.Hashing.SaltLength < 16 {
+		problem("hashing.salt_length must be at least 16 bytes, got %v", c.Hashing.SaltLength)
+	}
+	if c.Hashing.IDLength < 4 || c.Hashing.IDLength > 64 {
+		problem("hashing.id_length must be between 4 and 64 bytes, got %v", c.Hashing.IDLength)
+	}
+
+	switch c.Storage.Backend {
+	case Memory:
+		if len(c.Storage.RaftMembers) > 0 || c.Storage.RaftJoin {
+			problem("storage.raft_members and raft_join require the raft storage backend")
+		}
+	case Raft:
+		if len(c.Storage.RaftMembers) == 0 && !c.Storage.RaftJoin {
+			problem("the raft storage backend requires storage.raft_members or raft_join")
+		}
+		if c.Storage.Follow != "" {
+			problem("storage.follow can't be used with the raft storage backend")
+		}
+	default:
+		problem("storage.backend must be %v or %v, got %q", Memory, Raft, c.Storage.Backend)
+	}
+
+	needsSelf := len(c.Cluster.Peers) > 0 || c.Cluster.Gossip != "" || c.Storage.Backend == Raft
+	if needsSelf && c.Cluster.Self == "" {
+		problem("cluster.self is required with cluster.peers, cluster.gossip or the raft storage backend")
+	}
+	if (len(c.Cluster.Peers) > 0 || c.Storage.Backend == Raft) && c.Cluster.PeerAddr == "" {
+		problem("cluster.peers and the raft storage backend require cluster.peer_addr, the listener cluster.self reaches")
+	}
+	if (c.Cluster.PeerAddr != "" || c.Cluster.Gossip != "" || c.Storage.Follow != "") && c.Cluster.Secret == "" {
+		problem("cluster.peer_addr, cluster.gossip and storage.follow require a cluster secret, set with $" + EnvPrefix + "CLUSTER_SECRET")
+	}
+	for _, u := range append(append([]string{c.Cluster.Self, c.Storage.Follow, c.Middleware.PanicWebhook}, c.Cluster.Peers...), c.Storage.RaftMembers...) {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			problem("%q is not a base url like http://host:port", u)
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		problem("tls.cert and tls.key must be set together")
+	}
+	if c.TLS.Dev && c.TLS.Cert != "" {
+		problem("tls.dev can't be used with tls.cert")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" && !c.TLS.Dev {
+		problem("tls.client_ca requires tls.cert and tls.key or tls.dev")
+	}
+	if c.TLS.ClientAuth != certs.Optional && c.TLS.ClientAuth != certs.Require {
+		problem("tls.client_auth must be %v or %v, got %q", certs.Optional, certs.Require, c.TLS.ClientAuth)
+	}
+	if c.TLS.MinVersion != "1.2" && c.TLS.MinVersion != "1.3" {
+		problem("tls.min_version must be 1.2 or 1.3, got %q", c.TLS.MinVersion)
+	}
+	if c.TLS.Ciphers != certs.Modern && c.TLS.Ciphers != certs.Compatible {
+		problem("tls.ciphers must be %v or %v, got %q", certs.Modern, certs.Compatible, c.TLS.Ciphers)
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		problem("tls.reload_interval must be positive, got %v", &c.TLS.ReloadInterval)
+	}
+
+	switch c.AccessLog.Format {
+	case middleware.JSON, middleware.Text, middleware.Common, middleware.Combined:
+	default:
+		problem("access_log.format must be %v, %v, %v or %v, got %q", middleware.JSON, middleware.Text, middleware.Common, middleware.Combined, c.AccessLog.Format)
+	}
+	if c.AccessLog.Sample < 0 || c.AccessLog.Sample > 1 {
+		problem("access_log.sample must be between 0 and 1, got %v", c.AccessLog.Sample)
+	}
+	if c.AccessLog.MaxSize < 0 || c.AccessLog.MaxBackups < 0 {
+		problem("access_log.max_size and max_backups must not be negative")
+	}
+
+	if err := ratelimit.Validate(ratelimit.Config{Rules: c.RateLimit.Rules, Key: c.RateLimit.Key}); err != nil {
+		problem("%v", err)
+	}
+	if err := concurrency.Validate(concurrency.Config{Rules: c.Concurrency.Rules, Priority: c.Concurrency.Priority}); err != nil {
+		problem("%v", err)
+	}
+
+	for _, t := range c.Middleware.Timeouts {
+		if _, err := middleware.ParseTimeout(t); err != nil {
+			problem("%v", err)
+		}
+	}
+
+	if c.Compression.Level < -1 || c.Compression.Level > 9 {
+		problem("compression.level must be between -1 and 9, got %v", c.Compression.Level)
+	}
+	if c.Compression.MinSize < 0 {
+		problem("compression.min_size must not be negative, got %v", c.Compression.MinSize)
+	}
+
+	if _, err := proxy.ParseTrusted(c.Proxy.Trusted); err != nil {
+		problem("proxy.trusted %v", err)
+	}
+	if c.Proxy.Protocol && len(c.Proxy.Trusted) == 0 {
+		problem("proxy.protocol requires proxy.trusted, or any client could send a header")
+	}
+	if h := http.CanonicalHeaderKey(c.Proxy.Header); h != proxy.XForwardedFor && h != proxy.Forwarded {
+		problem("proxy.header must be %v or %v, got %q", proxy.XForwardedFor, proxy.Forwarded, c.Proxy.Header)
+	}
+
+	if (c.Admin.Cert == "") != (c.Admin.Key == "") {
+		problem("admin.cert and admin.key must be set together")
+	}
+	if c.Admin.ClientCA != "" && c.Admin.Cert == "" {
+		problem("admin.client_ca requires admin.cert and admin.key")
+	}
+
+	return errors.Join(errs...)
+}
+
+// validAddr returns an error when the address isn't a host:port, unix:/path or unix:@name address
+func validAddr(addr string) error {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if path == "" || path == "@" {
+			return fmt.Errorf("%q has no socket path or name", addr)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%q is not a host:port, unix:/path or unix:@name address", addr)
+	}
+	return nil
+}
+
+// Mode returns the file mode of unix domain sockets, zero when unset
+func (l Listen) Mode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q", l.SocketMode)
+	}
+	return os.FileMode(m), nil
+}
+
+// Duration is a time.Duration written in config files and flags as a string, e.g. "5s"
+type Duration time.Duration
+
+// String implements the flag.Value interface
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// Set implements the flag.Value interface
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected e.g. 5s or 1m30s", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %v, expected a string e.g. \"5s\"", string(b))
+	}
+	return d.Set(s)
+}
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = intValue(i)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type floatValue float64
+
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+// listValue is a comma separated list, replaced rather than appended to when set
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create a temp directory \n\n %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatalf("unable to write the config file \n\n %v", err)
+	}
+	return file
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(k string) string { return vars[k] }
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, args, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Load errored \n\n %v", err)
+	}
+	if cfg.Addr != ":8080" || time.Duration(cfg.Hashing.StoreDelay) != 5*time.Second || cfg.Storage.Backend != Memory {
+		t.Errorf("Load did not return the defaults. Config: %+v", cfg)
+	}
+	if len(args) != 0 {
+		t.Errorf("Load returned arguments that weren't passed. Args: %v", args)
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	file := writeFile(t, `{
+		"addr": ":9000",
+		"hashing": {"store_delay": "1s", "salt_length": 20, "id_length": 10},
+		"server": {"read_timeout": "30s"}
+	}`)
+
+	vars := map[string]string{
+		"CLOUD_JUMPER_CONFIG":         file,
+		"CLOUD_JUMPER_ADDR":           ":9001",
+		"CLOUD_JUMPER_SALT_LENGTH":    "24",
+		"CLOUD_JUMPER_ADMIN_TOKEN":    "secret",
+		"CLOUD_JUMPER_CLUSTER_SECRET": "shared",
+	}
+	cfg, args, err := Load([]string{"-addr", ":9002", "-peer-addr", ":8082", "-peers", "http://b:8080, http://c:8080", "-self", "http://a:8080", "export", "-o", "x"}, env(vars))
+	if err != nil {
+		t.Fatalf("Load errored \n\n %v", err)
+	}
+
+	if cfg.Addr != ":9002" {
+		t.Errorf("Flags did not override the environment. Addr: %v", cfg.Addr)
+	}
+	if cfg.Hashing.SaltLength != 24 {
+		t.Errorf("Environment did not override the file. Salt Length: %v", cfg.Hashing.SaltLength)
+	}
+	if cfg.Hashing.IDLength != 10 || time.Duration(cfg.Server.ReadTimeout) != 30*time.Second {
+		t.Errorf("File did not override the defaults. Config: %+v", cfg)
+	}
+	if time.Duration(cfg.Server.IdleTimeout) != 2*time.Minute {
+		t.Errorf("File replaced a default it didn't set. Idle Timeout: %v", cfg.Server.IdleTimeout)
+	}
+	if len(cfg.Cluster.Peers) != 2 || cfg.Cluster.Peers[1] != "http://c:8080" {
+		t.Errorf("Load did not split the peers. Peers: %v", cfg.Cluster.Peers)
+	}
+	if cfg.Cluster.Secret != "shared" {
+		t.Errorf("Load did not read the cluster secret from the environment")
+	}
+	if len(cfg.Admin.Tokens) != 1 || cfg.Admin.Tokens[0] != "secret" {
+		t.Errorf("Load did not read the admin token. Tokens: %v", cfg.Admin.Tokens)
+	}
+	if strings.Join(args, " ") != "export -o x" {
+		t.Errorf("Load did not return the sub command arguments. Args: %v", args)
+	}
+}
+
+func TestLoadSecretFallback(t *testing.T) {
+	vars := map[string]string{
+		"ADMIN_TOKEN":                 "bare",
+		"CLUSTER_SECRET":              "bare",
+		"CLOUD_JUMPER_CLUSTER_SECRET": "prefixed",
+	}
+	cfg, _, err := Load(nil, env(vars))
+	if err != nil {
+		t.Fatalf("Load errored \n\n %v", err)
+	}
+
+	if cfg.Cluster.Secret != "prefixed" {
+		t.Errorf("Load did not prefer the prefixed cluster secret. Secret: %v", cfg.Cluster.Secret)
+	}
+	if len(cfg.Admin.Tokens) != 1 || cfg.Admin.Tokens[0] != "bare" {
+		t.Errorf("Load did not fall back to the bare admin token. Tokens: %v", cfg.Admin.Tokens)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		vars     map[string]string
+		contains []string
+	}{
+		{"unknown field", nil, map[string]string{"CLOUD_JUMPER_CONFIG": writeFile(t, `{"adr": ":80"}`)}, []string{`unknown field "adr"`}},
+		{"bad duration", []string{"-hash-delay", "5"}, nil, []string{"-hash-delay", "invalid duration"}},
+		{"bad env", nil, map[string]string{"CLOUD_JUMPER_ID_LENGTH": "eight"}, []string{"CLOUD_JUMPER_ID_LENGTH", "invalid number"}},
+		{"every problem", []string{"-salt-length", "4", "-storage", "disk", "-peers", "http://b:8080"}, nil,
+			[]string{"salt_length must be at least 16", "storage.backend must be", "cluster.self is required", "cluster.peers and the raft storage backend require cluster.peer_addr"}},
+		{"raft without self", []string{"-raft", "http://a:8080"}, nil, []string{"cluster.self is required", "raft storage backend require cluster.peer_addr"}},
+		{"bad url", []string{"-self", "a:8080", "-peers", "http://b:8080"}, nil, []string{`"a:8080" is not a base url`}},
+		{"bad listen", []string{"-listen", "unix:,8080", "-socket-mode", "0999"}, nil,
+			[]string{`listen "unix:" has no socket path`, `listen "8080" is not a host:port`, "listen.socket_mode"}},
+		{"abstract admin socket", []string{"-admin-listen", "unix:@admin"}, nil, []string{`admin listen "unix:@admin" is an abstract socket`}},
+		{"bad trusted proxy", []string{"-trusted-proxies", "10.0.0.0/8,lb.local"}, nil, []string{`proxy.trusted invalid trusted proxy address "lb.local"`}},
+		{"untrusted proxy protocol", []string{"-proxy-protocol", "-forwarded-header", "X-Real-IP"}, nil,
+			[]string{"proxy.protocol requires proxy.trusted", `proxy.header must be X-Forwarded-For or Forwarded, got "X-Real-IP"`}},
+		{"bad http2", []string{"-http2=false", "-h2c", "-http2-max-concurrent-streams", "0", "-http2-max-read-frame-size", "1024"}, nil,
+			[]string{"http2.h2c requires", "max_concurrent_streams", "max_read_frame_size"}},
+		{"bad access log", []string{"-access-log-format", "xml", "-access-log-sample", "2", "-access-log-max-size", "-1"}, nil,
+			[]string{`access_log.format must be json, text, common or combined, got "xml"`, "access_log.sample must be between 0 and 1", "max_backups must not be negative"}},
+		{"bad rate limit", []string{"-rate-limit", "POST /hash=fast:10"}, nil, []string{`rate limit "POST /hash=fast:10" must have a positive rate`}},
+		{"bad rate limit key", []string{"-rate-limit-key", "api-key"}, nil, []string{`rate limit key must be ip or header:Name, got "api-key"`}},
+		{"bad concurrency limit", []string{"-concurrency-limit", "POST /hash=0", "-concurrency-queue-timeout", "-1s"}, nil,
+			[]string{`concurrency limit "POST /hash=0" must allow at least 1 request`, "concurrency.queue_timeout must not be negative"}},
+		{"bad timeout", []string{"-request-timeout", "POST /hash=10,/stats=-1s"}, nil,
+			[]string{`timeout "POST /hash=10" must have a positive duration`, `timeout "/stats=-1s" must have a positive duration`}},
+		{"bad compression", []string{"-compress-level", "10", "-compress-min-size", "-1"}, nil,
+			[]string{"compression.level must be between -1 and 9", "compression.min_size must not be negative"}},
+		{"peer without secret", []string{"-peer-addr", "8082", "-follow", "http://primary:8082"}, nil,
+			[]string{`cluster.peer_addr "8082" is not a host:port`, "require a cluster secret"}},
+		{"gossip without secret", []string{"-self", "http://a:8080", "-gossip", ":7946"}, nil, []string{"require a cluster secret"}},
+		{"no address", []string{"-addr", ""}, nil, []string{`addr "" is not a host:port`}},
+		{"bad log level", []string{"-log-level", "loud"}, nil, []string{`log_level must be debug, info, warn or error, got "loud"`}},
+	}
+
+	for _, test := range tests {
+		_, _, err := Load(test.args, env(test.vars))
+		if err == nil {
+			t.Errorf("%v: Load did not error", test.name)
+			continue
+		}
+		for _, c := range test.contains {
+			if !strings.Contains(err.Error(), c) {
+				t.Errorf("%v: Load error does not mention %q. Error: %v", test.name, c, err)
+			}
+		}
+	}
+}
+
+func TestLoadRaftBackend(t *testing.T) {
+	cfg, _, err := Load([]string{"-peer-addr", ":8082", "-self", "http://a:8082", "-raft", "http://a:8082,http://b:8082"}, env(map[string]string{"CLOUD_JUMPER_CLUSTER_SECRET": "shared"}))
+	if err != nil {
+		t.Fatalf("Load errored \n\n %v", err)
+	}
+	if cfg.Storage.Backend != Raft {
+		t.Errorf("Load did not infer the raft backend from the raft members. Backend: %v", cfg.Storage.Backend)
+	}
+}
+
+func TestLoadListen(t *testing.T) {
+	cfg, _, err := Load([]string{"-addr", "", "-listen", "unix:/run/cj.sock,:8443", "-socket-mode", "0660"}, env(nil))
+	if err != nil {
+		t.Fatalf("Load errored with listeners in place of the addr \n\n %v", err)
+	}
+	if len(cfg.Listen.Public) != 2 || cfg.Listen.Public[0] != "unix:/run/cj.sock" {
+		t.Errorf("Load did not split the listeners. Listen: %v", cfg.Listen.Public)
+	}
+	if mode, _ := cfg.Listen.Mode(); mode != 0660 {
+		t.Errorf("Listen Mode did not parse the octal mode. Mode: %o", mode)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	running, _, _ := Load(nil, env(nil))
+	loaded, _, err := Load([]string{"-hash-delay", "1s", "-addr", ":9000", "-log-level", "debug", "-admin-allow", "10.0.0.0/8"}, env(map[string]string{"CLOUD_JUMPER_ADMIN_TOKEN": "secret"}))
+	if err != nil {
+		t.Fatalf("Load errored \n\n %v", err)
+	}
+
+	reloadable, restart := Changes(running, loaded)
+	if strings.Join(reloadable, ",") != "log-level,hash-delay,admin-allow,admin-tokens" {
+		t.Errorf("Changes did not return the reloadable settings. Returned: %v", reloadable)
+	}
+	if strings.Join(restart, ",") != "addr" {
+		t.Errorf("Changes did not return the settings requiring a restart. Returned: %v", restart)
+	}
+
+	merged := Merge(running, loaded)
+	if merged.Addr != ":8080" || merged.LogLevel != "debug" || time.Duration(merged.Hashing.StoreDelay) != time.Second || merged.Admin.Allow[0] != "10.0.0.0/8" {
+		t.Errorf("Merge did not take only the reloadable settings. Config: %+v", merged)
+	}
+	if len(running.Admin.Allow) != 0 {
+		t.Errorf("Merge changed the running config. Allow: %v", running.Admin.Allow)
+	}
+}
@@ -0,0 +1,719 @@
+/*
+Package gossip implements SWIM style cluster membership and failure detection over UDP.
+
+	Every probe interval a node pings the next member in a shuffled round
+	robin. When no ack arrives in time, a few other members are asked to ping
+	it on our behalf, and only if they fail too is the member suspected.
+	Suspected members that don't refute the suspicion by gossiping a higher
+	incarnation number in time are declared dead, and dead members are
+	forgotten once the dead timeout passes. Membership changes are
+	piggybacked on the protocol messages, so no coordinator is needed.
+	Every message is signed with an HMAC of the secret the cluster shares,
+	and messages that fail it are dropped unread.
+*/
+package gossip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Member states
+const (
+	Alive   = "alive"
+	Suspect = "suspect"
+	Dead    = "dead"
+)
+
+// Message types
+const (
+	msgPing    = "ping"
+	msgPingReq = "ping_req"
+	msgAck     = "ack"
+	msgJoin    = "join"
+	msgSync    = "sync"
+)
+
+// Defaults used when a Config leaves the value unset
+const (
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 300 * time.Millisecond
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultDeadTimeout      = time.Minute
+	DefaultIndirectChecks   = 3
+	DefaultRetransmitMult   = 4
+)
+
+// maxPiggyback is the most updates sent with a single message
+const maxPiggyback = 16
+
+// Member is a node of the cluster as seen by this node
+type Member struct {
+	Name        string    `json:"name"`
+	Addr        string    `json:"addr"`
+	State       string    `json:"state"`
+	Incarnation uint64    `json:"incarnation"`
+	Since       time.Time `json:"since"`
+}
+
+// Update is a membership change gossiped between members
+type Update struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+type message struct {
+	Type       string   `json:"type"`
+	Seq        uint64   `json:"seq"`
+	From       string   `json:"from"`
+	Target     string   `json:"target,omitempty"`
+	TargetAddr string   `json:"target_addr,omitempty"`
+	Updates    []Update `json:"updates,omitempty"`
+}
+
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+// Config configures a Memberlist
+type Config struct {
+	// Name uniquely identifies this node, e.g. the base url it serves HTTP on
+	Name string
+	// BindAddr is the UDP address to listen on, e.g. ":7946"
+	BindAddr string
+	// AdvertiseAddr is the UDP address other members reach this node on,
+	// by default the address bound to
+	AdvertiseAddr string
+	// Seeds are the UDP addresses of members to join through
+	Seeds []string
+	// Secret signs the messages members send each other
+	Secret string
+
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	SuspicionTimeout time.Duration
+	DeadTimeout      time.Duration
+	IndirectChecks   int
+	RetransmitMult   int
+}
+
+// Memberlist tracks the members of the cluster
+type Memberlist struct {
+	cfg  Config
+	conn *net.UDPConn
+
+	mu          sync.Mutex
+	self        Member
+	members     map[string]*Member
+	broadcasts  []*broadcast
+	acks        map[uint64]chan struct{}
+	seq         uint64
+	probeOrder  []string
+	probeIndex  int
+	subscribers []func(Member)
+	// joined is set once another member is known, after which
+	// members that aren't known any more have been forgotten dead
+	joined bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a new reference to a Memberlist listening on the bind address.
+// The incarnation starts at the current time, so a restarted node
+// overrides the dead state gossiped about its previous run
+func New(cfg Config) (*Memberlist, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("gossip: a secret is required to sign messages")
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = DefaultProbeInterval
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = DefaultProbeTimeout
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if cfg.DeadTimeout <= 0 {
+		cfg.DeadTimeout = DefaultDeadTimeout
+	}
+	if cfg.IndirectChecks <= 0 {
+		cfg.IndirectChecks = DefaultIndirectChecks
+	}
+	if cfg.RetransmitMult <= 0 {
+		cfg.RetransmitMult = DefaultRetransmitMult
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	advertise := cfg.AdvertiseAddr
+	if advertise == "" {
+		advertise = conn.LocalAddr().String()
+	}
+
+	m := &Memberlist{
+		cfg:     cfg,
+		conn:    conn,
+		members: make(map[string]*Member),
+		acks:    make(map[uint64]chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	m.self = Member{cfg.Name, advertise, Alive, uint64(time.Now().UnixNano()), time.Now()}
+	self := m.self
+	m.members[cfg.Name] = &self
+	return m, nil
+}
+
+// Addr returns the UDP address other members reach this node on
+func (m *Memberlist) Addr() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.self.Addr
+}
+
+// Start begins receiving messages, joining through the seeds and probing members
+func (m *Memberlist) Start() {
+	m.wg.Add(2)
+	go m.receive()
+	go m.run()
+	m.join()
+}
+
+// Stop gossips that this node is leaving, then stops the Memberlist
+func (m *Memberlist) Stop() {
+	m.mu.Lock()
+	m.self.Incarnation++
+	leave := Update{m.self.Name, m.self.Addr, Dead, m.self.Incarnation}
+	targets := m.others(func(mem *Member) bool { return mem.State != Dead })
+	m.mu.Unlock()
+
+	for _, t := range targets {
+		m.send(t.Addr, message{Type: msgSync, Updates: []Update{leave}})
+	}
+
+	close(m.stop)
+	m.conn.Close()
+	m.wg.Wait()
+}
+
+// Subscribe registers fn to be called with a member whenever its state changes
+func (m *Memberlist) Subscribe(fn func(Member)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers = append(m.subscribers, fn)
+}
+
+// Members returns every known member, including dead ones, ordered by name
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		members = append(members, *mem)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// State returns the state of the member named, or an empty string if it's unknown
+func (m *Memberlist) State(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mem, ok := m.members[name]; ok {
+		return mem.State
+	}
+	return ""
+}
+
+// join asks the seeds for the members they know
+func (m *Memberlist) join() {
+	m.mu.Lock()
+	alive := m.aliveUpdate()
+	m.mu.Unlock()
+
+	for _, s := range m.cfg.Seeds {
+		m.send(s, message{Type: msgJoin, From: m.cfg.Name, Updates: []Update{alive}})
+	}
+}
+
+// run probes a member every interval, declaring suspects dead and
+// forgetting dead members once they time out
+func (m *Memberlist) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		m.reap()
+
+		m.mu.Lock()
+		lonely := len(m.others(func(mem *Member) bool { return mem.State != Dead })) == 0
+		m.mu.Unlock()
+
+		// keep trying the seeds until another member is known
+		if lonely {
+			m.join()
+			continue
+		}
+		m.probe()
+	}
+}
+
+// probe pings the next member, falling back to indirect pings
+// through other members before suspecting it
+func (m *Memberlist) probe() {
+	m.mu.Lock()
+	target, ok := m.nextTarget()
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	seq, ack := m.expectAck()
+	m.mu.Unlock()
+	defer m.forgetAck(seq)
+
+	m.send(target.Addr, message{Type: msgPing, Seq: seq, From: m.cfg.Name})
+
+	select {
+	case <-ack:
+		return
+	case <-m.stop:
+		return
+	case <-time.After(m.cfg.ProbeTimeout):
+	}
+
+	m.mu.Lock()
+	helpers := m.others(func(mem *Member) bool { return mem.State == Alive && mem.Name != target.Name })
+	m.mu.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > m.cfg.IndirectChecks {
+		helpers = helpers[:m.cfg.IndirectChecks]
+	}
+	for _, h := range helpers {
+		m.send(h.Addr, message{Type: msgPingReq, Seq: seq, From: m.cfg.Name, Target: target.Name, TargetAddr: target.Addr})
+	}
+
+	select {
+	case <-ack:
+		return
+	case <-m.stop:
+		return
+	case <-time.After(m.cfg.ProbeInterval - m.cfg.ProbeTimeout):
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mem, ok := m.members[target.Name]; ok && mem.State == Alive {
+		log.Printf("Gossip suspects %v after a failed probe", target.Name)
+		m.apply(Update{mem.Name, mem.Addr, Suspect, mem.Incarnation})
+	}
+}
+
+// reap declares members suspected for longer than the suspicion timeout
+// dead, and forgets members dead for longer than the dead timeout
+func (m *Memberlist) reap() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, mem := range m.members {
+		switch {
+		case mem.State == Suspect && time.Since(mem.Since) > m.cfg.SuspicionTimeout:
+			log.Printf("Gossip declared %v dead", mem.Name)
+			m.apply(Update{mem.Name, mem.Addr, Dead, mem.Incarnation})
+		case mem.State == Dead && time.Since(mem.Since) > m.cfg.DeadTimeout:
+			log.Printf("Gossip forgot %v", mem.Name)
+			delete(m.members, name)
+		}
+	}
+}
+
+// receive handles messages until the connection is closed
+func (m *Memberlist) receive() {
+	defer m.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.stop:
+				return
+			default:
+			}
+			log.Printf("Gossip receive failed: %v", err)
+			continue
+		}
+
+		body, ok := m.verify(buf[:n])
+		if !ok {
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			continue
+		}
+		m.handle(msg, from.String())
+	}
+}
+
+func (m *Memberlist) handle(msg message, from string) {
+	m.mu.Lock()
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+
+	// a member we declared dead is still talking, tell it so it can refute
+	if mem, ok := m.members[msg.From]; ok && mem.State == Dead {
+		dead := Update{mem.Name, mem.Addr, Dead, mem.Incarnation}
+		defer m.send(from, message{Type: msgSync, Updates: []Update{dead}})
+	}
+	m.mu.Unlock()
+
+	switch msg.Type {
+	case msgPing:
+		m.send(from, message{Type: msgAck, Seq: msg.Seq, From: m.cfg.Name})
+
+	case msgPingReq:
+		// ping the target for the requester, relaying its ack,
+		// only when it's a member at the address we know it by
+		m.mu.Lock()
+		if mem, ok := m.members[msg.Target]; !ok || mem.Addr != msg.TargetAddr || msg.Target == m.self.Name {
+			m.mu.Unlock()
+			return
+		}
+		seq, ack := m.expectAck()
+		m.mu.Unlock()
+
+		go func() {
+			defer m.forgetAck(seq)
+			m.send(msg.TargetAddr, message{Type: msgPing, Seq: seq, From: m.cfg.Name})
+			select {
+			case <-ack:
+				m.send(from, message{Type: msgAck, Seq: msg.Seq, From: m.cfg.Name})
+			case <-m.stop:
+			case <-time.After(m.cfg.ProbeInterval):
+			}
+		}()
+
+	case msgAck:
+		m.mu.Lock()
+		if ch, ok := m.acks[msg.Seq]; ok {
+			close(ch)
+			delete(m.acks, msg.Seq)
+		}
+		m.mu.Unlock()
+
+	case msgJoin:
+		// a joining member learns every member we know of
+		m.mu.Lock()
+		updates := make([]Update, 0, len(m.members))
+		for _, mem := range m.members {
+			updates = append(updates, Update{mem.Name, mem.Addr, mem.State, mem.Incarnation})
+		}
+		m.mu.Unlock()
+		m.send(from, message{Type: msgSync, Updates: updates})
+	}
+}
+
+// apply applies the update if it overrides what we know of the member,
+// queueing it to be gossiped on
+// The caller must hold mu
+func (m *Memberlist) apply(u Update) {
+	// leaves the member no higher incarnation to refute it with,
+	// or to be heard refuting with
+	if u.Incarnation >= math.MaxUint64-1 {
+		return
+	}
+	if u.Name == m.self.Name {
+		// refute any suspicion of ourselves with a higher incarnation
+		if u.State != Alive && u.Incarnation >= m.self.Incarnation {
+			m.self.Incarnation = u.Incarnation + 1
+			m.members[m.self.Name].Incarnation = m.self.Incarnation
+			log.Printf("Gossip refuted %v of this node with incarnation %v", u.State, m.self.Incarnation)
+			m.queue(m.aliveUpdate())
+		}
+		return
+	}
+
+	mem, known := m.members[u.Name]
+	if known && !overrides(u, mem) {
+		return
+	}
+	if !known {
+		if u.State == Dead {
+			return
+		}
+		mem = &Member{Name: u.Name}
+		m.members[u.Name] = mem
+		m.joined = true
+	}
+
+	changed := !known || mem.State != u.State
+	mem.Addr = u.Addr
+	mem.State = u.State
+	mem.Incarnation = u.Incarnation
+	if changed {
+		mem.Since = time.Now()
+	}
+	m.queue(u)
+
+	if changed {
+		for _, fn := range m.subscribers {
+			go fn(*mem)
+		}
+	}
+}
+
+// overrides reports whether the update takes precedence over the member's state
+func overrides(u Update, mem *Member) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > mem.Incarnation
+	case Suspect:
+		if mem.State == Alive {
+			return u.Incarnation >= mem.Incarnation
+		}
+		return mem.State == Suspect && u.Incarnation > mem.Incarnation
+	case Dead:
+		return mem.State != Dead && u.Incarnation >= mem.Incarnation
+	}
+	return false
+}
+
+// queue adds the update to be piggybacked on messages,
+// replacing any queued update about the same member
+// The caller must hold mu
+func (m *Memberlist) queue(u Update) {
+	for i, b := range m.broadcasts {
+		if b.update.Name == u.Name {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{update: u})
+}
+
+// piggyback returns the least transmitted updates, dropping any
+// transmitted enough times to have reached every member
+// The caller must hold mu
+func (m *Memberlist) piggyback() []Update {
+	limit := m.cfg.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+
+	sort.SliceStable(m.broadcasts, func(i, j int) bool { return m.broadcasts[i].transmits < m.broadcasts[j].transmits })
+	var updates []Update
+	kept := m.broadcasts[:0]
+	for _, b := range m.broadcasts {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, b.update)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	m.broadcasts = kept
+	return updates
+}
+
+// send writes the message to the address with any pending updates piggybacked,
+// always including this node's alive update so the receiver learns of us
+func (m *Memberlist) send(addr string, msg message) {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Printf("Gossip resolving %v failed: %v", addr, err)
+		return
+	}
+
+	m.mu.Lock()
+	if msg.Type != msgSync || len(msg.Updates) == 0 {
+		msg.Updates = append(msg.Updates, m.aliveUpdate())
+	}
+	msg.Updates = append(msg.Updates, m.piggyback()...)
+	m.mu.Unlock()
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	m.conn.WriteToUDP(m.sign(b), to)
+}
+
+// sign returns the message prefixed with its HMAC
+func (m *Memberlist) sign(b []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(m.cfg.Secret))
+	mac.Write(b)
+	return append(mac.Sum(make([]byte, 0, sha256.Size+len(b))), b...)
+}
+
+// verify returns the message of a signed packet, and whether its HMAC is valid
+func (m *Memberlist) verify(packet []byte) ([]byte, bool) {
+	if len(packet) < sha256.Size {
+		return nil, false
+	}
+	sum, b := packet[:sha256.Size], packet[sha256.Size:]
+	mac := hmac.New(sha256.New, []byte(m.cfg.Secret))
+	mac.Write(b)
+	return b, hmac.Equal(sum, mac.Sum(nil))
+}
+
+// nextTarget returns the next member to probe in a shuffled round robin
+// The caller must hold mu
+func (m *Memberlist) nextTarget() (Member, bool) {
+	for tries := 0; tries < 2; tries++ {
+		for m.probeIndex < len(m.probeOrder) {
+			name := m.probeOrder[m.probeIndex]
+			m.probeIndex++
+			if mem, ok := m.members[name]; ok && mem.State != Dead && name != m.self.Name {
+				return *mem, true
+			}
+		}
+
+		// every member has been probed, start a new round
+		m.probeOrder = m.probeOrder[:0]
+		for name := range m.members {
+			m.probeOrder = append(m.probeOrder, name)
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int) { m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i] })
+		m.probeIndex = 0
+	}
+	return Member{}, false
+}
+
+// others returns the members besides this node matching the filter
+// The caller must hold mu
+func (m *Memberlist) others(filter func(*Member) bool) []Member {
+	var members []Member
+	for _, mem := range m.members {
+		if mem.Name != m.self.Name && filter(mem) {
+			members = append(members, *mem)
+		}
+	}
+	return members
+}
+
+// The caller must hold mu
+func (m *Memberlist) aliveUpdate() Update {
+	return Update{m.self.Name, m.self.Addr, Alive, m.self.Incarnation}
+}
+
+// The caller must hold mu
+func (m *Memberlist) expectAck() (uint64, chan struct{}) {
+	m.seq++
+	ch := make(chan struct{})
+	m.acks[m.seq] = ch
+	return m.seq, ch
+}
+
+func (m *Memberlist) forgetAck(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.acks, seq)
+}
+
+var (
+	defaultMu sync.Mutex
+	list      *Memberlist
+)
+
+// Join starts gossiping as a member of the cluster with the config provided
+func Join(cfg Config) error {
+	m, err := New(cfg)
+	if err != nil {
+		return err
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if list != nil {
+		list.Stop()
+	}
+	list = m
+	list.Start()
+	log.Printf("Gossip started on %v as %v", m.Addr(), cfg.Name)
+	return nil
+}
+
+// Leave gossips that this node is leaving and stops gossiping
+func Leave() {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if list != nil {
+		list.Stop()
+		list = nil
+	}
+}
+
+// Enabled reports whether this node is gossiping
+func Enabled() bool {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return list != nil
+}
+
+// Members returns every member known to this node
+func Members() []Member {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if list == nil {
+		return []Member{}
+	}
+	return list.Members()
+}
+
+// IsDead reports whether the member named has been declared dead,
+// including members forgotten since
+func IsDead(name string) bool {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if list == nil {
+		return false
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if mem, ok := list.members[name]; ok {
+		return mem.State == Dead
+	}
+	return list.joined
+}
+
+// Isolated reports whether every other member this node has known is dead,
+// as when this node is partitioned from the rest of the cluster
+func Isolated() bool {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if list == nil {
+		return false
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	alive := list.others(func(mem *Member) bool { return mem.State != Dead })
+	return len(alive) == 0 && list.joined
+}
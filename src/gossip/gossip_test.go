@@ -0,0 +1,221 @@
+package gossip
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func startMember(t *testing.T, name string, seeds ...string) *Memberlist {
+	m, err := New(Config{
+		Name:             name,
+		BindAddr:         "127.0.0.1:0",
+		Seeds:            seeds,
+		Secret:           "secret",
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     20 * time.Millisecond,
+		SuspicionTimeout: 200 * time.Millisecond,
+		DeadTimeout:      500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New errored \n\n %v", err)
+	}
+	m.Start()
+	return m
+}
+
+// kill stops the member without gossiping that it's leaving, as if it crashed
+func kill(m *Memberlist) {
+	close(m.stop)
+	m.conn.Close()
+	m.wg.Wait()
+}
+
+func waitForState(t *testing.T, m *Memberlist, name, state string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if m.State(name) == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%v did not see %v as %v within 5 seconds. State: %q", m.cfg.Name, name, state, m.State(name))
+}
+
+func startCluster(t *testing.T, size int) []*Memberlist {
+	seed := startMember(t, "node0")
+	members := []*Memberlist{seed}
+	for i := 1; i < size; i++ {
+		members = append(members, startMember(t, fmt.Sprintf("node%v", i), seed.Addr()))
+	}
+
+	for _, m := range members {
+		for _, other := range members {
+			waitForState(t, m, other.cfg.Name, Alive)
+		}
+	}
+	return members
+}
+
+func TestJoin(t *testing.T) {
+	members := startCluster(t, 3)
+	for _, m := range members {
+		defer m.Stop()
+	}
+
+	for _, m := range members {
+		if n := len(m.Members()); n != 3 {
+			t.Errorf("%v knows %v members, expected 3", m.cfg.Name, n)
+		}
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	members := startCluster(t, 3)
+	defer members[0].Stop()
+	defer members[1].Stop()
+
+	kill(members[2])
+	waitForState(t, members[0], "node2", Dead)
+	waitForState(t, members[1], "node2", Dead)
+}
+
+func TestForgetDead(t *testing.T) {
+	members := startCluster(t, 3)
+	defer members[0].Stop()
+	defer members[1].Stop()
+
+	members[2].Stop()
+	waitForState(t, members[0], "node2", Dead)
+	waitForState(t, members[0], "node2", "")
+	if n := len(members[0].Members()); n != 2 {
+		t.Errorf("node0 knows %v members after forgetting node2, expected 2", n)
+	}
+
+	// the death gossiped by node1 doesn't bring node2 back
+	time.Sleep(200 * time.Millisecond)
+	if s := members[0].State("node2"); s != "" {
+		t.Errorf("node0 remembered node2 as %v after forgetting it", s)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	members := startCluster(t, 3)
+	defer members[0].Stop()
+	defer members[1].Stop()
+
+	// a leaving member is dead straight away, without suspicion
+	members[2].Stop()
+	waitForState(t, members[0], "node2", Dead)
+	waitForState(t, members[1], "node2", Dead)
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	members := startCluster(t, 3)
+	for _, m := range members {
+		defer m.Stop()
+	}
+
+	target := members[2]
+	target.mu.Lock()
+	before := target.self.Incarnation
+	target.mu.Unlock()
+
+	// suspect node2 from node0 while it's still alive
+	members[0].mu.Lock()
+	mem := members[0].members["node2"]
+	members[0].apply(Update{mem.Name, mem.Addr, Suspect, mem.Incarnation})
+	members[0].mu.Unlock()
+
+	waitForState(t, members[1], "node2", Alive)
+	waitForState(t, members[0], "node2", Alive)
+
+	target.mu.Lock()
+	after := target.self.Incarnation
+	target.mu.Unlock()
+	if after <= before {
+		t.Errorf("node2 did not refute the suspicion with a higher incarnation. Before: %v After: %v", before, after)
+	}
+	if s := members[0].State("node2"); s != Alive {
+		t.Errorf("node0 still sees node2 as %v after the refutation", s)
+	}
+}
+
+// sendAs sends the message to the member signed with the secret, from a new socket
+func sendAs(t *testing.T, m *Memberlist, secret string, msg message) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen for the test sender \n\n %v", err)
+	}
+	to, _ := net.ResolveUDPAddr("udp", m.Addr())
+	signer := &Memberlist{cfg: Config{Secret: secret}}
+	b, _ := json.Marshal(msg)
+	conn.WriteToUDP(signer.sign(b), to)
+	return conn
+}
+
+func TestUnsignedMessages(t *testing.T) {
+	members := startCluster(t, 2)
+	for _, m := range members {
+		defer m.Stop()
+	}
+
+	members[0].mu.Lock()
+	mem := *members[0].members["node1"]
+	members[0].mu.Unlock()
+	dead := Update{mem.Name, mem.Addr, Dead, mem.Incarnation + 1}
+	conn := sendAs(t, members[0], "guess", message{Type: msgSync, Updates: []Update{dead}})
+	defer conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if s := members[0].State("node1"); s != Alive {
+		t.Errorf("A message signed with another secret declared node1 %v", s)
+	}
+}
+
+func TestMaxIncarnation(t *testing.T) {
+	members := startCluster(t, 2)
+	for _, m := range members {
+		defer m.Stop()
+	}
+
+	members[0].mu.Lock()
+	mem := members[0].members["node1"]
+	members[0].apply(Update{mem.Name, mem.Addr, Dead, math.MaxUint64})
+	members[0].mu.Unlock()
+	members[1].mu.Lock()
+	members[1].apply(Update{"node1", mem.Addr, Dead, math.MaxUint64})
+	incarnation := members[1].self.Incarnation
+	members[1].mu.Unlock()
+
+	if s := members[0].State("node1"); s != Alive {
+		t.Errorf("An update with the highest incarnation declared node1 %v", s)
+	}
+	if incarnation == 0 || incarnation == math.MaxUint64 {
+		t.Errorf("node1 refuted an update it can't outbid. Incarnation: %v", incarnation)
+	}
+}
+
+func TestPingReqUnknownTarget(t *testing.T) {
+	members := startCluster(t, 2)
+	for _, m := range members {
+		defer m.Stop()
+	}
+
+	// the target is only pinged when it's a member at that address
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen for the test target \n\n %v", err)
+	}
+	defer target.Close()
+	conn := sendAs(t, members[0], "secret", message{Type: msgPingReq, Seq: 1, From: "node1", Target: "node1", TargetAddr: target.LocalAddr().String()})
+	defer conn.Close()
+
+	target.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := target.ReadFromUDP(make([]byte, 65536)); err == nil {
+		t.Errorf("A ping_req had node0 ping an address that isn't a member's. Sent %v bytes", n)
+	}
+}
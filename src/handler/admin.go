@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/admin"
+)
+
+// Drain handler for the POST "/admin/drain" endpoint
+// Stops this instance accepting new passwords and fails its health check,
+// so load balancers stop sending it traffic before it is shut down
+func Drain(ctx *Context) {
+	admin.Drain()
+	ctx.String(http.StatusOK, "Draining")
+}
+
+// Reload handler for the POST "/admin/reload" endpoint
+// Re-reads the configuration and applies the settings that can change
+// while running, responding with those applied and those requiring a restart
+func Reload(ctx *Context) {
+	report, err := admin.Reload()
+	if err != nil {
+		ctx.String(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	ctx.JSON(http.StatusOK, report)
+}
+
+// Maintenance handler for the POST "/admin/maintenance" endpoint
+// Turns maintenance mode on or off with a JSON body of {"enabled": true},
+// while on the password endpoints respond with a 503 Service Unavailable
+func Maintenance(ctx *Context) {
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&body); err != nil || body.Enabled == nil {
+		ctx.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	admin.SetMaintenance(*body.Enabled)
+	ctx.JSON(http.StatusOK, map[string]bool{"enabled": admin.Maintenance()})
+}
+
+// unavailable responds with a 503 Service Unavailable if this instance is
+// draining or in maintenance mode, returning true when the request should not continue
+func unavailable(ctx *Context, write bool) bool {
+	switch {
+	case admin.Maintenance():
+		ctx.String(http.StatusServiceUnavailable, "Under Maintenance")
+	case write && admin.Draining():
+		ctx.String(http.StatusServiceUnavailable, "Draining")
+	default:
+		return false
+	}
+	return true
+}
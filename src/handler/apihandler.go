@@ -4,9 +4,9 @@ Package handler contains functions to handle http request.
 package handler
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 )
@@ -23,6 +23,8 @@ type Route struct {
 	Path       string
 	Handler    func(*Context)
 	NamedParam string
+	// Pattern is the path as registered, e.g. /hash/:id
+	Pattern string
 }
 
 type Middleware struct {
@@ -34,10 +36,6 @@ type RouteKey struct {
 	HTTPMethod, Path string
 }
 
-// CSignal exports our channel for signaling a shutdown
-// this is needed for Windows Support, you can not send a signal to an app
-var CSignal = make(chan os.Signal)
-
 // New returns a new reference to an APIHandler struct
 func New() *APIHandler {
 	r := make(map[RouteKey]Route)
@@ -52,7 +50,8 @@ var namedParamRegex = regexp.MustCompile(`^/(\w+)/(:\w+|\w+=?)$`)
 // ServerHTTP implements the http.Handler interface
 // as a basic routing handler
 func (a APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := &Context{w, r, make(map[string]string)}
+	rw := NewResponse(w)
+	ctx := &Context{ResponseWriter: rw, Request: r, Params: make(map[string]string), response: rw}
 	var handler func(*Context)
 
 	for _, v := range a.PreMiddleware {
@@ -62,8 +61,8 @@ func (a APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	route, ok := a.Routes[RouteKey{r.Method, strings.ToLower(r.URL.Path)}]
 	if !ok {
 		for k, v := range a.Routes {
-			// if the route doesn't have a named param, shortcut to the next route
-			if v.NamedParam == "" {
+			// if the route doesn't have a named param or is for another method, shortcut to the next route
+			if v.NamedParam == "" || k.HTTPMethod != r.Method {
 				continue
 			}
 
@@ -89,6 +88,9 @@ func (a APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		handler = func(ctx *Context) { ctx.String(http.StatusNotFound, "Not Found") }
 	} else {
 		handler = route.Handler
+		if matched, ok := r.Context().Value(routeKey{}).(*string); ok {
+			*matched = route.Pattern
+		}
 	}
 
 	// run route handler
@@ -102,6 +104,16 @@ func (a APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+type routeKey struct{}
+
+// TrackRoute returns a copy of the context an APIHandler serving a request with it
+// records the pattern of the route it matched in, and a func returning the pattern,
+// or an empty string when no route matched
+func TrackRoute(ctx context.Context) (context.Context, func() string) {
+	matched := new(string)
+	return context.WithValue(ctx, routeKey{}, matched), func() string { return *matched }
+}
+
 // Pre registers a new Pre Middleware handler
 // to be called before any routes are handdled
 func (a APIHandler) Pre(handler func(*Context)) {
@@ -124,21 +136,23 @@ func (a APIHandler) Any(path string, handler func(*Context)) {
 // Get registers a new GET route
 // for the path and handler provided
 func (a APIHandler) Get(path string, handler func(*Context)) {
+	pattern := path
 	r, param := checkNamedParam(path)
 	if r != "" {
 		path = r
 	}
-	a.Routes[RouteKey{http.MethodGet, strings.ToLower(path)}] = Route{path, handler, param}
+	a.Routes[RouteKey{http.MethodGet, strings.ToLower(path)}] = Route{path, handler, param, pattern}
 }
 
 // Post registers a new POST route
 // for the path and handler provided
 func (a APIHandler) Post(path string, handler func(*Context)) {
+	pattern := path
 	r, param := checkNamedParam(path)
 	if r != "" {
 		path = r
 	}
-	a.Routes[RouteKey{http.MethodPost, strings.ToLower(path)}] = Route{path, handler, param}
+	a.Routes[RouteKey{http.MethodPost, strings.ToLower(path)}] = Route{path, handler, param, pattern}
 }
 
 // checkNamedParam checks to see if the path provided, is using a url parameter based
@@ -150,7 +164,7 @@ func checkNamedParam(path string) (string, string) {
 	}
 	pathprefix := match[1]
 	param := match[2]
-	if param != "" {
+	if strings.HasPrefix(param, ":") {
 		return fmt.Sprintf("^/%v/(\\w+=?)$", pathprefix), strings.Split(param, ":")[1]
 	}
 	return "", ""
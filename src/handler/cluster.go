@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/cluster"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+	"github.com/caoakleyii/cloud-jumper/src/transfer"
+)
+
+// GetCluster handler for the GET "/admin/cluster" endpoint
+// Returns this node's view of the cluster
+func GetCluster(ctx *Context) {
+	ctx.JSON(http.StatusOK, cluster.CurrentStatus())
+}
+
+// Rebalance handler for the POST "/admin/rebalance" endpoint
+// Optionally replaces the peer list with a JSON body of {"peers": [...]}
+// then moves every record this node no longer owns to its owner
+func Rebalance(ctx *Context) {
+	if !cluster.Enabled() {
+		ctx.String(http.StatusConflict, "Cluster Not Enabled")
+		return
+	}
+
+	var body struct {
+		Peers []string `json:"peers"`
+	}
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&body); err != nil && err != io.EOF {
+		ctx.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	if body.Peers != nil {
+		cluster.Configure(cluster.CurrentStatus().Self, body.Peers)
+	}
+
+	ctx.JSON(http.StatusOK, cluster.Rebalance(cache.InMemoryPasswordStorage))
+}
+
+// ReceiveRecords handler for the POST "/cluster/records" endpoint
+// Stores ndjson records moved to this node by a rebalance,
+// keeping any record this node already has
+func ReceiveRecords(ctx *Context) {
+	if readOnly(ctx) {
+		return
+	}
+
+	body := http.MaxBytesReader(ctx.ResponseWriter, ctx.Request.Body, maxImportBytes)
+	report, err := transfer.Import(body, cache.PasswordStorage, transfer.NDJSON, transfer.Skip, false)
+	if err != nil {
+		importFailed(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
+
+// forward proxies the request to the peer that owns it
+// and responds with the peer's response
+func forward(ctx *Context, peer string, body io.Reader, header http.Header) {
+	resp, err := cluster.Forward(peer, ctx.Request, body, header)
+	if err != nil {
+		requestid.Printf(ctx.Request.Context(), "Forwarding to %v failed: %v", peer, err)
+		ctx.String(http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		ctx.ResponseWriter.Header().Set("Content-Type", ct)
+	}
+	ctx.ResponseWriter.WriteHeader(resp.StatusCode)
+	io.Copy(ctx.ResponseWriter, resp.Body)
+}
@@ -1,8 +1,13 @@
 package handler
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
 	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/proxy"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
 )
 
 // Context represents the context of the current HTTP request and
@@ -12,12 +17,15 @@ type Context struct {
 	ResponseWriter http.ResponseWriter
 	Request        *http.Request
 	Params         map[string]string
+	// response records what's been written through ResponseWriter
+	response *Response
 }
 
-// String sends a string response with the provided status code
+// String sends a string response with the provided status code. Once the
+// headers are committed, e.g. by a middleware responding first, only the
+// message is written
 func (ctx *Context) String(status int, message string) {
-	ctx.ResponseWriter.Header().Set("Content-Type", "text/plain;charsetUTF8")
-	ctx.ResponseWriter.WriteHeader(status)
+	ctx.writeHeader(status, "text/plain;charsetUTF8")
 	ctx.ResponseWriter.Write([]byte(message))
 }
 
@@ -26,13 +34,77 @@ func (ctx *Context) JSON(status int, body interface{}) {
 	j, err := json.Marshal(body)
 	if err != nil {
 		ctx.String(http.StatusInternalServerError, "Internal Server Error")
+		return
 	}
-	ctx.ResponseWriter.Header().Set("Content-Type", "application/json")
-	ctx.ResponseWriter.WriteHeader(status)
+	ctx.writeHeader(status, "application/json")
 	ctx.ResponseWriter.Write(j)
 }
 
+// writeHeader sends the status and content type unless the headers are committed
+func (ctx *Context) writeHeader(status int, contentType string) {
+	if ctx.Committed() {
+		return
+	}
+	ctx.ResponseWriter.Header().Set("Content-Type", contentType)
+	ctx.ResponseWriter.WriteHeader(status)
+}
+
+// Status returns the status sent in response, or zero until the headers are committed
+func (ctx *Context) Status() int {
+	return ctx.Response().Status()
+}
+
+// Committed returns whether the response's headers have been sent
+func (ctx *Context) Committed() bool {
+	return ctx.Response().Committed()
+}
+
+// Response returns the record of the response written through ResponseWriter
+func (ctx *Context) Response() *Response {
+	if ctx.response == nil {
+		ctx.response = NewResponse(ctx.ResponseWriter)
+		ctx.ResponseWriter = ctx.response
+	}
+	return ctx.response
+}
+
 // Param returns the registered path parameter by name
 func (ctx *Context) Param(name string) string {
 	return ctx.Params[name]
 }
+
+// ClientCert returns the verified certificate the client
+// presented over mutual TLS, or nil when it presented none
+func (ctx *Context) ClientCert() *x509.Certificate {
+	if ctx.Request.TLS == nil || len(ctx.Request.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return ctx.Request.TLS.VerifiedChains[0][0]
+}
+
+// ClientIdentity returns the common name of the client's verified certificate,
+// or an empty string when it presented none
+func (ctx *Context) ClientIdentity() string {
+	if cert := ctx.ClientCert(); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// RealIP returns the IP of the client, resolved through the
+// forwarding headers added by trusted proxies
+func (ctx *Context) RealIP() string {
+	return proxy.RealIP(ctx.Request)
+}
+
+// Context returns the context of the request, done once the client goes away
+// or a deadline set by the Timeout middleware passes
+func (ctx *Context) Context() context.Context {
+	return ctx.Request.Context()
+}
+
+// RequestID returns the id of the request, given by the RequestID middleware,
+// or an empty string when it has none
+func (ctx *Context) RequestID() string {
+	return requestid.From(ctx.Request.Context())
+}
@@ -2,6 +2,9 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,7 +12,7 @@ import (
 )
 
 func TestContext(t *testing.T) {
-	t.Run("TestString", testString)
+	t.Run("TestString", TestString)
 	t.Run("TestParam", TestParam)
 }
 
@@ -50,6 +53,8 @@ func TestString(t *testing.T) {
 	if resp.StatusCode != expectedStatus {
 		t.Errorf("TestString did not properly return the status expected. Expected: %v | Returned: %v", expectedStatus, resp.StatusCode)
 	}
+
+	server.Shutdown(context.Background())
 }
 
 func TestParam(t *testing.T) {
@@ -87,3 +92,27 @@ func TestParam(t *testing.T) {
 
 	server.Shutdown(context.Background())
 }
+
+func TestClientIdentity(t *testing.T) {
+	ctx := &Context{Request: &http.Request{}}
+	if ctx.ClientCert() != nil || ctx.ClientIdentity() != "" {
+		t.Errorf("TestClientIdentity returned an identity for a plain HTTP request")
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client-a"}}
+	ctx.Request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if ctx.ClientIdentity() != "client-a" {
+		t.Errorf("TestClientIdentity did not return the certificate's common name. Returned: %v", ctx.ClientIdentity())
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	// without trusted proxies forwarding headers are ignored
+	ctx := &Context{Request: &http.Request{
+		RemoteAddr: "192.0.2.1:1234",
+		Header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+	}}
+	if ip := ctx.RealIP(); ip != "192.0.2.1" {
+		t.Errorf("RealIP believed an untrusted forwarding header. Returned: %v", ip)
+	}
+}
@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/gossip"
+)
+
+// GetMembers handler for the GET "/admin/members" endpoint
+// Returns every cluster member known to this node's gossip and its state
+func GetMembers(ctx *Context) {
+	if !gossip.Enabled() {
+		ctx.String(http.StatusNotFound, "Gossip Not Enabled")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gossip.Members())
+}
@@ -2,9 +2,14 @@ package handler
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/cluster"
+	"github.com/caoakleyii/cloud-jumper/src/jobs"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
 
 	"github.com/caoakleyii/cloud-jumper/src/hasher"
 )
@@ -54,9 +59,13 @@ func postPassword(ctx *Context) {
 */
 
 // PostPassword handler for the POST "/hash" endpoint
-// Hashes a password and returns the id and after 5 seconds stores it
+// Hashes a password and returns the id and after the policy's store delay stores it
 // in-memory
 func PostPassword(ctx *Context) {
+	if unavailable(ctx, true) || readOnly(ctx) {
+		return
+	}
+
 	p := ctx.Request.FormValue("password")
 
 	// Check "validation" the incoming password
@@ -65,30 +74,86 @@ func PostPassword(ctx *Context) {
 		return
 	}
 
-	// Always generate a secure salt for your hash
-	salt, err := hasher.GenerateRandomString(32)
+	policy := hasher.CurrentPolicy()
 
-	if err != nil {
-		ctx.String(http.StatusInternalServerError, "Internal Server Error")
+	// generate a short id, unless the node forwarding this request already has
+	forwarded := cluster.IsForwarded(ctx.Request)
+	id := ""
+	if forwarded {
+		id = ctx.Request.Header.Get(cluster.IDHeader)
+	}
+
+	if id == "" {
+		var err error
+		id, err = hasher.GenerateRandomString(policy.IDLength)
+
+		if err != nil {
+			ctx.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+	}
+
+	// send the password to the node that owns the id
+	if owner, local := cluster.Owner(id); !local && !forwarded {
+		header := http.Header{}
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+		header.Set(cluster.IDHeader, id)
+		forward(ctx, owner, strings.NewReader(url.Values{"password": {p}}.Encode()), header)
 		return
 	}
 
-	// generate a short id
-	id, err := hasher.GenerateRandomString(8)
+	// a record still waiting on its store delay isn't in the store yet
+	if _, ok := cache.PasswordStorage.Get(id); ok || jobs.Default.Pending(id) {
+		ctx.String(http.StatusConflict, "Password Id Already Exists")
+		return
+	}
+
+	// Always generate a secure salt for your hash
+	salt, err := hasher.GenerateRandomString(policy.SaltLength)
 
 	if err != nil {
 		ctx.String(http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
-	// store the data on a seperate thread 5 seconds later
-	go func(id string, m map[string]string) {
-		time.Sleep(time.Second * 5)
+	// backends other than the in memory store replicate the write,
+	// so the id is only returned once the record has been committed
+	if _, ok := cache.PasswordStorage.(*cache.Store); !ok {
+		r := cache.Record{ID: id, Hash: hasher.Sha512HashBase64Encode(p, salt), CreatedAt: time.Now()}
+		// a request given up on is never told its id, so isn't stored
+		if ctx.Context().Err() != nil {
+			return
+		}
+		put := cache.PasswordStorage.Put
+		if s, ok := cache.PasswordStorage.(cache.ContextPutter); ok {
+			put = func(r cache.Record) error { return s.PutContext(ctx.Context(), r) }
+		}
+		if err := put(r); err != nil {
+			if ctx.Context().Err() != nil {
+				return
+			}
+			requestid.Printf(ctx.Context(), "Storing password %v failed: %v", id, err)
+			ctx.String(http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+
+		ctx.String(http.StatusCreated, id)
+		return
+	}
 
-		// hash, encode and store the password
-		p = hasher.Sha512HashBase64Encode(p, salt)
-		m[id] = p
-	}(id, cache.InMemoryPasswordStorage)
+	// store the data on a seperate thread after the delay, the job is
+	// tracked so a shutdown waits for it or reports it lost
+	r := cache.Record{ID: id, Hash: hasher.Sha512HashBase64Encode(p, salt), CreatedAt: time.Now()}
+	if err := jobs.Default.Submit(ctx.Context(), r, cache.PasswordStorage, policy.StoreDelay); err != nil {
+		switch {
+		case ctx.Context().Err() != nil:
+		case err == jobs.ErrPending:
+			ctx.String(http.StatusConflict, "Password Id Already Exists")
+		default:
+			ctx.String(http.StatusServiceUnavailable, "Shutting Down")
+		}
+		return
+	}
 
 	// return 201 created with the id
 	ctx.String(http.StatusCreated, id)
@@ -105,15 +170,24 @@ func PostPassword(ctx *Context) {
 // GetPassword handler function that returns an
 // OK response with the hashed password
 func GetPassword(ctx *Context) {
+	if unavailable(ctx, false) {
+		return
+	}
+
 	id := ctx.Param("id")
 
-	p := cache.InMemoryPasswordStorage[id]
+	if owner, local := cluster.Owner(id); !local && !cluster.IsForwarded(ctx.Request) {
+		forward(ctx, owner, nil, nil)
+		return
+	}
+
+	r, ok := cache.PasswordStorage.Get(id)
 
-	if p == "" {
+	if !ok {
 		ctx.String(http.StatusNotFound, "Password Not Found")
 		return
 	}
 
-	ctx.String(http.StatusOK, p)
+	ctx.String(http.StatusOK, r.Hash)
 	return
 }
@@ -1,10 +1,50 @@
 package handler
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/gossip"
+	"github.com/caoakleyii/cloud-jumper/src/health"
+)
 
 // GetHealth used to monitor the status of the API
-// will be used in unit-testing of problems
+// will be used in unit-testing of problems. Responds with a 503 while
+// draining, in maintenance or once gossip has declared every other cluster member dead
 func GetHealth(ctx *Context) {
+	if unavailable(ctx, true) {
+		return
+	}
+	if gossip.Isolated() {
+		ctx.String(http.StatusServiceUnavailable, "Isolated From Cluster")
+		return
+	}
 	ctx.String(http.StatusOK, "Server is responding")
 	return
 }
+
+// GetLivez handler for the GET "/livez" endpoint
+// Responds with a 503 when a liveness check fails, listing every
+// check's result and latency as JSON with the verbose query parameter
+func GetLivez(ctx *Context) {
+	writeReport(ctx, health.Default.Liveness(ctx.Request.Context()))
+}
+
+// GetReadyz handler for the GET "/readyz" endpoint
+// Responds with a 503 when a readiness check fails, such as while draining,
+// listing every check's result and latency as JSON with the verbose query parameter
+func GetReadyz(ctx *Context) {
+	writeReport(ctx, health.Default.Readiness(ctx.Request.Context()))
+}
+
+func writeReport(ctx *Context, report health.Report) {
+	status := http.StatusOK
+	if !report.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+
+	if _, verbose := ctx.Request.URL.Query()["verbose"]; verbose {
+		ctx.JSON(status, report)
+		return
+	}
+	ctx.String(status, report.Status)
+}
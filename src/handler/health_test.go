@@ -2,9 +2,14 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"sync/atomic"
 	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/health"
 )
 
 func TestGetHealth(t *testing.T) {
@@ -45,3 +50,50 @@ func TestGetHealth(t *testing.T) {
 
 	server.Shutdown(context.Background())
 }
+
+func TestGetReadyz(t *testing.T) {
+	a := New()
+	a.Get("/readyz", GetReadyz)
+	server := startTestServer(t, a)
+	defer server.Shutdown(context.Background())
+
+	// checks go on a fresh registry so they don't leak into later tests
+	registry := health.Default
+	health.Default = health.NewRegistry()
+	t.Cleanup(func() { health.Default = registry })
+
+	var failing atomic.Bool
+	health.Default.Ready(health.Check{Name: "test", Fn: func(context.Context) error {
+		if failing.Load() {
+			return errors.New("failing")
+		}
+		return nil
+	}})
+
+	resp, err := http.Get("http://localhost:9999/readyz")
+	if err != nil {
+		t.Fatalf("TestGetReadyz errored when making request to test server \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("TestGetReadyz did not return an OK status. Returned: %v", resp.StatusCode)
+	}
+
+	failing.Store(true)
+	resp, err = http.Get("http://localhost:9999/readyz?verbose")
+	if err != nil {
+		t.Fatalf("TestGetReadyz errored when making request to test server \n\n %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("TestGetReadyz did not return a Service Unavailable status. Returned: %v", resp.StatusCode)
+	}
+
+	var report health.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("TestGetReadyz did not return a JSON report \n\n %v", err)
+	}
+	if len(report.Checks) != 1 || report.Checks[0].Error != "failing" {
+		t.Errorf("TestGetReadyz did not list the failing check. Report: %+v", report)
+	}
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain retries connections refused by the test port, so tests starting
+// their server in a goroutine may request it before it's listening, and
+// doesn't keep connections alive to reach the next test's server
+func TestMain(m *testing.M) {
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.DisableKeepAlives = true
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for i := 0; ; i++ {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err == nil || i == 100 || !errors.Is(err, syscall.ECONNREFUSED) {
+				return conn, err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	os.Exit(m.Run())
+}
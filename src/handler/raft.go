@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/raft"
+)
+
+// RaftRPC handler for the POST "/raft/:rpc" endpoint
+// Handles the requests Raft members send each other
+func RaftRPC(ctx *Context) {
+	n, ok := raftNode(ctx)
+	if !ok {
+		return
+	}
+
+	dec := json.NewDecoder(ctx.Request.Body)
+	var err error
+	var resp interface{}
+	switch ctx.Param("rpc") {
+	case raft.RPCVote:
+		var req raft.VoteRequest
+		if err = dec.Decode(&req); err == nil {
+			resp = n.HandleVote(req)
+		}
+	case raft.RPCAppend:
+		var req raft.AppendRequest
+		if err = dec.Decode(&req); err == nil {
+			resp = n.HandleAppend(req)
+		}
+	case raft.RPCSnapshot:
+		var req raft.SnapshotRequest
+		if err = dec.Decode(&req); err == nil {
+			resp = n.HandleSnapshot(req)
+		}
+	case raft.RPCPropose:
+		var req raft.ProposeRequest
+		if err = dec.Decode(&req); err == nil {
+			resp = n.HandlePropose(req)
+		}
+	default:
+		ctx.String(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// GetRaftStatus handler for the GET "/admin/raft" endpoint
+// Returns the state of this Raft member
+func GetRaftStatus(ctx *Context) {
+	n, ok := raftNode(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, n.Status())
+}
+
+// AddRaftMember handler for the POST "/admin/raft/members" endpoint
+// Adds the member in the JSON body of {"id": "http://host:port"},
+// responding once the configuration change has committed
+func AddRaftMember(ctx *Context) {
+	changeRaftMembers(ctx, func(n *raft.Node, id string) error { return n.AddMember(id) })
+}
+
+// RemoveRaftMember handler for the POST "/admin/raft/members/remove" endpoint
+// Removes the member in the JSON body of {"id": "http://host:port"},
+// responding once the configuration change has committed
+func RemoveRaftMember(ctx *Context) {
+	changeRaftMembers(ctx, func(n *raft.Node, id string) error { return n.RemoveMember(id) })
+}
+
+func changeRaftMembers(ctx *Context, change func(*raft.Node, string) error) {
+	n, ok := raftNode(ctx)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&body); err != nil || body.ID == "" {
+		ctx.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	if err := change(n, body.ID); err != nil {
+		ctx.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	ctx.JSON(http.StatusOK, n.Status())
+}
+
+// raftNode returns the Raft member backing the password storage,
+// responding with a 404 Not Found when the Raft backend isn't in use
+func raftNode(ctx *Context) (*raft.Node, bool) {
+	n, ok := cache.PasswordStorage.(*raft.Node)
+	if !ok {
+		ctx.String(http.StatusNotFound, "Raft Not Enabled")
+	}
+	return n, ok
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/replication"
+)
+
+// changeBatch is the most changes read from the log at a time
+const changeBatch = 1000
+
+// defaultStreamWait and maxStreamWait bound how long a change log stream
+// stays open before the follower reconnects from its last offset,
+// so streams never hold up a graceful shutdown for long
+const (
+	defaultStreamWait = 30 * time.Second
+	maxStreamWait     = 5 * time.Minute
+)
+
+// StreamChanges handler for the GET "/replication/log" endpoint
+// Streams the change log after the offset query parameter as ndjson,
+// waiting for new changes until the wait query parameter duration passes.
+// An offset compacted out of the log is answered with a snapshot instead
+func StreamChanges(ctx *Context) {
+	q := ctx.Request.URL.Query()
+	store := cache.InMemoryPasswordStorage
+
+	var offset uint64
+	if v := q.Get("offset"); v != "" {
+		var err error
+		if offset, err = strconv.ParseUint(v, 10, 64); err != nil {
+			ctx.String(http.StatusBadRequest, "Bad Request")
+			return
+		}
+	}
+
+	wait := defaultStreamWait
+	if v := q.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxStreamWait {
+			ctx.String(http.StatusBadRequest, "Bad Request")
+			return
+		}
+		wait = d
+	}
+
+	// a follower ahead of our log has followed a different primary
+	if offset > store.Offset() {
+		ctx.String(http.StatusConflict, "Offset Ahead Of Change Log")
+		return
+	}
+	// one behind the compacted log starts over from a snapshot
+	if offset < store.Compacted() {
+		streamSnapshot(ctx, store)
+		return
+	}
+
+	ctx.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+	ctx.ResponseWriter.WriteHeader(http.StatusOK)
+	flusher, _ := ctx.ResponseWriter.(http.Flusher)
+	enc := json.NewEncoder(ctx.ResponseWriter)
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		// get the channel before reading, so a change in between isn't missed
+		changed := store.Changed()
+		changes, err := store.ChangesSince(offset, changeBatch)
+		// the log was compacted past a slow follower, which reconnects for a snapshot
+		if err != nil {
+			return
+		}
+
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+			offset = c.Offset
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if len(changes) == changeBatch {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return
+		case <-ctx.Context().Done():
+			return
+		}
+	}
+}
+
+// streamSnapshot streams every record as ndjson, with the offset
+// of the last change they include in the snapshot header
+func streamSnapshot(ctx *Context, store *cache.Store) {
+	records, offset := store.Snapshot()
+
+	ctx.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+	ctx.ResponseWriter.Header().Set(replication.SnapshotHeader, strconv.FormatUint(offset, 10))
+	ctx.ResponseWriter.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(ctx.ResponseWriter)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return
+		}
+	}
+}
+
+// GetReplicationStatus handler for the GET "/admin/replication" endpoint
+// Returns the role and change log offset of this instance
+func GetReplicationStatus(ctx *Context) {
+	ctx.JSON(http.StatusOK, replication.CurrentStatus(cache.InMemoryPasswordStorage))
+}
+
+// Promote handler for the POST "/admin/promote" endpoint
+// Stops following the primary and starts accepting writes
+func Promote(ctx *Context) {
+	if _, err := replication.Promote(); err != nil {
+		ctx.String(http.StatusConflict, "Already Primary")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, replication.CurrentStatus(cache.InMemoryPasswordStorage))
+}
+
+// readOnly responds with a 503 Service Unavailable if this instance
+// is a follower, returning true when the write should not continue
+func readOnly(ctx *Context) bool {
+	if !replication.IsFollower() {
+		return false
+	}
+	ctx.String(http.StatusServiceUnavailable, "Read Only Follower")
+	return true
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/replication"
+)
+
+func TestStreamChanges(t *testing.T) {
+	a := New()
+	a.Get("/replication/log", StreamChanges)
+	server := startTestServer(t, a)
+
+	store := cache.NewStore()
+	store.Put(cache.Record{ID: "local", Hash: "hash"})
+	r := replication.NewReplica("http://localhost:9999", store)
+	r.Start()
+
+	cache.InMemoryPasswordStorage.Put(cache.Record{ID: "replicated1", Hash: "hash", CreatedAt: time.Now()})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := store.Get("replicated1"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("TestStreamChanges follower did not apply the change within 5 seconds")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := store.Get("local"); ok {
+		t.Errorf("TestStreamChanges follower kept a record the primary never had")
+	}
+	if r.Offset() != cache.InMemoryPasswordStorage.Offset() {
+		t.Errorf("TestStreamChanges follower offset did not match the primary. Expected: %v | Returned: %v", cache.InMemoryPasswordStorage.Offset(), r.Offset())
+	}
+
+	r.Stop()
+	server.Shutdown(context.Background())
+}
+
+func TestStreamSnapshot(t *testing.T) {
+	a := New()
+	a.Get("/replication/log", StreamChanges)
+	server := startTestServer(t, a)
+	defer server.Shutdown(context.Background())
+
+	primary := cache.InMemoryPasswordStorage
+	primary.SetRetain(1)
+	defer primary.SetRetain(cache.DefaultRetain)
+	primary.Put(cache.Record{ID: "snapshot1", Hash: "hash", CreatedAt: time.Now()})
+	primary.Put(cache.Record{ID: "snapshot2", Hash: "hash", CreatedAt: time.Now()})
+
+	store := cache.NewStore()
+	store.Put(cache.Record{ID: "stale", Hash: "hash"})
+	r := replication.NewReplica("http://localhost:9999", store)
+	r.Start()
+	defer r.Stop()
+
+	caughtUp := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for r.Offset() != primary.Offset() {
+			if time.Now().After(deadline) {
+				t.Fatalf("TestStreamSnapshot follower did not catch up within 5 seconds. Offset: %v | Primary: %v", r.Offset(), primary.Offset())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the follower starts over from a snapshot, then follows the log again
+	caughtUp()
+	if _, ok := store.Get("stale"); ok {
+		t.Errorf("TestStreamSnapshot follower kept a record missing from the snapshot")
+	}
+	primary.Put(cache.Record{ID: "snapshot3", Hash: "hash", CreatedAt: time.Now()})
+	caughtUp()
+
+	if store.Len() != primary.Len() {
+		t.Errorf("TestStreamSnapshot follower did not restore the snapshot. Expected: %v records | Returned: %v", primary.Len(), store.Len())
+	}
+	if _, ok := store.Get("snapshot3"); !ok {
+		t.Errorf("TestStreamSnapshot follower did not apply the change after the snapshot")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	a := New()
+	a.Get("/replication/log", StreamChanges)
+	a.Post("/hash", PostPassword)
+	a.Post("/admin/promote", Promote)
+	server := startTestServer(t, a)
+
+	replication.Follow("http://localhost:9999", cache.NewStore())
+
+	resp, err := http.PostForm("http://localhost:9999/hash", url.Values{"password": {"angryMonkey"}})
+
+	if err != nil {
+		t.Errorf("TestPromote errored when making request to test server \n\n %v", err)
+	}
+
+	if resp.StatusCode != 503 {
+		t.Errorf("TestPromote follower did not reject a write. Returned: %v", resp.StatusCode)
+	}
+
+	resp, err = http.Post("http://localhost:9999/admin/promote", "", nil)
+
+	if err != nil {
+		t.Errorf("TestPromote errored when making request to test server \n\n %v", err)
+	}
+
+	if resp.StatusCode != 200 || replication.IsFollower() {
+		t.Errorf("TestPromote did not promote the follower. Returned: %v", resp.StatusCode)
+	}
+
+	resp, err = http.Post("http://localhost:9999/admin/promote", "", nil)
+
+	if err != nil {
+		t.Errorf("TestPromote errored when making request to test server \n\n %v", err)
+	}
+
+	if resp.StatusCode != 409 {
+		t.Errorf("TestPromote did not return a CONFLICT status promoting a primary. Returned: %v", resp.StatusCode)
+	}
+
+	server.Shutdown(context.Background())
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Response wraps an http.ResponseWriter, recording the status and size
+// of the response and whether its headers have been committed. It keeps
+// the writer's flushing, hijacking and io.ReaderFrom capabilities
+type Response struct {
+	http.ResponseWriter
+	status   int
+	size     int64
+	hijacked bool
+}
+
+// NewResponse wraps the writer, or returns it when it's already a Response
+// so handlers wrapped by middleware share the same record
+func NewResponse(w http.ResponseWriter) *Response {
+	if r, ok := w.(*Response); ok {
+		return r
+	}
+	return &Response{ResponseWriter: w}
+}
+
+// Status returns the status sent, or zero until the headers are committed
+func (r *Response) Status() int {
+	return r.status
+}
+
+// Size returns the bytes of body written
+func (r *Response) Size() int64 {
+	return r.size
+}
+
+// Committed returns whether the headers have been sent, after which they
+// can no longer be changed, or the connection has been hijacked
+func (r *Response) Committed() bool {
+	return r.status != 0 || r.hijacked
+}
+
+// WriteHeader implements the http.ResponseWriter interface,
+// ignoring any call once the headers are committed
+func (r *Response) WriteHeader(status int) {
+	if r.Committed() {
+		return
+	}
+	// informational responses precede the final one
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface
+func (r *Response) Write(b []byte) (int, error) {
+	r.commit()
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// commit records the implicit 200 net/http sends when the body is written first
+func (r *Response) commit() {
+	if !r.Committed() {
+		r.status = http.StatusOK
+	}
+}
+
+// Flush implements the http.Flusher interface, doing nothing
+// when the underlying writer can't flush
+func (r *Response) Flush() {
+	r.commit()
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Hijack implements the http.Hijacker interface, failing with
+// http.ErrNotSupported when the underlying writer can't be hijacked, e.g. over HTTP/2
+func (r *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// ReadFrom implements the io.ReaderFrom interface, letting net/http
+// copy files straight to the connection
+func (r *Response) ReadFrom(src io.Reader) (int64, error) {
+	r.commit()
+	var n int64
+	var err error
+	if rf, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		// hide ReadFrom so io.Copy doesn't call back into it
+		n, err = io.Copy(struct{ io.Writer }{r.ResponseWriter}, src)
+	}
+	r.size += n
+	return n, err
+}
+
+// Unwrap lets an http.ResponseController reach the underlying writer
+func (r *Response) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponse(t *testing.T) {
+	a := New()
+	statuses := make(chan int, 1)
+	a.Pre(func(ctx *Context) {
+		if ctx.Request.URL.Path == "/health" {
+			ctx.String(http.StatusAccepted, "pre ")
+		}
+	})
+	a.Get("/health", func(ctx *Context) {
+		ctx.String(http.StatusInternalServerError, "handler")
+	})
+	a.Get("/upgrade", func(ctx *Context) {
+		conn, rw, err := ctx.ResponseWriter.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack errored \n\n %v", err)
+			return
+		}
+		defer conn.Close()
+		if !ctx.Committed() {
+			t.Errorf("The response was not committed once hijacked")
+		}
+		rw.WriteString("HTTP/1.1 204 No Content\r\n\r\n")
+		rw.Flush()
+	})
+	a.Use(func(ctx *Context) {
+		statuses <- ctx.Status()
+	})
+
+	server := startTestServer(t, a)
+	defer server.Shutdown(context.Background())
+
+	resp, err := http.Get("http://localhost:9999/health")
+	if err != nil {
+		t.Fatalf("TestResponse errored when making a request to test server: \n\n %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// the status first sent stands and the handler's body follows the middleware's
+	if resp.StatusCode != http.StatusAccepted || string(body) != "pre handler" {
+		t.Errorf("The headers were written again once committed. Returned: %v %q", resp.StatusCode, body)
+	}
+	if status := <-statuses; status != http.StatusAccepted {
+		t.Errorf("Post middleware was not given the status sent. Status: %v", status)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:9999")
+	if err != nil {
+		t.Fatalf("unable to dial test server \n\n %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(line, "HTTP/1.1 204") {
+		t.Errorf("The hijacked connection was not written to. Read: %q", line)
+	}
+	<-statuses
+}
+
+func TestResponseCapabilities(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := NewResponse(w)
+	if NewResponse(r) != r {
+		t.Errorf("NewResponse wrapped a Response again")
+	}
+	if r.Committed() || r.Status() != 0 {
+		t.Errorf("A new Response was committed")
+	}
+
+	n, err := r.ReadFrom(strings.NewReader("streamed"))
+	if err != nil || n != 8 || r.Size() != 8 || r.Status() != http.StatusOK || w.Body.String() != "streamed" {
+		t.Errorf("ReadFrom did not copy and record the body. Copied: %v %v | Size: %v | Status: %v", n, err, r.Size(), r.Status())
+	}
+
+	r.Flush()
+	if !w.Flushed {
+		t.Errorf("Flush did not flush the underlying writer")
+	}
+
+	// httptest.ResponseRecorder can't be hijacked
+	if _, _, err := r.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Hijack did not fail unsupported. Errored: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"net/http"
 	"os"
 )
@@ -10,35 +11,41 @@ import (
 
 	The http.Server.Shutdown() method provides a
 	graceful shutdown with the release of go 1.8
-	The server is being run on a seperate goroutine
-	while the app is waiting on a exit signal to update
-	the blocking channel. The current context has no timeout
-	and will defer the cancel for any existing child context,
-	after the shutdown returns.
-
-	This handler, handles the request for /shutdown and signals
-	an interrupt or fills the channel
+	The server is being run by a server.App, which
+	waits for an exit signal or a shutdown trigger.
+	The app places its trigger on the base context of
+	every request it serves.
+
+	This handler, handles the request for /admin/shutdown and triggers
+	the app serving it, or interrupts the process when there isn't one
 */
 
+type shutdownKey struct{}
+
+// WithShutdown returns a copy of the context carrying the func
+// that triggers a shutdown of the app serving the request
+func WithShutdown(ctx context.Context, shutdown func()) context.Context {
+	return context.WithValue(ctx, shutdownKey{}, shutdown)
+}
+
 // Shutdown is a handler that when called
-// signals to gracefully shutdown the server, through an interrupt signal channel
+// signals to gracefully shutdown the server serving the request
 func Shutdown(ctx *Context) {
-	// only works in unix, linux and osx environments
-	// on windows, the p.Signal does nothing
-	// will be running in a docker, to unify our environments
-	pid := os.Getpid()
-	p, err := os.FindProcess(pid)
-
-	if err != nil {
-		ctx.String(http.StatusInternalServerError, err.Error())
+	if shutdown, ok := ctx.Request.Context().Value(shutdownKey{}).(func()); ok {
+		// respond before the server starts shutting down
+		defer shutdown()
+		ctx.String(http.StatusOK, "Shutting Down.")
 		return
 	}
 
-	err = p.Signal(os.Interrupt)
+	// only works in unix, linux and osx environments
+	// on windows, the p.Signal does nothing
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(os.Interrupt)
+	}
 
-	if err.Error() == "not supported by windows" {
-		CSignal <- os.Interrupt
-	} else if err != nil {
+	if err != nil {
 		ctx.String(http.StatusInternalServerError, err.Error())
 		return
 	}
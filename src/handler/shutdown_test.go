@@ -1,38 +1,44 @@
 package handler
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
 	"testing"
+	"time"
 )
 
 func TestShutdown(t *testing.T) {
-	/*a := New()
-
-	a.Get("/shutdown", Shutdown)
-
-	server := &http.Server{
-		Addr:    ":9999",
-		Handler: a,
+	a := New()
+	a.Post("/admin/shutdown", Shutdown)
+	server := startTestServer(t, a)
+	defer server.Shutdown(context.Background())
+
+	// catch the interrupt so it doesn't stop the test binary
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+
+	resp, err := http.Get("http://localhost:9999/admin/shutdown")
+	if err != nil {
+		t.Fatalf("TestShutdown errored when making request to test server \n\n %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("TestShutdown did not return a Not Found status for a GET. Returned: %v", resp.StatusCode)
 	}
 
-	go func() {
-		server.ListenAndServe()
-	}()
-
-	go func() {
-		resp, err := http.Get("http://localhost:9999/shutdown")
-
-		if err != nil {
-			t.Errorf("TestShutdown errored when making request to test server \n\n %v", err)
-		}
-
-		if resp.StatusCode != 200 {
-			t.Errorf("TestShutdown did not return an OK status. Returned: %v", resp.StatusCode)
-		}
-	}()
-
-	signal.Notify(CSignal, os.Kill, os.Interrupt)
-	<-CSignal
-	close(CSignal)
-	server.Shutdown(context.Background()) */
+	resp, err = http.Post("http://localhost:9999/admin/shutdown", "", nil)
+	if err != nil {
+		t.Fatalf("TestShutdown errored when making request to test server \n\n %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("TestShutdown did not return an OK status. Returned: %v", resp.StatusCode)
+	}
 
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Errorf("TestShutdown did not signal an interrupt")
+	}
 }
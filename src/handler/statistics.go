@@ -12,6 +12,7 @@ import (
 type Stastic struct {
 	Total   int     `json:"total"`
 	Average float64 `json:"average"`
+	Panics  int64   `json:"panics"`
 }
 
 /*
@@ -37,9 +38,9 @@ func GetStastics(ctx *Context) {
 		average := float64(duration) / float64(total)
 		ms := float64(average / float64(time.Millisecond))
 
-		stat = Stastic{total, ms}
+		stat = Stastic{total, ms, cache.RecoveredPanics.Load()}
 	} else {
-		stat = Stastic{total, 0}
+		stat = Stastic{total, 0, cache.RecoveredPanics.Load()}
 	}
 
 	ctx.JSON(http.StatusOK, stat)
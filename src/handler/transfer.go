@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+	"github.com/caoakleyii/cloud-jumper/src/transfer"
+)
+
+// maxImportBytes is the largest body an import reads, as every record
+// is held until the whole input has been validated
+const maxImportBytes = 64 << 20
+
+// ExportPasswords handler for the GET "/admin/export" endpoint
+// Streams every stored password record as ndjson or csv
+func ExportPasswords(ctx *Context) {
+	format := ctx.Request.URL.Query().Get("format")
+	if format == "" {
+		format = transfer.NDJSON
+	}
+
+	if !transfer.ValidFormat(format) {
+		ctx.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	h := ctx.ResponseWriter.Header()
+	h.Set("Content-Type", transfer.ContentType(format))
+	h.Set("Content-Disposition", "attachment; filename=passwords."+format)
+	ctx.ResponseWriter.WriteHeader(http.StatusOK)
+
+	// the status has been sent, so all we can do is log a failed stream
+	if err := transfer.Export(ctx.ResponseWriter, cache.PasswordStorage, format); err != nil {
+		requestid.Printf(ctx.Request.Context(), "Export failed: %v", err)
+	}
+}
+
+// ImportPasswords handler for the POST "/admin/import" endpoint
+// Reads ndjson or csv password records from the body into the store
+// and responds with a report of what was, or with dry_run would be, changed
+func ImportPasswords(ctx *Context) {
+	if readOnly(ctx) {
+		return
+	}
+
+	q := ctx.Request.URL.Query()
+
+	format := q.Get("format")
+	if format == "" {
+		format = transfer.NDJSON
+	}
+
+	policy := q.Get("conflict")
+	if policy == "" {
+		policy = transfer.Skip
+	}
+
+	dryRun := false
+	if v := q.Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			ctx.String(http.StatusBadRequest, "Bad Request")
+			return
+		}
+	}
+
+	if !transfer.ValidFormat(format) || !transfer.ValidPolicy(policy) {
+		ctx.String(http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	body := http.MaxBytesReader(ctx.ResponseWriter, ctx.Request.Body, maxImportBytes)
+	report, err := transfer.Import(body, cache.PasswordStorage, format, policy, dryRun)
+	if err == transfer.ErrConflict {
+		ctx.JSON(http.StatusConflict, report)
+		return
+	}
+	if err != nil {
+		importFailed(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, report)
+}
+
+// importFailed responds to a failed import, only describing the
+// input's problems, as backend failures are logged instead
+func importFailed(ctx *Context, err error) {
+	var tooLarge *http.MaxBytesError
+	var storeErr *transfer.StoreError
+	switch {
+	case errors.As(err, &tooLarge):
+		ctx.String(http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	case errors.As(err, &storeErr):
+		requestid.Printf(ctx.Request.Context(), "Import failed: %v", err)
+		ctx.String(http.StatusServiceUnavailable, "Service Unavailable")
+	default:
+		ctx.String(http.StatusBadRequest, err.Error())
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/transfer"
+)
+
+// startTestServer listens on the test port before returning,
+// so requests made right away don't race the server starting
+// or reuse a connection to the previous test's server
+func startTestServer(t *testing.T, h http.Handler) *http.Server {
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	l, err := net.Listen("tcp", ":9999")
+	if err != nil {
+		t.Fatalf("unable to listen for the test server \n\n %v", err)
+	}
+
+	server := &http.Server{
+		Addr:    ":9999",
+		Handler: h,
+	}
+	go func() {
+		server.Serve(l)
+	}()
+	return server
+}
+
+func TestExportPasswords(t *testing.T) {
+	a := New()
+	a.Get("/admin/export", ExportPasswords)
+	server := startTestServer(t, a)
+
+	resp, err := http.Get("http://localhost:9999/admin/export?format=csv")
+
+	if err != nil {
+		t.Errorf("TestExportPasswords errored when making request to test server \n\n %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("TestExportPasswords did not return an OK status. Returned: %v", resp.StatusCode)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Errorf("TestExportPasswords error when attempting to read body stream \n\n %v", err)
+	}
+
+	s := string(body[:])
+	if !strings.HasPrefix(s, "id,hash,created_at\n") || !strings.Contains(s, "abc123,") {
+		t.Errorf("TestExportPasswords did not return the csv export. Returned: %v", s)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestImportPasswords(t *testing.T) {
+	a := New()
+	a.Post("/admin/import", ImportPasswords)
+	server := startTestServer(t, a)
+
+	body := `{"id":"abc123","hash":"other"}` + "\n" + `{"id":"import1","hash":"hash"}` + "\n"
+	resp, err := http.Post("http://localhost:9999/admin/import?conflict=fail&dry_run=true", "application/x-ndjson", strings.NewReader(body))
+
+	if err != nil {
+		t.Errorf("TestImportPasswords errored when making request to test server \n\n %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 409 {
+		t.Errorf("TestImportPasswords did not return a CONFLICT status. Returned: %v", resp.StatusCode)
+	}
+
+	var report transfer.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Errorf("TestImportPasswords error when decoding the report \n\n %v", err)
+	}
+
+	if report.Total != 2 || len(report.Conflicts) != 1 || report.Conflicts[0] != "abc123" {
+		t.Errorf("TestImportPasswords did not report the conflict. Returned: %+v", report)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// failingStorage refuses every write
+type failingStorage struct {
+	*cache.Store
+}
+
+func (failingStorage) Put(cache.Record) error {
+	return errors.New("disk on fire")
+}
+
+func TestImportPasswordsErrors(t *testing.T) {
+	a := New()
+	a.Post("/admin/import", ImportPasswords)
+	server := startTestServer(t, a)
+	defer server.Shutdown(context.Background())
+
+	defer func(s cache.Storage) { cache.PasswordStorage = s }(cache.PasswordStorage)
+	cache.PasswordStorage = failingStorage{cache.NewStore()}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"id":"import1"}`, http.StatusBadRequest},
+		{`{"id":"import1","hash":"hash"}`, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		resp, err := http.Post("http://localhost:9999/admin/import", "application/x-ndjson", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("TestImportPasswordsErrors errored when making request to test server \n\n %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || strings.Contains(string(body), "disk on fire") {
+			t.Errorf("%v: Import responded %v %q, expected %v without the backend's error", test.body, resp.StatusCode, body, test.status)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package hasher
+
+import (
+	"sync"
+	"time"
+)
+
+// Policy configures how passwords are hashed and stored
+type Policy struct {
+	// SaltLength is the number of random bytes salting each hash
+	SaltLength int
+	// IDLength is the number of random bytes in a password id
+	IDLength int
+	// StoreDelay is how long after responding a hashed password is stored
+	StoreDelay time.Duration
+}
+
+// DefaultPolicy is the policy used until another is set
+var DefaultPolicy = Policy{SaltLength: 32, IDLength: 8, StoreDelay: 5 * time.Second}
+
+var (
+	policyMu sync.RWMutex
+	policy   = DefaultPolicy
+)
+
+// SetPolicy replaces the policy used for passwords hashed from now on
+func SetPolicy(p Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = p
+}
+
+// CurrentPolicy returns the policy passwords are hashed with
+func CurrentPolicy() Policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policy
+}
@@ -0,0 +1,154 @@
+/*
+Package health implements a registry of liveness and readiness checks.
+
+	Liveness checks report whether the process is working at all and should
+	be restarted if not. Readiness checks report whether it should be sent
+	traffic, so they also fail while draining or when a dependency is down.
+	Subsystems register their own checks, each run with a timeout.
+*/
+package health
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds checks registered without a timeout
+const DefaultTimeout = time.Second
+
+// Check statuses
+const (
+	OK     = "ok"
+	Failed = "failed"
+)
+
+// Check is a named func reporting an error when unhealthy
+type Check struct {
+	Name    string
+	Timeout time.Duration
+	Fn      func(context.Context) error
+}
+
+// Result is the outcome of running a check
+type Result struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// Report is the outcome of running every check of a kind
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Healthy reports whether every check passed
+func (r Report) Healthy() bool {
+	return r.Status == OK
+}
+
+// Registry holds the liveness and readiness checks
+type Registry struct {
+	mu    sync.RWMutex
+	live  []Check
+	ready []Check
+}
+
+// Default is the registry the server's checks are registered with
+var Default = NewRegistry()
+
+// NewRegistry returns a new reference to a Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Live registers a liveness check
+func (r *Registry) Live(c Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.live = append(r.live, c)
+}
+
+// Ready registers a readiness check
+func (r *Registry) Ready(c Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = append(r.ready, c)
+}
+
+// Liveness runs the liveness checks
+func (r *Registry) Liveness(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := append([]Check(nil), r.live...)
+	r.mu.RUnlock()
+	return run(ctx, checks)
+}
+
+// Readiness runs the readiness checks
+func (r *Registry) Readiness(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := append([]Check(nil), r.ready...)
+	r.mu.RUnlock()
+	return run(ctx, checks)
+}
+
+// run runs the checks concurrently, each bounded by its timeout
+func run(ctx context.Context, checks []Check) Report {
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := Report{Status: OK, Checks: results}
+	for _, res := range results {
+		if res.Status != OK {
+			report.Status = Failed
+		}
+	}
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+	return report
+}
+
+func runCheck(ctx context.Context, c Check) Result {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		done <- c.Fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+
+	res := Result{Name: c.Name, Status: OK, Latency: time.Since(start).String()}
+	if err != nil {
+		res.Status = Failed
+		res.Error = err.Error()
+	}
+	return res
+}
@@ -0,0 +1,49 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	r := NewRegistry()
+	r.Ready(Check{Name: "ok", Fn: func(context.Context) error { return nil }})
+
+	if report := r.Readiness(context.Background()); !report.Healthy() || len(report.Checks) != 1 {
+		t.Errorf("Readiness did not pass with a passing check. Report: %+v", report)
+	}
+	if report := r.Liveness(context.Background()); !report.Healthy() || len(report.Checks) != 0 {
+		t.Errorf("Liveness ran a readiness check. Report: %+v", report)
+	}
+
+	r.Ready(Check{Name: "broken", Fn: func(context.Context) error { return errors.New("broken") }})
+	report := r.Readiness(context.Background())
+	if report.Healthy() {
+		t.Errorf("Readiness passed with a failing check. Report: %+v", report)
+	}
+	if c := report.Checks[0]; c.Name != "broken" || c.Status != Failed || c.Error != "broken" || c.Latency == "" {
+		t.Errorf("Readiness did not report the failing check. Result: %+v", c)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	r := NewRegistry()
+	r.Live(Check{Name: "slow", Timeout: 20 * time.Millisecond, Fn: func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+	r.Live(Check{Name: "panics", Fn: func(context.Context) error { panic("oops") }})
+
+	start := time.Now()
+	report := r.Liveness(context.Background())
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Liveness waited on a check past its timeout. Took: %v", d)
+	}
+	for _, c := range report.Checks {
+		if c.Status != Failed {
+			t.Errorf("Liveness did not fail the %v check. Result: %+v", c.Name, c)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Package jobs runs the delayed background writes of hashed passwords.
+
+	Every job is tracked from the moment it is submitted, so a shutdown can
+	stop accepting new jobs and wait for the pending ones. Jobs still pending
+	when the shutdown deadline passes are flushed to a file, from where they
+	can be imported, or reported as lost.
+*/
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// ErrClosed is returned when submitting a job to a queue that is shutting down
+var ErrClosed = errors.New("jobs: queue is shutting down")
+
+// ErrPending is returned when submitting a job for a record whose id already has one pending
+var ErrPending = errors.New("jobs: a job for the id is already pending")
+
+// Summary reports what happened to the jobs pending at shutdown
+type Summary struct {
+	Pending   int      `json:"pending"`
+	Completed int      `json:"completed"`
+	Failed    int      `json:"failed"`
+	Flushed   int      `json:"flushed"`
+	Lost      int      `json:"lost"`
+	LostIDs   []string `json:"lost_ids"`
+}
+
+type job struct {
+	record  cache.Record
+	storage cache.Storage
+	// ctx carries the id of the request that submitted the job
+	ctx context.Context
+}
+
+// Queue runs jobs storing records after a delay
+type Queue struct {
+	// FlushFile is the file records of jobs still pending at the shutdown
+	// deadline are appended to as ndjson, if empty they are lost
+	FlushFile string
+
+	mu      sync.Mutex
+	pending map[string]job
+	closed  bool
+	failed  int
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Default is the queue password hashing jobs are submitted to
+var Default = NewQueue()
+
+// NewQueue returns a new reference to a Queue
+func NewQueue() *Queue {
+	return &Queue{pending: make(map[string]job), stop: make(chan struct{})}
+}
+
+// Submit stores the record in s once the delay passes. The job outlives the context,
+// only the request id it carries is kept for the job's log lines, but isn't submitted
+// when the context is already done, its request having been given up on
+func (q *Queue) Submit(ctx context.Context, r cache.Record, s cache.Storage, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if _, ok := q.pending[r.ID]; ok {
+		return ErrPending
+	}
+
+	q.pending[r.ID] = job{r, s, requestid.With(context.Background(), requestid.From(ctx))}
+	q.wg.Add(1)
+	go q.run(r.ID, delay)
+	return nil
+}
+
+// Open accepts jobs again once a Shutdown has returned, forgetting
+// the jobs it reported so the next Shutdown only summarises new ones
+func (q *Queue) Open() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		return
+	}
+	q.closed = false
+	q.failed = 0
+	q.pending = make(map[string]job)
+	q.stop = make(chan struct{})
+}
+
+// Len returns the number of pending jobs
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Pending reports whether a job storing the record with the id is pending
+func (q *Queue) Pending(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.pending[id]
+	return ok
+}
+
+// Closed reports whether the queue has stopped accepting jobs
+func (q *Queue) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+func (q *Queue) run(id string, delay time.Duration) {
+	defer q.wg.Done()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-q.stop:
+		// abandoned at the shutdown deadline, the job stays pending to be flushed
+		return
+	}
+
+	q.mu.Lock()
+	j, ok := q.pending[id]
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	err := j.storage.Put(j.record)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, id)
+	if err != nil {
+		q.failed++
+		requestid.Printf(j.ctx, "Storing password %v failed: %v", id, err)
+	}
+}
+
+// Shutdown stops accepting jobs and waits for the pending ones until the context is done,
+// then flushes any still pending to the flush file
+func (q *Queue) Shutdown(ctx context.Context) Summary {
+	q.mu.Lock()
+	q.closed = true
+	s := Summary{Pending: len(q.pending), LostIDs: []string{}}
+	failed := q.failed
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(q.stop)
+		<-done
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s.Failed = q.failed - failed
+	remaining := make([]cache.Record, 0, len(q.pending))
+	for _, j := range q.pending {
+		remaining = append(remaining, j.record)
+	}
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].ID < remaining[j].ID })
+	s.Completed = s.Pending - s.Failed - len(remaining)
+
+	if len(remaining) > 0 && q.FlushFile != "" {
+		if err := flush(q.FlushFile, remaining); err != nil {
+			log.Printf("Flushing pending jobs to %v failed: %v", q.FlushFile, err)
+		} else {
+			s.Flushed = len(remaining)
+			remaining = nil
+		}
+	}
+
+	for _, r := range remaining {
+		s.Lost++
+		s.LostIDs = append(s.LostIDs, r.ID)
+	}
+	return s
+}
+
+// flush appends the records to the file as ndjson
+func flush(file string, records []cache.Record) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,141 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+)
+
+func TestShutdownWaits(t *testing.T) {
+	q := NewQueue()
+	s := cache.NewStore()
+
+	for _, id := range []string{"a", "b"} {
+		if err := q.Submit(context.Background(), cache.Record{ID: id, Hash: "hash"}, s, 50*time.Millisecond); err != nil {
+			t.Fatalf("Submit errored \n\n %v", err)
+		}
+	}
+	if q.Len() != 2 {
+		t.Errorf("Queue did not track the pending jobs. Len: %v", q.Len())
+	}
+
+	summary := q.Shutdown(context.Background())
+	if summary.Pending != 2 || summary.Completed != 2 || summary.Lost != 0 {
+		t.Errorf("Shutdown did not wait for the pending jobs. Summary: %+v", summary)
+	}
+	if _, ok := s.Get("b"); !ok {
+		t.Errorf("Shutdown returned before the jobs stored their records")
+	}
+
+	if err := q.Submit(context.Background(), cache.Record{ID: "c"}, s, 0); err != ErrClosed {
+		t.Errorf("Submit accepted a job after shutdown. Returned: %v", err)
+	}
+}
+
+func TestSubmitCancelled(t *testing.T) {
+	q := NewQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := q.Submit(ctx, cache.Record{ID: "a"}, cache.NewStore(), 0); err != context.Canceled {
+		t.Errorf("Submit accepted the job of a request given up on. Returned: %v", err)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("The job was left pending. Pending: %v", n)
+	}
+}
+
+func TestSubmitPending(t *testing.T) {
+	q := NewQueue()
+	s := cache.NewStore()
+	q.Submit(context.Background(), cache.Record{ID: "a", Hash: "first"}, s, 20*time.Millisecond)
+
+	if !q.Pending("a") {
+		t.Errorf("Pending did not report the submitted job")
+	}
+	if err := q.Submit(context.Background(), cache.Record{ID: "a", Hash: "second"}, s, 0); err != ErrPending {
+		t.Errorf("Submit accepted a second job for a pending id. Returned: %v", err)
+	}
+
+	summary := q.Shutdown(context.Background())
+	if r, _ := s.Get("a"); r.Hash != "first" || summary.Completed != 1 || summary.Failed != 0 {
+		t.Errorf("The pending job was replaced. Stored: %+v Summary: %+v", r, summary)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	q := NewQueue()
+	s := cache.NewStore()
+	q.Submit(context.Background(), cache.Record{ID: "fast", Hash: "hash"}, s, 0)
+	q.Submit(context.Background(), cache.Record{ID: "slow", Hash: "hash"}, s, time.Hour)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	summary := q.Shutdown(ctx)
+
+	if summary.Completed != 0 || summary.Lost != 1 || len(summary.LostIDs) != 1 || summary.LostIDs[0] != "slow" {
+		t.Errorf("Shutdown did not report the job pending at the deadline as lost. Summary: %+v", summary)
+	}
+	if _, ok := s.Get("slow"); ok {
+		t.Errorf("Job stored its record after the shutdown deadline")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	q := NewQueue()
+	s := cache.NewStore()
+	q.Submit(context.Background(), cache.Record{ID: "lost", Hash: "hash"}, s, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Shutdown(ctx)
+
+	q.Open()
+	if q.Closed() {
+		t.Errorf("Open did not accept jobs again")
+	}
+	if err := q.Submit(context.Background(), cache.Record{ID: "a", Hash: "hash"}, s, 0); err != nil {
+		t.Fatalf("Submit errored after Open \n\n %v", err)
+	}
+	summary := q.Shutdown(context.Background())
+	if summary.Pending != 1 || summary.Completed != 1 || summary.Lost != 0 {
+		t.Errorf("Shutdown summarised jobs of the earlier shutdown. Summary: %+v", summary)
+	}
+}
+
+func TestShutdownFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatalf("unable to create a temp directory \n\n %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := NewQueue()
+	q.FlushFile = filepath.Join(dir, "pending.ndjson")
+	q.Submit(context.Background(), cache.Record{ID: "slow", Hash: "hash"}, cache.NewStore(), time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if summary := q.Shutdown(ctx); summary.Flushed != 1 || summary.Lost != 0 {
+		t.Errorf("Shutdown did not flush the pending job. Summary: %+v", summary)
+	}
+
+	f, err := os.Open(q.FlushFile)
+	if err != nil {
+		t.Fatalf("unable to open the flush file \n\n %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	var r cache.Record
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &r) != nil || r.ID != "slow" || r.Hash != "hash" {
+		t.Errorf("Flush file does not hold the pending record. Line: %v", scanner.Text())
+	}
+}
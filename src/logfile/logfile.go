@@ -0,0 +1,124 @@
+/*
+Package logfile writes logs to a file rotated by size.
+
+	Once a write would take the file past its maximum size, the file is renamed
+	with the suffix .1, older files shift up to .2, .3 and so on, and writing
+	continues in a new file. Only the configured number of old files are kept.
+*/
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File is an io.WriteCloser appending to a file that is rotated by size
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens the file for appending. It's rotated once it would grow past maxSize
+// bytes, keeping maxBackups old files, or never when maxSize is zero
+func Open(path string, maxSize int64, maxBackups int) (*File, error) {
+	f := &File{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+// Write implements the io.Writer interface, rotating the file first
+// when the write would take it past its maximum size
+func (f *File) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	var rotateErr error
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			rotateErr = fmt.Errorf("rotating %v: %w", f.path, err)
+			// without a file there's nowhere to write
+			if f.f == nil {
+				return 0, rotateErr
+			}
+		}
+	}
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts the old files up a suffix, dropping the oldest, and moves
+// writing to a new file. Whether or not the files could be shifted, writing
+// carries on in the file at the path
+func (f *File) rotate() error {
+	closeErr := f.f.Close()
+	f.f = nil
+	err := errors.Join(closeErr, f.shift())
+	if openErr := f.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift renames the file and its backups up a suffix, or removes it without backups
+func (f *File) shift() error {
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(backup(f.path, i), backup(f.path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(f.path, backup(f.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func backup(path string, i int) string {
+	return fmt.Sprintf("%v.%v", path, i)
+}
+
+// Close implements the io.Closer interface
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
@@ -0,0 +1,85 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := Open(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Open errored \n\n %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write errored \n\n %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range expected {
+		b, err := os.ReadFile(file)
+		if err != nil || string(b) != content {
+			t.Errorf("%v was not rotated. Expected: %q | Read: %q %v", filepath.Base(file), content, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("More than the maximum backups were kept")
+	}
+}
+
+func TestOpenAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	os.WriteFile(path, []byte("existing\n"), 0640)
+
+	f, err := Open(path, 20, 1)
+	if err != nil {
+		t.Fatalf("Open errored \n\n %v", err)
+	}
+	f.Write([]byte("appended\n"))
+	// the size of the existing file counts towards the maximum
+	f.Write([]byte("rotated\n"))
+	f.Close()
+
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "existing\nappended\n" {
+		t.Errorf("Open did not append to the existing file. Read: %q", b)
+	}
+	if b, _ := os.ReadFile(path); !strings.HasPrefix(string(b), "rotated") {
+		t.Errorf("The file was not rotated once full. Read: %q", b)
+	}
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Errorf("Write did not error once closed")
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// a non empty directory can't be replaced by the rotated file
+	os.MkdirAll(filepath.Join(path+".1", "taken"), 0750)
+
+	f, err := Open(path, 10, 1)
+	if err != nil {
+		t.Fatalf("Open errored \n\n %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("first\n"))
+	if _, err := f.Write([]byte("second\n")); err == nil {
+		t.Errorf("Write did not report the failed rotation")
+	}
+	if _, err := f.Write([]byte("third\n")); err != nil && !strings.Contains(err.Error(), "rotating") {
+		t.Errorf("Writes failed after the rotation did \n\n %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "first\nsecond\nthird\n" {
+		t.Errorf("Writing did not carry on in the file. Read: %q", b)
+	}
+}
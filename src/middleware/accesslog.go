@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+	"github.com/caoakleyii/cloud-jumper/src/proxy"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// Access log formats
+const (
+	JSON = "json"
+	Text = "text"
+	// Common is the Common Log Format
+	Common = "common"
+	// Combined is the Combined Log Format, adding the referer and user agent to Common
+	Combined = "combined"
+)
+
+// AccessLogConfig configures the access log
+type AccessLogConfig struct {
+	// Format is json, text, common or combined
+	Format string
+	// Sample is the fraction of requests logged, between 0 and 1.
+	// Requests failing with a server error are always logged
+	Sample float64
+	// Exclude are paths whose requests aren't logged, e.g. /health
+	Exclude []string
+}
+
+// AccessLog wraps a handler, logging every request it serves to w with its method,
+// path, route, status, size, latency, client ip and request id. The client ip is
+// resolved through trusted proxies and the request id given by RequestID wrapping AccessLog
+func AccessLog(next http.Handler, w io.Writer, cfg AccessLogConfig) (http.Handler, error) {
+	var h slog.Handler
+	switch cfg.Format {
+	case JSON:
+		h = slog.NewJSONHandler(w, nil)
+	case Text:
+		h = slog.NewTextHandler(w, nil)
+	case Common, Combined:
+		h = &clfHandler{w: w, combined: cfg.Format == Combined}
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+
+	// paths are compared as routes match them, whatever their case or trailing slash
+	exclude := make(map[string]bool, len(cfg.Exclude))
+	for _, path := range cfg.Exclude {
+		exclude[pathrule.Clean(path)] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exclude[pathrule.Clean(r.URL.Path)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		ctx, route := handler.TrackRoute(r.Context())
+		rec := handler.NewResponse(w)
+		defer func() {
+			status := rec.Status()
+			v := recover()
+			if v != nil && status == 0 {
+				status = http.StatusInternalServerError
+			}
+
+			if status < http.StatusInternalServerError && cfg.Sample < 1 && rand.Float64() >= cfg.Sample {
+				if v != nil {
+					panic(v)
+				}
+				return
+			}
+
+			entry := slog.NewRecord(start, slog.LevelInfo, "access", 0)
+			entry.AddAttrs(
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("route", route()),
+				slog.String("proto", r.Proto),
+				slog.Int("status", status),
+				slog.Int64("bytes", rec.Size()),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("client_ip", proxy.RealIP(r)),
+				slog.String("request_id", requestid.From(r.Context())),
+				slog.String("referer", r.Referer()),
+				slog.String("user_agent", r.UserAgent()),
+			)
+			h.Handle(r.Context(), entry)
+
+			if v != nil {
+				panic(v)
+			}
+		}()
+
+		next.ServeHTTP(rec, r.WithContext(ctx))
+	}), nil
+}
+
+// clfHandler is a slog.Handler writing access log records in the Common or Combined Log Format
+type clfHandler struct {
+	mu       sync.Mutex
+	w        io.Writer
+	combined bool
+}
+
+func (h *clfHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *clfHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *clfHandler) WithGroup(string) slog.Handler            { return h }
+
+// Handle implements the slog.Handler interface, e.g.
+// 192.0.2.1 - - [19/Oct/2026:10:00:00 +0000] "GET /hash/abc HTTP/1.1" 200 88
+func (h *clfHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make(map[string]string)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+
+	size := attrs["bytes"]
+	if size == "0" {
+		size = "-"
+	}
+	line := fmt.Sprintf("%v - - [%v] %v %v %v", dash(attrs["client_ip"]), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(attrs["method"]+" "+attrs["path"]+" "+attrs["proto"]), attrs["status"], size)
+	if h.combined {
+		line += fmt.Sprintf(" %v %v", strconv.Quote(dash(attrs["referer"])), strconv.Quote(dash(attrs["user_agent"])))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+// dash returns - in place of an empty value
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+)
+
+// logBuffer is a bytes.Buffer safe to write from the server while the test reads it
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+// serveLogged serves the test routes logged to the buffer, returning the base url
+func serveLogged(t *testing.T, cfg AccessLogConfig) (string, *logBuffer) {
+	h := handler.New()
+	h.Get("/health", handler.GetHealth)
+	h.Get("/hash/:id", func(ctx *handler.Context) {
+		ctx.String(http.StatusOK, "hash of "+ctx.Param("id"))
+	})
+	h.Get("/fail", func(ctx *handler.Context) {
+		panic("fail")
+	})
+
+	var buf logBuffer
+	logged, err := AccessLog(Recover(h), &buf, cfg)
+	if err != nil {
+		t.Fatalf("AccessLog errored \n\n %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen \n\n %v", err)
+	}
+	s := &http.Server{Handler: RequestID(logged)}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return "http://" + l.Addr().String(), &buf
+}
+
+func get(t *testing.T, url string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	req.Header.Set("User-Agent", "test-agent")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to get %v \n\n %v", url, err)
+	}
+	resp.Body.Close()
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	base, buf := serveLogged(t, AccessLogConfig{Format: JSON, Sample: 1, Exclude: []string{"/health"}})
+	// excluded paths match whatever their case or trailing slash, as routes do
+	get(t, base+"/health")
+	get(t, base+"/HEALTH")
+	get(t, base+"/health/")
+	get(t, base+"/hash/abc")
+	get(t, base+"/fail")
+
+	lines := buf.lines()
+	if len(lines) != 2 {
+		t.Fatalf("AccessLog did not log every request but the excluded. Logged: %v", lines)
+	}
+
+	var entry struct {
+		Method    string  `json:"method"`
+		Path      string  `json:"path"`
+		Route     string  `json:"route"`
+		Status    int     `json:"status"`
+		Bytes     int     `json:"bytes"`
+		Latency   float64 `json:"latency_ms"`
+		ClientIP  string  `json:"client_ip"`
+		RequestID string  `json:"request_id"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("AccessLog did not log json \n\n %v", err)
+	}
+	if entry.Method != "GET" || entry.Path != "/hash/abc" || entry.Route != "/hash/:id" || entry.Status != 200 ||
+		entry.Bytes != len("hash of abc") || entry.ClientIP != "127.0.0.1" || entry.RequestID != "req-1" {
+		t.Errorf("AccessLog did not log the request. Logged: %v", lines[0])
+	}
+
+	// the panic is logged with the status recovered
+	if !strings.Contains(lines[1], `"status":500`) {
+		t.Errorf("AccessLog did not log the recovered panic. Logged: %v", lines[1])
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	base, buf := serveLogged(t, AccessLogConfig{Format: Combined, Sample: 1})
+	get(t, base+"/hash/abc")
+
+	clf := regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /hash/abc HTTP/1\.1" 200 11 "-" "test-agent"$`)
+	if line := buf.lines()[0]; !clf.MatchString(line) {
+		t.Errorf("AccessLog did not log in the Combined Log Format. Logged: %v", line)
+	}
+}
+
+func TestAccessLogSample(t *testing.T) {
+	base, buf := serveLogged(t, AccessLogConfig{Format: Text, Sample: 0})
+	get(t, base+"/hash/abc")
+	get(t, base+"/fail")
+
+	// server errors are logged whatever the sample
+	lines := buf.lines()
+	if len(lines) != 1 || !strings.Contains(lines[0], "status=500") {
+		t.Errorf("AccessLog did not only log the server error. Logged: %v", lines)
+	}
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content codings responses are compressed with, gzip preferred when a client accepts both equally
+const (
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// CompressConfig configures compressing responses
+type CompressConfig struct {
+	// Level is the compression level, from 1 for the fastest to 9 for the smallest,
+	// 0 for none or -1 for the default
+	Level int
+	// MinSize is the fewest bytes of body compressed, smaller bodies aren't worth it.
+	// Responses flushed before reaching it are compressed as they're streams
+	MinSize int
+	// Types are the media types compressed, e.g. application/json, or text/* for every text type
+	Types []string
+}
+
+// encoder is a pooled gzip or zlib writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressor holds the config and writer pools of a Compress middleware
+type compressor struct {
+	cfg   CompressConfig
+	pools map[string]*sync.Pool
+}
+
+// Compress wraps a handler, compressing the responses of clients accepting gzip or deflate
+// when they're of an allowed type and at least the minimum size. Every response of an
+// allowed type varies by Accept-Encoding, responses already encoded or marked no-transform
+// are left as they are
+func Compress(next http.Handler, cfg CompressConfig) (http.Handler, error) {
+	if cfg.Level < gzip.DefaultCompression || cfg.Level > gzip.BestCompression {
+		return nil, fmt.Errorf("compression level must be between -1 and 9, got %v", cfg.Level)
+	}
+	types := make([]string, len(cfg.Types))
+	for i, t := range cfg.Types {
+		types[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	cfg.Types = types
+
+	c := &compressor{cfg: cfg, pools: map[string]*sync.Pool{
+		Gzip: {New: func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, cfg.Level)
+			return w
+		}},
+		Deflate: {New: func() interface{} {
+			w, _ := zlib.NewWriterLevel(nil, cfg.Level)
+			return w
+		}},
+	}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, c: c, head: r.Method == http.MethodHead, encoding: negotiate(r.Header.Get("Accept-Encoding"))}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	}), nil
+}
+
+// negotiate returns the coding of the Accept-Encoding header with the highest
+// quality, gzip or deflate, or an empty string when neither is acceptable
+func negotiate(accept string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = Gzip
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(param, "="); ok && strings.TrimSpace(strings.ToLower(k)) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding != "" {
+			qualities[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{Gzip, Deflate} {
+		q, ok := qualities[coding]
+		if !ok {
+			// the wildcard stands for every coding not listed
+			if q, ok = qualities["*"]; !ok {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// allowed returns whether responses of the content type are compressed
+func (c *compressor) allowed(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, t := range c.cfg.Types {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds back the start of the body until it knows whether to
+// compress it: once the minimum size is written, the response is flushed
+// or the handler returns
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	head     bool
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	// enc is set while compressing
+	enc encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// informational responses precede the final one
+	if status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.c.cfg.MinSize {
+			return len(b), nil
+		}
+		return len(b), cw.decide(false)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressing the response when the client accepts it,
+// it's of an allowed type and long enough or a stream being flushed
+func (cw *compressWriter) decide(flushing bool) error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	// net/http would sniff the compressed body
+	if _, ok := h["Content-Type"]; !ok && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if cw.c.allowed(h.Get("Content-Type")) {
+		if !strings.Contains(strings.ToLower(strings.Join(h.Values("Vary"), ",")), "accept-encoding") {
+			h.Add("Vary", "Accept-Encoding")
+		}
+		if cw.compressible(flushing) {
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+			cw.enc = cw.c.pools[cw.encoding].Get().(encoder)
+			cw.enc.Reset(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// compressible returns whether a response of an allowed type is compressed
+func (cw *compressWriter) compressible(flushing bool) bool {
+	h := cw.Header()
+	if cw.encoding == "" || h.Get("Content-Encoding") != "" || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if cw.status < 200 || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	if flushing || len(cw.buf) >= cw.c.cfg.MinSize {
+		return true
+	}
+	// a HEAD response has the headers of the GET response, whose size it may give
+	if n, err := strconv.Atoi(h.Get("Content-Length")); cw.head && err == nil {
+		return n >= cw.c.cfg.MinSize
+	}
+	return false
+}
+
+// Flush lets streaming routes flush through the compression,
+// compressing the stream whatever has been written so far
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection to the handler, uncompressed
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(cw.ResponseWriter).Hijack()
+	if err == nil {
+		cw.decided = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets an http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish sends whatever the handler left held back and ends the compressed stream
+func (cw *compressWriter) finish() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		// don't hold on to the response while pooled
+		cw.enc.Reset(io.Discard)
+		cw.c.pools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                           "",
+		"gzip":                       Gzip,
+		"deflate, gzip":              Gzip,
+		"gzip;q=0.5, deflate":        Deflate,
+		"GZIP; q=1.0, deflate;q=0.9": Gzip,
+		"gzip;q=0, deflate;q=0":      "",
+		"br, *;q=0.1":                Gzip,
+		"*;q=0.5, gzip;q=0":          Deflate,
+		"identity":                   "",
+		"x-gzip":                     Gzip,
+	}
+	for accept, expected := range tests {
+		if coding := negotiate(accept); coding != expected {
+			t.Errorf("%q: negotiate returned %q, expected %q", accept, coding, expected)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	big := strings.Repeat(`{"id":"abc","hash":"hashed"}`, 100)
+	flushed, finish := make(chan bool), make(chan bool)
+	h := handler.New()
+	h.Get("/big", func(ctx *handler.Context) {
+		ctx.String(http.StatusOK, big)
+	})
+	h.Get("/small", func(ctx *handler.Context) {
+		ctx.JSON(http.StatusOK, map[string]string{"id": "abc"})
+	})
+	h.Get("/image", func(ctx *handler.Context) {
+		ctx.ResponseWriter.Header().Set("Content-Type", "image/png")
+		ctx.ResponseWriter.Write([]byte(big))
+	})
+	h.Get("/encoded", func(ctx *handler.Context) {
+		ctx.ResponseWriter.Header().Set("Content-Encoding", "br")
+		ctx.String(http.StatusOK, big)
+	})
+	h.Get("/stream", func(ctx *handler.Context) {
+		ctx.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+		ctx.ResponseWriter.Write([]byte("first\n"))
+		ctx.ResponseWriter.(http.Flusher).Flush()
+		flushed <- true
+		<-finish
+		ctx.ResponseWriter.Write([]byte("second\n"))
+	})
+	// the router has no HEAD routes
+	routes := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/head" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(big)))
+		if r.Method != http.MethodHead {
+			w.Write([]byte(big))
+		}
+	})
+	compress, err := Compress(routes, CompressConfig{Level: -1, MinSize: 1024, Types: []string{"application/json", "application/x-ndjson", "Text/*"}})
+	if err != nil {
+		t.Fatalf("Compress errored \n\n %v", err)
+	}
+	base := serve(t, compress)
+	// see the responses as sent, rather than decompressed by the transport
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	get := func(method, path, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, base+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v: unable to get \n\n %v", path, err)
+		}
+		defer resp.Body.Close()
+		if method == http.MethodHead {
+			return resp, ""
+		}
+
+		var body io.Reader = resp.Body
+		switch resp.Header.Get("Content-Encoding") {
+		case Gzip:
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("%v: the body is not gzipped \n\n %v", path, err)
+			}
+		case Deflate:
+			if body, err = zlib.NewReader(resp.Body); err != nil {
+				t.Fatalf("%v: the body is not deflated \n\n %v", path, err)
+			}
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%v: unable to read the body \n\n %v", path, err)
+		}
+		return resp, string(b)
+	}
+
+	tests := []struct {
+		path, accept, encoding, vary string
+	}{
+		{"/big", "gzip", Gzip, "Accept-Encoding"},
+		{"/big", "gzip;q=0.1, deflate", Deflate, "Accept-Encoding"},
+		{"/big", "", "", "Accept-Encoding"},
+		{"/small", "gzip", "", "Accept-Encoding"},
+		{"/image", "gzip", "", ""},
+		{"/encoded", "gzip", "br", "Accept-Encoding"},
+	}
+	for _, test := range tests {
+		resp, body := get(http.MethodGet, test.path, test.accept)
+		if enc := resp.Header.Get("Content-Encoding"); enc != test.encoding {
+			t.Errorf("%v %q: Content-Encoding was %q, expected %q", test.path, test.accept, enc, test.encoding)
+		}
+		if vary := resp.Header.Get("Vary"); vary != test.vary {
+			t.Errorf("%v %q: Vary was %q, expected %q", test.path, test.accept, vary, test.vary)
+		}
+		if test.encoding == Gzip || test.encoding == Deflate {
+			if body != big {
+				t.Errorf("%v %q: the body was not compressed whole. Read: %q", test.path, test.accept, body)
+			}
+			if resp.Header.Get("Content-Length") == strconv.Itoa(len(big)) {
+				t.Errorf("%v %q: the uncompressed Content-Length was sent", test.path, test.accept)
+			}
+		}
+	}
+
+	// a HEAD response has the headers of the GET response
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp, _ := get(method, "/head", "gzip")
+		if resp.Header.Get("Content-Encoding") != Gzip {
+			t.Errorf("%v: the response was not compressed. Headers: %v", method, resp.Header)
+		}
+	}
+
+	// a stream is compressed as it's flushed
+	req, _ := http.NewRequest(http.MethodGet, base+"/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unable to get /stream \n\n %v", err)
+	}
+	defer resp.Body.Close()
+	<-flushed
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("the stream is not gzipped \n\n %v", err)
+	}
+	lines := bufio.NewReader(zr)
+	if line, _ := lines.ReadString('\n'); line != "first\n" {
+		t.Errorf("The flushed line was not sent. Read: %q", line)
+	}
+	finish <- true
+	if rest, _ := io.ReadAll(lines); string(rest) != "second\n" {
+		t.Errorf("The stream was not ended. Read: %q", rest)
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/caoakleyii/cloud-jumper/src/concurrency"
+)
+
+// Concurrency wraps a handler, serving no more requests at once than the limiter
+// allows. Requests it sheds get a 503 Service Unavailable to retry in a second
+func Concurrency(next http.Handler, l *concurrency.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := l.Acquire(r)
+		if err != nil {
+			// a cancelled client is gone, there's no one to respond to
+			if err != concurrency.ErrShed {
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain;charsetUTF8")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Service Unavailable"))
+			return
+		}
+		s := &slot{release: release, holders: 1}
+		defer s.drop()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), slotKey{}, s)))
+	})
+}
+
+type slotKey struct{}
+
+// slot is the request's place under the concurrency limit, released once
+// every holder has dropped it, as a handler Timeout gave up on may outlive
+// the request
+type slot struct {
+	mu      sync.Mutex
+	release func()
+	holders int
+}
+
+func (s *slot) drop() {
+	s.mu.Lock()
+	s.holders--
+	last := s.holders == 0
+	s.mu.Unlock()
+	if last {
+		s.release()
+	}
+}
+
+// holdSlot keeps the request's slot until the func returned is called
+func holdSlot(ctx context.Context) func() {
+	s, ok := ctx.Value(slotKey{}).(*slot)
+	if !ok {
+		return func() {}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holders++
+	return s.drop
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/concurrency"
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+)
+
+func TestConcurrency(t *testing.T) {
+	l, err := concurrency.New(concurrency.Config{Rules: []string{"POST /hash=1"}, Priority: []string{"/health"}})
+	if err != nil {
+		t.Fatalf("concurrency.New errored \n\n %v", err)
+	}
+	started, finish := make(chan bool), make(chan bool)
+	h := handler.New()
+	h.Post("/hash", func(ctx *handler.Context) {
+		started <- true
+		<-finish
+		ctx.String(http.StatusOK, "hashed")
+	})
+	h.Post("/health", handler.GetHealth)
+	base := serve(t, Concurrency(h, l))
+
+	first := make(chan int)
+	go func() {
+		resp, err := http.Post(base+"/hash", "application/x-www-form-urlencoded", nil)
+		if err != nil {
+			first <- 0
+			return
+		}
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	<-started
+
+	resp, err := http.Post(base+"/hash", "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("unable to post /hash \n\n %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Concurrency did not shed the request over the limit. Returned: %v %q", resp.StatusCode, body)
+	}
+
+	// priority routes are served while the limit is reached
+	resp, err = http.Post(base+"/health", "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("unable to post /health \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Concurrency held back a priority route. Returned: %v", resp.StatusCode)
+	}
+
+	finish <- true
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("The request within the limit was not served. Returned: %v", status)
+	}
+}
+
+func TestConcurrencyTimedOut(t *testing.T) {
+	l, _ := concurrency.New(concurrency.Config{Rules: []string{"POST /hash=1"}})
+	timeouts, _ := NewTimeouts([]string{"/hash=20ms"})
+	finish, finished := make(chan bool), make(chan bool)
+	h := handler.New()
+	h.Post("/hash", func(ctx *handler.Context) {
+		<-finish
+		finished <- true
+	})
+	base := serve(t, Concurrency(Timeout(h, timeouts), l))
+
+	post := func() int {
+		resp, err := http.Post(base+"/hash", "application/x-www-form-urlencoded", nil)
+		if err != nil {
+			t.Fatalf("unable to post /hash \n\n %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(); status != http.StatusGatewayTimeout {
+		t.Fatalf("The request was not timed out. Returned: %v", status)
+	}
+
+	// the handler answered with a 504 is still running in its slot
+	if status := post(); status != http.StatusServiceUnavailable {
+		t.Errorf("Concurrency released the slot of a handler still running. Returned: %v", status)
+	}
+
+	finish <- true
+	<-finished
+	// once the handler has returned its slot is free
+	go func() {
+		finish <- true
+		<-finished
+	}()
+	status := post()
+	for deadline := time.Now().Add(time.Second); status == http.StatusServiceUnavailable && time.Now().Before(deadline); status = post() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status != http.StatusOK {
+		t.Errorf("The slot was not released once the handler returned. Returned: %v", status)
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/ratelimit"
+)
+
+// RateLimit wraps a handler, responding 429 Too Many Requests instead of serving
+// clients over the limiter's rate. Requests a rule limits are told their limit
+// in the RateLimit headers, and when to retry in Retry-After once denied
+func RateLimit(next http.Handler, l *ratelimit.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, limited := l.Allow(r)
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d.Headers(w.Header())
+		if !d.Allowed {
+			w.Header().Set("Content-Type", "text/plain;charsetUTF8")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("Too Many Requests"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
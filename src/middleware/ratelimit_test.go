@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	l, err := ratelimit.New(ratelimit.Config{Rules: []string{"POST /hash=0.1:1"}, Key: ratelimit.IP})
+	if err != nil {
+		t.Fatalf("ratelimit.New errored \n\n %v", err)
+	}
+	hashed := 0
+	h := handler.New()
+	h.Post("/hash", func(ctx *handler.Context) {
+		hashed++
+		ctx.String(http.StatusOK, "hashed")
+	})
+	h.Get("/health", handler.GetHealth)
+	base := serve(t, RateLimit(h, l))
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Post(base+"/hash", "application/x-www-form-urlencoded", nil)
+		if err != nil {
+			t.Fatalf("unable to post /hash \n\n %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != expected {
+			t.Errorf("request %v: RateLimit responded %v %q, expected %v", i, resp.StatusCode, body, expected)
+		}
+		if limit := resp.Header.Get("RateLimit-Limit"); limit != "1" {
+			t.Errorf("request %v: RateLimit-Limit was %q", i, limit)
+		}
+		if resp.Header.Get("RateLimit-Policy") != "1;w=10" || resp.Header.Get("RateLimit-Remaining") != "0" {
+			t.Errorf("request %v: RateLimit headers were not set. Headers: %v", i, resp.Header)
+		}
+		if retry := resp.Header.Get("Retry-After"); (expected == http.StatusTooManyRequests) != (retry == "10") {
+			t.Errorf("request %v: Retry-After was %q", i, retry)
+		}
+	}
+	if hashed != 1 {
+		t.Errorf("The denied request was served. Served: %v", hashed)
+	}
+
+	resp, err := http.Get(base + "/health")
+	if err != nil {
+		t.Fatalf("unable to get /health \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Limit") != "" {
+		t.Errorf("RateLimit limited a route without a rule. Returned: %v %v", resp.StatusCode, resp.Header)
+	}
+}
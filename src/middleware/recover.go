@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// Report describes a panic recovered while serving a request
+type Report struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Remote    string    `json:"remote"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+}
+
+// Sink receives the report of every recovered panic, e.g. to forward it to an
+// error tracker. It's called on the request's goroutine so shouldn't block
+type Sink func(Report)
+
+var (
+	sinkMu sync.RWMutex
+	sink   Sink
+)
+
+// SetSink replaces the sink recovered panics are reported to, nil for none
+func SetSink(s Sink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	sink = s
+}
+
+func currentSink() Sink {
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+	return sink
+}
+
+// Recover wraps a handler, recovering a panic anywhere in its middleware and routes.
+// The stack is logged with the request's id, given by RequestID wrapping Recover, the panic counted in the statistics
+// and reported to the sink. A client that hasn't been sent anything gets a 500,
+// otherwise its connection is aborted so the partial response isn't mistaken for
+// a complete one
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := handler.NewResponse(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// net/http aborts the response silently
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			stack := debug.Stack()
+			if p, ok := v.(*goroutinePanic); ok {
+				v, stack = p.value, p.stack
+			}
+			report := reportPanic(r, v, stack)
+
+			if rec.Committed() {
+				panic(http.ErrAbortHandler)
+			}
+			// drop any headers set for the response that was meant to be sent
+			h := w.Header()
+			for k := range h {
+				delete(h, k)
+			}
+			h.Set("Content-Type", "text/plain;charsetUTF8")
+			if report.RequestID != "" {
+				h.Set(requestid.Header, report.RequestID)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal Server Error"))
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// goroutinePanic is a panic recovered on a goroutine serving part of a request,
+// passed back to the request's goroutine with the stack it was raised on
+type goroutinePanic struct {
+	value interface{}
+	stack []byte
+}
+
+// reportPanic logs and counts the panic, and reports it to the sink
+func reportPanic(r *http.Request, v interface{}, stack []byte) Report {
+	report := Report{
+		Time:      time.Now(),
+		RequestID: requestid.From(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Remote:    r.RemoteAddr,
+		Panic:     fmt.Sprint(v),
+		Stack:     string(stack),
+	}
+	cache.RecoveredPanics.Add(1)
+	log.Printf("Recovered panic serving %v %v request_id=%v: %v\n%v",
+		report.Method, report.Path, report.RequestID, report.Panic, report.Stack)
+	if s := currentSink(); s != nil {
+		s(report)
+	}
+	return report
+}
+
+// WebhookSink returns a Sink posting every report as JSON to the url,
+// in the background so a slow endpoint doesn't hold up the response
+func WebhookSink(url string) Sink {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(report Report) {
+		body, err := json.Marshal(report)
+		if err != nil {
+			return
+		}
+		go func() {
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if report.RequestID != "" {
+				req.Header.Set(requestid.Header, report.RequestID)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Unable to report the panic to %v: %v", url, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("Unable to report the panic to %v: %v", url, resp.Status)
+			}
+		}()
+	}
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// serve serves the handler wrapped by RequestID and Recover, returning its base url
+func serve(t *testing.T, h http.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen \n\n %v", err)
+	}
+	s := &http.Server{Handler: RequestID(Recover(h))}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return "http://" + l.Addr().String()
+}
+
+func TestRecover(t *testing.T) {
+	reports := make(chan Report, 1)
+	SetSink(func(r Report) { reports <- r })
+	defer SetSink(nil)
+
+	h := handler.New()
+	h.Pre(func(ctx *handler.Context) {
+		if ctx.Request.URL.Path == "/pre" {
+			panic("pre middleware")
+		}
+	})
+	h.Get("/route", func(ctx *handler.Context) {
+		ctx.ResponseWriter.Header().Set("Content-Type", "application/json")
+		var m map[string]string
+		m["id"] = "nil map"
+	})
+	h.Get("/partial", func(ctx *handler.Context) {
+		ctx.ResponseWriter.Header().Set("Content-Length", "100")
+		ctx.ResponseWriter.Write([]byte("partial"))
+		ctx.ResponseWriter.(http.Flusher).Flush()
+		panic("after writing")
+	})
+	h.Get("/pre", handler.GetHealth)
+	base := serve(t, h)
+	panics := cache.RecoveredPanics.Load()
+
+	for _, path := range []string{"/pre", "/route"} {
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		req.Header.Set("X-Request-ID", "req-"+path)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: the panic dropped the connection \n\n %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError || string(body) != "Internal Server Error" {
+			t.Errorf("%v: Recover did not respond with a 500. Returned: %v %q", path, resp.StatusCode, body)
+		}
+		if id := resp.Header.Get(requestid.Header); id != "req-"+path {
+			t.Errorf("%v: Recover dropped the request id. Returned: %v", path, id)
+		}
+		if ct := resp.Header.Get("Content-Type"); strings.Contains(ct, "json") {
+			t.Errorf("%v: Recover kept the headers of the response meant to be sent. Content-Type: %v", path, ct)
+		}
+
+		report := <-reports
+		if report.RequestID != "req-"+path || report.Path != path || !strings.Contains(report.Stack, "recover_test.go") {
+			t.Errorf("%v: the sink was not sent a report of the panic. Report: %+v", path, report)
+		}
+	}
+
+	// a response already started is cut off rather than completed
+	resp, err := http.Get(base + "/partial")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("Recover completed a response that was partly written")
+	}
+	<-reports
+
+	if n := cache.RecoveredPanics.Load() - panics; n != 3 {
+		t.Errorf("Recover did not count every panic. Counted: %v", n)
+	}
+}
+
+func TestRecoverTimeout(t *testing.T) {
+	reports := make(chan Report, 1)
+	SetSink(func(r Report) { reports <- r })
+	defer SetSink(nil)
+
+	timeouts, err := NewTimeouts([]string{"/=100ms"})
+	if err != nil {
+		t.Fatalf("NewTimeouts errored \n\n %v", err)
+	}
+	base := serve(t, Timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/late" {
+			<-r.Context().Done()
+		}
+		panic("handler")
+	}), timeouts))
+
+	// the panic on the handler's goroutine is reported with its own stack
+	resp, err := http.Get(base + "/now")
+	if err != nil {
+		t.Fatalf("the panic dropped the connection \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Recover did not respond with a 500. Returned: %v", resp.StatusCode)
+	}
+	if report := <-reports; !strings.Contains(report.Stack, "recover_test.go") {
+		t.Errorf("the report does not have the stack of the panic. Stack: %v", report.Stack)
+	}
+
+	// and still reported once the timeout has answered the request
+	resp, err = http.Get(base + "/late")
+	if err != nil {
+		t.Fatalf("TestRecoverTimeout errored when making request to test server \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Timeout did not respond with a 504. Returned: %v", resp.StatusCode)
+	}
+	select {
+	case report := <-reports:
+		if report.Path != "/late" {
+			t.Errorf("the sink was sent the wrong report. Report: %+v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the panic after the timeout was not reported")
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+// RequestID wraps a handler, giving every request the id it was sent with
+// in the X-Request-ID header, or a generated one when it has none or an
+// invalid one. The id is carried on the request's context and sent back
+// in the response's header
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+
+		w.Header().Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.With(r.Context(), id)))
+	})
+}
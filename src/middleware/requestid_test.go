@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/requestid"
+)
+
+func TestRequestID(t *testing.T) {
+	// the handler echoes the id its context carries and forwards a request to the upstream
+	var forwarded string
+	upstream := handler.New()
+	upstream.Get("/upstream", func(ctx *handler.Context) {
+		forwarded = ctx.Request.Header.Get(requestid.Header)
+	})
+	upstreamURL := serve(t, upstream)
+
+	client := &http.Client{Transport: &requestid.Transport{}}
+	h := handler.New()
+	h.Get("/id", func(ctx *handler.Context) {
+		req, _ := http.NewRequestWithContext(ctx.Request.Context(), http.MethodGet, upstreamURL+"/upstream", nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+		ctx.String(http.StatusOK, ctx.RequestID())
+	})
+	base := serve(t, h)
+
+	tests := []struct {
+		name   string
+		sent   string
+		echoed bool
+	}{
+		{"accepted", "client-id-1", true},
+		{"generated", "", false},
+		{"invalid", "bad id; injected=1", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, base+"/id", nil)
+		if test.sent != "" {
+			req.Header[requestid.Header] = []string{test.sent}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: TestRequestID errored making the request \n\n %v", test.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		id := resp.Header.Get(requestid.Header)
+		if test.echoed && id != test.sent {
+			t.Errorf("%v: the id sent was not echoed. Sent: %v | Returned: %v", test.name, test.sent, id)
+		}
+		if !test.echoed && (!requestid.Valid(id) || id == test.sent) {
+			t.Errorf("%v: an id was not generated. Returned: %q", test.name, id)
+		}
+		if string(body) != id {
+			t.Errorf("%v: the context does not carry the id. Expected: %v | Returned: %v", test.name, id, body)
+		}
+		if forwarded != id {
+			t.Errorf("%v: the id was not passed on to the upstream. Expected: %v | Passed: %v", test.name, id, forwarded)
+		}
+	}
+}
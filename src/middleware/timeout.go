@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+)
+
+// TimeoutRule sets a deadline on requests to its target
+type TimeoutRule struct {
+	pathrule.Target
+	Timeout time.Duration
+}
+
+// ParseTimeout parses a rule written [METHOD ]/prefix=duration, e.g. POST /hash=10s
+func ParseTimeout(s string) (TimeoutRule, error) {
+	var r TimeoutRule
+	target, d, err := pathrule.Parse(s, "duration")
+	if err != nil {
+		return r, fmt.Errorf("timeout %q %v", s, err)
+	}
+	r.Target = target
+
+	if r.Timeout, err = time.ParseDuration(d); err != nil || r.Timeout <= 0 {
+		return r, fmt.Errorf("timeout %q must have a positive duration", s)
+	}
+	return r, nil
+}
+
+// Timeouts holds the timeout rules, the first matching a request setting its deadline
+type Timeouts struct {
+	mu    sync.RWMutex
+	rules []TimeoutRule
+}
+
+// NewTimeouts returns a new reference to Timeouts
+func NewTimeouts(rules []string) (*Timeouts, error) {
+	t := &Timeouts{}
+	apply, err := t.Prepare(rules)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	return t, nil
+}
+
+// Prepare parses the rules, returning a func that switches to them
+func (t *Timeouts) Prepare(rules []string) (func(), error) {
+	parsed := make([]TimeoutRule, 0, len(rules))
+	for _, s := range rules {
+		r, err := ParseTimeout(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.rules = parsed
+	}, nil
+}
+
+// timeout returns the timeout of the request, zero when no rule matches
+func (t *Timeouts) timeout(r *http.Request) time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, rule := range t.rules {
+		if rule.Matches(r) {
+			return rule.Timeout
+		}
+	}
+	return 0
+}
+
+// Timeout wraps a handler, setting a deadline on the context of requests a rule
+// matches. A handler overrunning it without having written is answered with a
+// 504 Gateway Timeout, telling it apart from requests shed with a 503, and its
+// later writes fail with http.ErrHandlerTimeout. A response already started is
+// left to the handler, which should stop once the context is done
+func Timeout(next http.Handler, t *Timeouts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := t.timeout(r)
+		if d == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		tw := &timeoutWriter{w: w, h: w.Header().Clone()}
+
+		// the handler runs aside so an overrun can be answered, its panics
+		// are passed back with their stack to be handled as if it hadn't
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					if v != http.ErrAbortHandler {
+						v = &goroutinePanic{v, debug.Stack()}
+					}
+					panicked <- v
+					return
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case <-done:
+			return
+		case v := <-panicked:
+			panic(v)
+		case <-ctx.Done():
+		}
+
+		tw.mu.Lock()
+		if tw.wroteHeader {
+			tw.mu.Unlock()
+			select {
+			case <-done:
+			case v := <-panicked:
+				panic(v)
+			}
+			return
+		}
+		defer tw.mu.Unlock()
+		tw.timedOut = true
+		// the handler still running keeps the request's concurrency slot,
+		// and a panic once the request has been answered is only reported
+		drop := holdSlot(r.Context())
+		go func() {
+			defer drop()
+			select {
+			case <-done:
+			case v := <-panicked:
+				if p, ok := v.(*goroutinePanic); ok {
+					reportPanic(r, p.value, p.stack)
+				}
+			}
+		}()
+		// a client that went away isn't answered
+		if ctx.Err() == context.DeadlineExceeded {
+			w.Header().Set("Content-Type", "text/plain;charsetUTF8")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte("Gateway Timeout"))
+		}
+	})
+}
+
+// timeoutWriter passes the handler's response through until it times out. The
+// handler gets its own headers, copied over once it writes, so it can't touch
+// the response after the timeout has answered it
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut && !tw.wroteHeader {
+		tw.writeHeader(status)
+	}
+}
+
+// writeHeader sends the handler's headers. It's called with the lock held
+func (tw *timeoutWriter) writeHeader(status int) {
+	h := tw.w.Header()
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range tw.h {
+		h[k] = v
+	}
+	tw.w.WriteHeader(status)
+	// informational responses precede the final one
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		tw.wroteHeader = true
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+// Flush lets streaming routes flush through the timeout
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	http.NewResponseController(tw.w).Flush()
+}
+
+// Hijack hands the connection to the handler, which then
+// answers for it whatever the timeout
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	conn, rw, err := http.NewResponseController(tw.w).Hijack()
+	if err == nil {
+		tw.wroteHeader = true
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+)
+
+func TestParseTimeout(t *testing.T) {
+	r, err := ParseTimeout("post /Hash/=10s")
+	if err != nil || r != (TimeoutRule{pathrule.Target{Method: "POST", Prefix: "/hash"}, 10 * time.Second}) {
+		t.Errorf("ParseTimeout returned %+v %v", r, err)
+	}
+	for _, s := range []string{"/hash", "hash=1s", "/hash=0s", "/hash=soon"} {
+		if _, err := ParseTimeout(s); err == nil {
+			t.Errorf("%q: ParseTimeout did not error", s)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	timeouts, err := NewTimeouts([]string{"/slow=50ms", "/stream=50ms", "/panic=1s"})
+	if err != nil {
+		t.Fatalf("NewTimeouts errored \n\n %v", err)
+	}
+	late := make(chan error, 1)
+	h := handler.New()
+	h.Get("/slow", func(ctx *handler.Context) {
+		<-ctx.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		_, err := ctx.ResponseWriter.Write([]byte("too late"))
+		late <- err
+	})
+	h.Get("/stream", func(ctx *handler.Context) {
+		ctx.ResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+		ctx.ResponseWriter.Write([]byte("started\n"))
+		ctx.ResponseWriter.(http.Flusher).Flush()
+		<-ctx.Context().Done()
+		ctx.ResponseWriter.Write([]byte("stopped\n"))
+	})
+	h.Get("/panic", func(ctx *handler.Context) {
+		panic("in the handler's goroutine")
+	})
+	h.Get("/health", func(ctx *handler.Context) {
+		if _, ok := ctx.Context().Deadline(); ok {
+			t.Errorf("A request without a rule was given a deadline")
+		}
+		handler.GetHealth(ctx)
+	})
+	// panics reach the Recover wrapping Timeout
+	base := serve(t, Timeout(h, timeouts))
+
+	tests := []struct {
+		path        string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"/slow", http.StatusGatewayTimeout, "Gateway Timeout", "text/plain;charsetUTF8"},
+		{"/stream", http.StatusOK, "started\nstopped\n", "application/x-ndjson"},
+		{"/panic", http.StatusInternalServerError, "Internal Server Error", "text/plain;charsetUTF8"},
+		{"/health", http.StatusOK, "", ""},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(base + test.path)
+		if err != nil {
+			t.Fatalf("%v: unable to get \n\n %v", test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status || !strings.HasPrefix(string(body), test.body) {
+			t.Errorf("%v: Timeout responded %v %q, expected %v %q", test.path, resp.StatusCode, body, test.status, test.body)
+		}
+		if ct := resp.Header.Get("Content-Type"); test.contentType != "" && ct != test.contentType {
+			t.Errorf("%v: Content-Type was %q, expected %q", test.path, ct, test.contentType)
+		}
+		if resp.Header.Get("X-Request-ID") == "" {
+			t.Errorf("%v: Timeout dropped the headers set before it", test.path)
+		}
+	}
+
+	if err := <-late; err != http.ErrHandlerTimeout {
+		t.Errorf("A write after the timeout did not fail. Errored: %v", err)
+	}
+}
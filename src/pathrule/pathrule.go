@@ -0,0 +1,70 @@
+/*
+Package pathrule parses and matches the targets of the rules configuring
+rate limits, concurrency limits and timeouts.
+
+	A rule is written [METHOD ]/prefix=value and applies to the requests to
+	the paths under the prefix, of the method when one is given. Paths are
+	matched lowercased, as the router does, so a rule can't be sidestepped
+	by changing the case of a route.
+*/
+package pathrule
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Target is the requests a rule applies to
+type Target struct {
+	Method string
+	Prefix string
+}
+
+// Parse splits a rule into its target and value, describing the value as form in errors
+func Parse(s, form string) (Target, string, error) {
+	var t Target
+	target, value, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok {
+		return t, "", fmt.Errorf("is not [METHOD ]/prefix=%v", form)
+	}
+	if method, prefix, ok := strings.Cut(target, " "); ok {
+		t.Method, target = strings.ToUpper(method), strings.TrimSpace(prefix)
+	}
+	if !strings.HasPrefix(target, "/") {
+		return t, "", fmt.Errorf("has no /prefix")
+	}
+	t.Prefix = Clean(target)
+	return t, value, nil
+}
+
+// Clean returns the prefix as matched, lowercased and without a trailing slash
+func Clean(prefix string) string {
+	return strings.ToLower(strings.TrimSuffix(prefix, "/"))
+}
+
+// String returns the target as written in a rule
+func (t Target) String() string {
+	s := t.Prefix
+	if s == "" {
+		s = "/"
+	}
+	if t.Method != "" {
+		s = t.Method + " " + s
+	}
+	return s
+}
+
+// Matches returns whether the target includes the request
+func (t Target) Matches(r *http.Request) bool {
+	if t.Method != "" && t.Method != r.Method {
+		return false
+	}
+	return Under(r.URL.Path, t.Prefix)
+}
+
+// Under returns whether the path is the cleaned prefix or below it
+func Under(path, prefix string) bool {
+	path = strings.ToLower(path)
+	return strings.HasPrefix(path, prefix) && (len(path) == len(prefix) || path[len(prefix)] == '/')
+}
@@ -0,0 +1,63 @@
+package pathrule
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Target
+		value    string
+		err      string
+	}{
+		{"POST /hash=1", Target{"POST", "/hash"}, "1", ""},
+		{"get /Stats/=1:2", Target{"GET", "/stats"}, "1:2", ""},
+		{" /=10s ", Target{"", ""}, "10s", ""},
+		{"/hash", Target{}, "", "is not [METHOD ]/prefix=n"},
+		{"POST hash=1", Target{}, "", "no /prefix"},
+	}
+
+	for _, test := range tests {
+		target, value, err := Parse(test.s, "n")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: Parse did not error with %q. Errored: %v", test.s, test.err, err)
+			}
+			continue
+		}
+		if err != nil || target != test.expected || value != test.value {
+			t.Errorf("%q: Parse returned %+v %q %v, expected %+v %q", test.s, target, value, err, test.expected, test.value)
+		}
+		if again, _, _ := Parse(target.String()+"=", "n"); again != target {
+			t.Errorf("%q: String did not round trip. Returned: %q", test.s, target.String())
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	target := Target{"POST", "/hash"}
+	tests := []struct {
+		method, path string
+		expected     bool
+	}{
+		{"POST", "/hash", true},
+		{"POST", "/hash/1", true},
+		{"POST", "/HASH", true},
+		{"POST", "/hashes", false},
+		{"GET", "/hash", false},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "http://localhost"+test.path, nil)
+		if target.Matches(r) != test.expected {
+			t.Errorf("%v %v: Matches did not return %v", test.method, test.path, test.expected)
+		}
+	}
+	r, _ := http.NewRequest("GET", "http://localhost/anything", nil)
+	if !(Target{}).Matches(r) {
+		t.Errorf("The root target did not match every request")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Package peer authenticates the requests cluster nodes send each other.
+
+	The routes only other nodes call, such as the replication log, are served
+	on a peer listener separate from the public api. Every request to it must
+	carry the secret the cluster shares as a bearer token, which nodes send
+	with a Transport.
+*/
+package peer
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	mu     sync.RWMutex
+	secret []byte
+)
+
+type key struct{}
+
+// SetSecret sets the secret shared by the nodes of the cluster,
+// without one every request to a Guard is refused
+func SetSecret(s string) {
+	mu.Lock()
+	defer mu.Unlock()
+	secret = []byte(s)
+}
+
+func current() []byte {
+	mu.RLock()
+	defer mu.RUnlock()
+	return secret
+}
+
+// Guard wraps a handler, only passing it requests carrying the secret
+func Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := current()
+		auth := r.Header.Get("Authorization")
+		if len(s) == 0 || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare(s, []byte(strings.TrimPrefix(auth, "Bearer "))) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="peer"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key{}, true)))
+	})
+}
+
+// Authenticated reports whether the request was sent by another node, through a Guard
+func Authenticated(r *http.Request) bool {
+	ok, _ := r.Context().Value(key{}).(bool)
+	return ok
+}
+
+// Transport is an http.RoundTripper sending the secret with each request
+type Transport struct {
+	// Base sends the requests, by default http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// a RoundTripper must not modify the request it's given
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+string(current()))
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	authenticated := false
+	h := Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = Authenticated(r)
+	}))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	get := func(client *http.Client) int {
+		authenticated = false
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unable to get \n\n %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	peers := &http.Client{Transport: &Transport{}}
+
+	// without a secret every request is refused
+	SetSecret("")
+	if status := get(peers); status != http.StatusUnauthorized {
+		t.Errorf("Guard without a secret responded %v, expected %v", status, http.StatusUnauthorized)
+	}
+
+	SetSecret("shared")
+	defer SetSecret("")
+	if status := get(http.DefaultClient); status != http.StatusUnauthorized || authenticated {
+		t.Errorf("Guard passed a request without the secret, responding %v", status)
+	}
+	if status := get(peers); status != http.StatusOK || !authenticated {
+		t.Errorf("Guard refused a request sent with the secret, responding %v", status)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if Authenticated(req) {
+		t.Errorf("A request that didn't pass a Guard was authenticated")
+	}
+}
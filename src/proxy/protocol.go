@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderTimeout bounds how long a connection has to send its PROXY protocol header
+const HeaderTimeout = 5 * time.Second
+
+// v2Signature starts every PROXY protocol v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Header is the longest PROXY protocol v1 header, including the CRLF
+const maxV1Header = 107
+
+// Listener accepts connections that start with a PROXY protocol header,
+// see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+type Listener struct {
+	net.Listener
+}
+
+// NewListener returns a Listener accepting the listener's connections
+func NewListener(l net.Listener) *Listener {
+	return &Listener{Listener: l}
+}
+
+// Accept returns the next connection, whose remote address is the one its header
+// passes. Connections from peers that aren't trusted proxies are closed
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && !Trusted(addr.IP) {
+			log.Printf("Closed a connection from %v, not a trusted proxy", addr)
+			c.Close()
+			continue
+		}
+		return &Conn{Conn: c, r: bufio.NewReader(c)}, nil
+	}
+}
+
+// Conn is a connection started with a PROXY protocol header. The header is read
+// on the first Read or RemoteAddr, so a slow peer doesn't hold up Accept
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) header() {
+	c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+	c.remote, c.err = readHeader(c.r)
+	c.Conn.SetReadDeadline(time.Time{})
+
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol header from %v: %w", c.Conn.RemoteAddr(), c.err)
+		log.Print(c.err)
+	}
+	// health checks and unknown protocols keep the address of the proxy
+	if c.remote == nil {
+		c.remote = c.Conn.RemoteAddr()
+	}
+}
+
+// Read implements the net.Conn interface, erroring when the header is invalid
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.header)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// Write implements the net.Conn interface, erroring when the header is invalid
+// so nothing is sent to a peer not speaking the protocol
+func (c *Conn) Write(b []byte) (int, error) {
+	c.once.Do(c.header)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+// RemoteAddr returns the address of the client the header passes
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.header)
+	return c.remote
+}
+
+// readHeader reads a v1 or v2 header, returning the client's address
+// or nil when the header doesn't pass one
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readV1 reads a human readable header, e.g. PROXY TCP4 192.0.2.1 198.51.100.1 56324 443
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(line) > maxV1Header || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is not terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header, skipping any TLVs after the addresses
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if version := hdr[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported version %v", version)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command := hdr[12] & 0xf; command {
+	case 0:
+		// LOCAL, sent by the proxy itself, e.g. for health checks
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported command %v", command)
+	}
+
+	switch family := hdr[13] >> 4; family {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("short ipv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("short ipv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// unspecified or unix addresses
+		return nil, nil
+	}
+}
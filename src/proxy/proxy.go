@@ -0,0 +1,148 @@
+/*
+Package proxy resolves the address of the client behind load balancers and reverse proxies.
+
+	A listener wrapped with NewListener reads the HAProxy PROXY protocol header,
+	v1 or v2, each connection starts with, so the connection's remote address is
+	the client's rather than the load balancer's. RealIP resolves the client of
+	a request from the X-Forwarded-For or Forwarded header the trusted proxies
+	set, only believing the hops they added.
+*/
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Headers trusted proxies set the client's address in
+const (
+	XForwardedFor = "X-Forwarded-For"
+	Forwarded     = "Forwarded"
+)
+
+var (
+	trustedMu sync.RWMutex
+	trusted   []*net.IPNet
+	header    = XForwardedFor
+)
+
+// SetTrusted replaces the networks of the proxies trusted to
+// send PROXY protocol headers and forwarding headers
+func SetTrusted(nets []*net.IPNet) {
+	trustedMu.Lock()
+	defer trustedMu.Unlock()
+	trusted = nets
+}
+
+// SetHeader sets the forwarding header the trusted proxies set,
+// XForwardedFor or Forwarded, any other is ignored by RealIP
+func SetHeader(name string) {
+	trustedMu.Lock()
+	defer trustedMu.Unlock()
+	header = http.CanonicalHeaderKey(name)
+}
+
+// Trusted reports whether the ip is a trusted proxy's
+func Trusted(ip net.IP) bool {
+	trustedMu.RLock()
+	defer trustedMu.RUnlock()
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrusted parses the IPs and CIDRs of trusted proxies
+func ParseTrusted(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy cidr %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// RealIP returns the IP of the client that sent the request. Starting from the
+// peer that connected, each hop added to the header set with SetHeader is followed
+// back while the hop that added it is a trusted proxy. The other header is ignored,
+// as the proxies pass on whatever a client sends in it
+func RealIP(r *http.Request) string {
+	trustedMu.RLock()
+	name := header
+	trustedMu.RUnlock()
+
+	ip := host(r.RemoteAddr)
+	for hops := forwarded(r.Header, name); len(hops) > 0; hops = hops[:len(hops)-1] {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || !Trusted(parsed) {
+			break
+		}
+		// an obfuscated or unknown hop can't be followed further
+		hop := host(hops[len(hops)-1])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// forwarded returns the addresses of the hops a request was forwarded through
+// recorded in the header named, the client first
+func forwarded(h http.Header, name string) []string {
+	var hops []string
+	switch name {
+	case Forwarded:
+		values := h.Values(Forwarded)
+		if len(values) == 0 {
+			break
+		}
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "for") {
+					hop = strings.Trim(v, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	case XForwardedFor:
+		for _, v := range h.Values(XForwardedFor) {
+			for _, hop := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// host strips the port and brackets from an address
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2 returns a v2 header of the command and family passing the addresses
+func v2(command, family byte, addrs []byte) string {
+	hdr := append([]byte(nil), v2Signature...)
+	hdr = append(hdr, 0x20|command, family<<4|1)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xdc, 0x04, 0x01, 0xbb)
+	tlv := append(append([]byte(nil), ipv4...), 0x04, 0x00, 0x01, 0x00)
+
+	tests := []struct {
+		name   string
+		header string
+		remote string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", true},
+		{"v1 unterminated", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443" + strings.Repeat(" ", 100) + "\r\n", "", true},
+		{"v2 ipv4", v2(1, 1, ipv4), "192.0.2.1:56324", false},
+		{"v2 ipv6", v2(1, 2, ipv6), "[2001:db8::1]:56324", false},
+		{"v2 tlvs", v2(1, 1, tlv), "192.0.2.1:56324", false},
+		{"v2 local", v2(0, 0, nil), "", false},
+		{"v2 short", v2(1, 1, ipv4[:8]), "", true},
+		{"missing", "GET / HTTP/1.1\r\n\r\n", "", true},
+	}
+
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "GET"))
+		remote, err := readHeader(r)
+		if (err != nil) != test.err {
+			t.Errorf("%v: readHeader returned error %v", test.name, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if addr := fmt.Sprint(remote); remote != nil && addr != test.remote || remote == nil && test.remote != "" {
+			t.Errorf("%v: readHeader returned the wrong address. Expected: %v | Returned: %v", test.name, test.remote, addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "GET" {
+			t.Errorf("%v: readHeader read past the header. Left: %q", test.name, rest)
+		}
+	}
+}
+
+// serve serves the remote address of every request on a proxy protocol listener
+func serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen \n\n %v", err)
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go s.Serve(NewListener(l))
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// request sends a request preceded by the header, returning the response body
+func request(addr, header string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "%vGET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", header)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestListener(t *testing.T) {
+	addr := serve(t)
+
+	// without trusted proxies no peer can connect
+	if remote, err := request(addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"); err == nil {
+		t.Errorf("The listener served a connection without any trusted proxy. Returned: %v", remote)
+	}
+
+	SetTrusted([]*net.IPNet{{IP: net.ParseIP("127.0.0.0"), Mask: net.CIDRMask(8, 32)}})
+	defer SetTrusted(nil)
+	remote, err := request(addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	if err != nil || remote != "192.0.2.1:56324" {
+		t.Errorf("The listener did not pass the client's address. Returned: %v %v", remote, err)
+	}
+	if remote, err := request(addr, ""); err == nil {
+		t.Errorf("The listener served a connection without a header. Returned: %v", remote)
+	}
+
+	// peers other than the trusted proxies can't connect
+	SetTrusted([]*net.IPNet{{IP: net.ParseIP("192.0.2.0"), Mask: net.CIDRMask(24, 32)}})
+	if remote, err := request(addr, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"); err == nil {
+		t.Errorf("The listener served a connection from an untrusted peer. Returned: %v", remote)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("ParseTrusted errored \n\n %v", err)
+	}
+	SetTrusted(trusted)
+	defer SetTrusted(nil)
+
+	tests := []struct {
+		name    string
+		header  string
+		remote  string
+		headers map[string][]string
+		ip      string
+	}{
+		{"direct", XForwardedFor, "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", XForwardedFor, "192.0.2.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"trusted peer", XForwardedFor, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed hop", XForwardedFor, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1"}}, "198.51.100.1"},
+		{"proxy chain", XForwardedFor, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.2", "10.0.0.3"}}, "198.51.100.1"},
+		{"only proxies", XForwardedFor, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded", Forwarded, "[2001:db8::1]:1234", map[string][]string{"Forwarded": {`for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`}}, "198.51.100.1"},
+		{"forwarded ignoring x-forwarded-for", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.1"},
+		{"x-forwarded-for ignoring forwarded", XForwardedFor, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=1.2.3.4"}, "X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"other header", Forwarded, "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "10.0.0.1"},
+		{"obfuscated hop", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.1, for=_hidden"}}, "10.0.0.1"},
+	}
+
+	defer SetHeader(XForwardedFor)
+	for _, test := range tests {
+		SetHeader(test.header)
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header(test.headers)}
+		if ip := RealIP(r); ip != test.ip {
+			t.Errorf("%v: RealIP returned the wrong ip. Expected: %v | Returned: %v", test.name, test.ip, ip)
+		}
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	if _, err := ParseTrusted([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("ParseTrusted did not error on an invalid cidr")
+	}
+	if _, err := ParseTrusted([]string{"proxy.local"}); err == nil {
+		t.Errorf("ParseTrusted did not error on a hostname")
+	}
+	nets, err := ParseTrusted([]string{" 10.0.0.1 "})
+	if err != nil || len(nets) != 1 || !nets[0].Contains(net.ParseIP("10.0.0.1")) || nets[0].Contains(net.ParseIP("10.0.0.2")) {
+		t.Errorf("ParseTrusted did not parse a single ip. Returned: %v %v", nets, err)
+	}
+}
@@ -0,0 +1,813 @@
+/*
+Package raft implements a password storage backend replicated with the Raft consensus algorithm.
+
+	Writes are appended to a log the leader replicates to every member, and
+	are only acknowledged once a quorum of members has stored them. Committed
+	entries are applied in order to each member's in memory store, which is
+	periodically snapshotted so the log stays bounded. Members are added and
+	removed one at a time through configuration entries in the log.
+*/
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+)
+
+// States a node can be in
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+// Entry types
+const (
+	EntryCommand = "command"
+	EntryConfig  = "config"
+	EntryNoop    = "noop"
+)
+
+// Proposal operations besides the cache operations
+const (
+	OpAddMember    = "add_member"
+	OpRemoveMember = "remove_member"
+)
+
+// Defaults used when a Config leaves the value unset
+const (
+	DefaultElectionTimeout   = 500 * time.Millisecond
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 1000
+	DefaultProposeTimeout    = 10 * time.Second
+)
+
+// maxAppendEntries is the most entries sent to a member in one request
+const maxAppendEntries = 500
+
+var (
+	// ErrNoLeader is returned when a write is made while no leader is known
+	ErrNoLeader = errors.New("raft: no known leader")
+	// ErrNotLeader is returned when a forwarded write reaches a node that isn't the leader
+	ErrNotLeader = errors.New("raft: node is not the leader")
+	// ErrLeadershipLost is returned when a write was replaced by another leader before committing
+	ErrLeadershipLost = errors.New("raft: leadership lost before the write committed")
+	// ErrConfigChangeInProgress is returned when a membership change is made before the last one committed
+	ErrConfigChangeInProgress = errors.New("raft: a membership change is already in progress")
+	// ErrStopped is returned for writes to a stopped node
+	ErrStopped = errors.New("raft: node is stopped")
+)
+
+// Entry is an entry of the replicated log
+type Entry struct {
+	Index   uint64       `json:"index"`
+	Term    uint64       `json:"term"`
+	Type    string       `json:"type"`
+	Op      string       `json:"op,omitempty"`
+	Record  cache.Record `json:"record"`
+	Members []string     `json:"members,omitempty"`
+}
+
+// Config configures a Node
+type Config struct {
+	// ID is the base url other members reach this node's peer listener on
+	ID string
+	// Members are the ids of the initial members, including this node.
+	// It is ignored when the node restarts from persisted state, and is
+	// left empty for a node that will be added to an existing cluster
+	Members []string
+	// DataDir persists the log and snapshots, when empty nothing survives a restart
+	DataDir string
+	// Store is the in memory store committed writes are applied to
+	Store *cache.Store
+	// Transport sends requests to other members, by default over HTTP
+	Transport Transport
+
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	SnapshotThreshold int
+	ProposeTimeout    time.Duration
+}
+
+// Status describes the state of a node
+type Status struct {
+	ID            string   `json:"id"`
+	State         string   `json:"state"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader"`
+	Members       []string `json:"members"`
+	CommitIndex   uint64   `json:"commit_index"`
+	LastApplied   uint64   `json:"last_applied"`
+	LastIndex     uint64   `json:"last_index"`
+	SnapshotIndex uint64   `json:"snapshot_index"`
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Node is a member of a Raft cluster and implements cache.Storage
+type Node struct {
+	cfg Config
+
+	// applyMu is held while changing the store, before mu
+	applyMu sync.Mutex
+	mu      sync.Mutex
+
+	state    string
+	term     uint64
+	votedFor string
+	leader   string
+	members  []string
+
+	// log holds the entries after the snapshot
+	log      []Entry
+	snapshot Snapshot
+
+	commitIndex uint64
+	lastApplied uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+	waiters    map[uint64]waiter
+
+	electionDeadline time.Time
+
+	applyCh     chan struct{}
+	replicateCh chan struct{}
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewNode returns a new reference to a Node, restoring any state
+// persisted in the data directory
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold <= 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if cfg.ProposeTimeout <= 0 {
+		cfg.ProposeTimeout = DefaultProposeTimeout
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = NewHTTPTransport()
+	}
+	if cfg.Store == nil {
+		cfg.Store = cache.NewStore()
+	}
+
+	n := &Node{
+		cfg:         cfg,
+		state:       Follower,
+		members:     append([]string(nil), cfg.Members...),
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		inflight:    make(map[string]bool),
+		waiters:     make(map[uint64]waiter),
+		applyCh:     make(chan struct{}, 1),
+		replicateCh: make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	n.snapshot.Members = n.members
+
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Start begins taking part in elections and applying committed entries
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionDeadline()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	log.Printf("Raft node %v started with members %v", n.cfg.ID, n.Members())
+}
+
+// Stop stops the node, failing any writes waiting to commit
+func (n *Node) Stop() {
+	close(n.stop)
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, w := range n.waiters {
+		w.ch <- ErrStopped
+		delete(n.waiters, i)
+	}
+}
+
+// Get returns the record stored under id from this node's store.
+// Followers may briefly return stale reads
+func (n *Node) Get(id string) (cache.Record, bool) {
+	return n.cfg.Store.Get(id)
+}
+
+// Range calls fn for every record of this node's store ordered by id, until fn returns false
+func (n *Node) Range(fn func(cache.Record) bool) {
+	n.cfg.Store.Range(fn)
+}
+
+// Put replicates the record, returning once a quorum has committed it
+func (n *Node) Put(r cache.Record) error {
+	return n.PutContext(context.Background(), r)
+}
+
+// PutContext replicates the record unless the context is done before it's
+// proposed, returning once a quorum has committed it
+func (n *Node) PutContext(ctx context.Context, r cache.Record) error {
+	return n.Propose(ctx, ProposeRequest{Op: cache.OpPut, Record: r})
+}
+
+// AddMember adds the member to the cluster,
+// returning once the configuration change has committed
+func (n *Node) AddMember(id string) error {
+	return n.Propose(context.Background(), ProposeRequest{Op: OpAddMember, Member: id})
+}
+
+// RemoveMember removes the member from the cluster,
+// returning once the configuration change has committed
+func (n *Node) RemoveMember(id string) error {
+	return n.Propose(context.Background(), ProposeRequest{Op: OpRemoveMember, Member: id})
+}
+
+// Propose commits the proposal through the leader, forwarding it when this
+// node is not the leader. Once the leader has appended it, the proposal may
+// commit even if the context is done before Propose returns
+func (n *Node) Propose(ctx context.Context, p ProposeRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ProposeTimeout)
+	defer cancel()
+
+	n.mu.Lock()
+	state, leader := n.state, n.leader
+	n.mu.Unlock()
+
+	if state == Leader {
+		return n.propose(ctx, p)
+	}
+	if leader == "" {
+		return ErrNoLeader
+	}
+
+	var resp ProposeResponse
+	if err := n.cfg.Transport.Call(ctx, leader, RPCPropose, p, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// propose appends the proposal to the leader's log and waits for it to commit
+func (n *Node) propose(ctx context.Context, p ProposeRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	switch p.Op {
+	case OpAddMember, OpRemoveMember:
+		if n.configIndex() > n.commitIndex {
+			n.mu.Unlock()
+			return ErrConfigChangeInProgress
+		}
+		e.Type = EntryConfig
+		e.Members = changeMembers(n.members, p.Op, p.Member)
+	default:
+		e.Type = EntryCommand
+		e.Op = p.Op
+		e.Record = p.Record
+	}
+
+	n.appendEntries(e)
+	// an entry that wasn't saved can't count towards a quorum
+	if err := n.persist(); err != nil {
+		n.truncate(e.Index)
+		n.mu.Unlock()
+		return fmt.Errorf("raft: persisting the entry failed: %w", err)
+	}
+	ch := make(chan error, 1)
+	n.waiters[e.Index] = waiter{e.Term, ch}
+	// a single member is its own quorum
+	n.advanceCommitIndex()
+	n.mu.Unlock()
+
+	n.triggerReplication()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.stop:
+		return ErrStopped
+	}
+}
+
+// Status returns the current state of the node
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		Members:       append([]string{}, n.members...),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+// Members returns the members of the current configuration
+func (n *Node) Members() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.members...)
+}
+
+// run campaigns when the leader hasn't been heard from in time
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		campaign := n.state != Leader && time.Now().After(n.electionDeadline)
+		n.mu.Unlock()
+
+		if campaign {
+			n.campaign()
+		}
+	}
+}
+
+// campaign starts an election for the next term
+func (n *Node) campaign() {
+	n.mu.Lock()
+	n.resetElectionDeadline()
+
+	// nodes that aren't members, like ones waiting to be added, never campaign
+	if !n.isMember(n.cfg.ID) {
+		n.mu.Unlock()
+		return
+	}
+
+	// the vote for itself has to be saved, or after a restart
+	// it could vote for another candidate in the same term
+	prevState, prevTerm, prevVotedFor, prevLeader := n.state, n.term, n.votedFor, n.leader
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	if err := n.persist(); err != nil {
+		log.Printf("Raft persisting state failed, not campaigning: %v", err)
+		n.state, n.term, n.votedFor, n.leader = prevState, prevTerm, prevVotedFor, prevLeader
+		n.mu.Unlock()
+		return
+	}
+
+	term := n.term
+	members := append([]string(nil), n.members...)
+	req := VoteRequest{term, n.cfg.ID, n.lastIndex(), n.lastTerm()}
+	votes := 1
+	if votes > len(members)/2 {
+		n.becomeLeader()
+	}
+	n.mu.Unlock()
+
+	for _, m := range members {
+		if m == n.cfg.ID {
+			continue
+		}
+
+		go func(m string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+
+			var resp VoteResponse
+			if err := n.cfg.Transport.Call(ctx, m, RPCVote, req, &resp); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+			if n.state != Candidate || n.term != term || !resp.Granted {
+				return
+			}
+			if votes++; votes > len(members)/2 {
+				n.becomeLeader()
+			}
+		}(m)
+	}
+}
+
+// becomeFollower steps down to a follower of the term provided
+// The caller must hold mu
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.persist(); err != nil {
+			log.Printf("Raft persisting state failed: %v", err)
+		}
+	}
+	if n.state == Leader {
+		log.Printf("Raft node %v stepped down in term %v", n.cfg.ID, n.term)
+	}
+	n.state = Follower
+	n.leader = leader
+}
+
+// becomeLeader takes leadership of the current term, appending an entry
+// of the term so entries of earlier terms commit with it
+// The caller must hold mu
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.cfg.ID
+	for _, m := range n.members {
+		n.nextIndex[m] = n.lastIndex() + 1
+		n.matchIndex[m] = 0
+	}
+
+	n.appendEntries(Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop})
+	if err := n.persist(); err != nil {
+		log.Printf("Raft persisting state failed: %v", err)
+	}
+	n.advanceCommitIndex()
+	log.Printf("Raft node %v became leader in term %v", n.cfg.ID, n.term)
+
+	n.wg.Add(1)
+	go n.lead(n.term)
+}
+
+// lead replicates the log to every member while this node leads the term
+func (n *Node) lead(term uint64) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		n.mu.Lock()
+		if n.state != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		for _, m := range n.members {
+			if m == n.cfg.ID || n.inflight[m] {
+				continue
+			}
+			if _, ok := n.nextIndex[m]; !ok {
+				n.nextIndex[m] = n.lastIndex() + 1
+			}
+			n.inflight[m] = true
+			go n.replicate(m, term)
+		}
+		n.mu.Unlock()
+
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		case <-n.replicateCh:
+		}
+	}
+}
+
+// replicate sends the member the entries it is missing,
+// or the snapshot when those entries have been compacted
+func (n *Node) replicate(m string, term uint64) {
+	defer func() {
+		n.mu.Lock()
+		n.inflight[m] = false
+		n.mu.Unlock()
+	}()
+
+	n.mu.Lock()
+	if n.state != Leader || n.term != term {
+		n.mu.Unlock()
+		return
+	}
+
+	next := n.nextIndex[m]
+	if next <= n.snapshot.Index {
+		req := SnapshotRequest{term, n.cfg.ID, n.snapshot}
+		n.mu.Unlock()
+		n.sendSnapshot(m, req)
+		return
+	}
+
+	prev := next - 1
+	entries := n.entriesFrom(next, maxAppendEntries)
+	req := AppendRequest{term, n.cfg.ID, prev, n.termAt(prev), entries, n.commitIndex}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+
+	var resp AppendResponse
+	if err := n.cfg.Transport.Call(ctx, m, RPCAppend, req, &resp); err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return
+	}
+	if n.state != Leader || n.term != term {
+		return
+	}
+
+	if resp.Success {
+		match := prev + uint64(len(entries))
+		if match > n.matchIndex[m] {
+			n.matchIndex[m] = match
+		}
+		n.nextIndex[m] = n.matchIndex[m] + 1
+		n.advanceCommitIndex()
+
+		// keep sending while the member is behind
+		if n.nextIndex[m] <= n.lastIndex() {
+			n.triggerReplication()
+		}
+		return
+	}
+
+	// back up to the member's hint, at least one entry at a time
+	next = next - 1
+	if resp.ConflictIndex > 0 && resp.ConflictIndex < next {
+		next = resp.ConflictIndex
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[m] = next
+	n.triggerReplication()
+}
+
+func (n *Node) sendSnapshot(m string, req SnapshotRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var resp SnapshotResponse
+	if err := n.cfg.Transport.Call(ctx, m, RPCSnapshot, req, &resp); err != nil {
+		log.Printf("Raft sending snapshot to %v failed: %v", m, err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return
+	}
+	if n.state != Leader || n.term != req.Term {
+		return
+	}
+	if req.Snapshot.Index > n.matchIndex[m] {
+		n.matchIndex[m] = req.Snapshot.Index
+	}
+	n.nextIndex[m] = n.matchIndex[m] + 1
+	n.advanceCommitIndex()
+	n.triggerReplication()
+}
+
+// advanceCommitIndex commits the latest entry of the current term
+// stored by a quorum of the members
+// The caller must hold mu
+func (n *Node) advanceCommitIndex() {
+	for i := n.lastIndex(); i > n.commitIndex && n.termAt(i) == n.term; i-- {
+		count := 0
+		for _, m := range n.members {
+			if m == n.cfg.ID || n.matchIndex[m] >= i {
+				count++
+			}
+		}
+
+		if count > len(n.members)/2 {
+			n.commitIndex = i
+			n.triggerApply()
+			return
+		}
+	}
+}
+
+// applyLoop applies committed entries to the store in order
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+
+		for n.applyNext() {
+		}
+	}
+}
+
+// applyNext applies the next committed entry,
+// returning false when every committed entry has been applied
+func (n *Node) applyNext() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	i := n.lastApplied + 1
+	e := n.entry(i)
+	n.mu.Unlock()
+
+	if e.Type == EntryCommand {
+		n.cfg.Store.Apply(cache.Change{Op: e.Op, Record: e.Record})
+	}
+
+	n.mu.Lock()
+	n.lastApplied = i
+	if w, ok := n.waiters[i]; ok {
+		if w.term == e.Term {
+			w.ch <- nil
+		} else {
+			w.ch <- ErrLeadershipLost
+		}
+		delete(n.waiters, i)
+	}
+
+	// a leader removed from the cluster steps down once the removal commits
+	if e.Type == EntryConfig && n.state == Leader && !n.isMember(n.cfg.ID) && n.configIndex() <= i {
+		n.becomeFollower(n.term, "")
+	}
+
+	compact := n.lastApplied-n.snapshot.Index >= uint64(n.cfg.SnapshotThreshold)
+	n.mu.Unlock()
+
+	if compact {
+		n.takeSnapshot()
+	}
+	return true
+}
+
+// appendEntries appends entries to the log, updating the members
+// when a configuration entry is appended
+// The caller must hold mu
+func (n *Node) appendEntries(entries ...Entry) {
+	for _, e := range entries {
+		n.log = append(n.log, e)
+		if e.Type == EntryConfig {
+			n.members = append([]string(nil), e.Members...)
+		}
+	}
+}
+
+// truncate removes the entries from index i onwards, restoring
+// the members of the latest configuration left in the log
+// The caller must hold mu
+func (n *Node) truncate(i uint64) {
+	n.log = n.log[:i-n.snapshot.Index-1]
+	n.members = n.configAt(n.lastIndex())
+
+	for idx, w := range n.waiters {
+		if idx >= i {
+			w.ch <- ErrLeadershipLost
+			delete(n.waiters, idx)
+		}
+	}
+}
+
+// configAt returns the members of the configuration in effect at index i
+// The caller must hold mu
+func (n *Node) configAt(i uint64) []string {
+	for j := i; j > n.snapshot.Index; j-- {
+		if e := n.entry(j); e.Type == EntryConfig {
+			return append([]string(nil), e.Members...)
+		}
+	}
+	return append([]string(nil), n.snapshot.Members...)
+}
+
+// configIndex returns the index of the latest configuration entry in the log
+// The caller must hold mu
+func (n *Node) configIndex() uint64 {
+	for j := n.lastIndex(); j > n.snapshot.Index; j-- {
+		if n.entry(j).Type == EntryConfig {
+			return j
+		}
+	}
+	return n.snapshot.Index
+}
+
+// The caller must hold mu for each of the log helpers below
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+func (n *Node) termAt(i uint64) uint64 {
+	if i == n.snapshot.Index {
+		return n.snapshot.Term
+	}
+	if i < n.snapshot.Index || i > n.lastIndex() {
+		return 0
+	}
+	return n.entry(i).Term
+}
+
+func (n *Node) entry(i uint64) Entry {
+	return n.log[i-n.snapshot.Index-1]
+}
+
+func (n *Node) entriesFrom(i uint64, max int) []Entry {
+	entries := n.log[i-n.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) triggerApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) triggerReplication() {
+	select {
+	case n.replicateCh <- struct{}{}:
+	default:
+	}
+}
+
+func changeMembers(members []string, op, member string) []string {
+	changed := []string{}
+	for _, m := range members {
+		if m != member {
+			changed = append(changed, m)
+		}
+	}
+	if op == OpAddMember {
+		changed = append(changed, member)
+	}
+	return changed
+}
@@ -0,0 +1,347 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+)
+
+// memTransport delivers RPCs between nodes in the same process
+// and can disconnect nodes to simulate partitions
+type memTransport struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+type memCaller struct {
+	t    *memTransport
+	from string
+}
+
+func newMemTransport() *memTransport {
+	return &memTransport{nodes: make(map[string]*Node), down: make(map[string]bool)}
+}
+
+func (t *memTransport) setDown(id string, down bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down[id] = down
+}
+
+func (c *memCaller) Call(ctx context.Context, member, rpc string, req, resp interface{}) error {
+	c.t.mu.Lock()
+	n, ok := c.t.nodes[member]
+	down := c.t.down[member] || c.t.down[c.from]
+	c.t.mu.Unlock()
+	if !ok || down {
+		return errors.New("unreachable")
+	}
+
+	// round trip through json like the http transport
+	b, _ := json.Marshal(req)
+	var out interface{}
+	switch rpc {
+	case RPCVote:
+		var r VoteRequest
+		json.Unmarshal(b, &r)
+		out = n.HandleVote(r)
+	case RPCAppend:
+		var r AppendRequest
+		json.Unmarshal(b, &r)
+		out = n.HandleAppend(r)
+	case RPCSnapshot:
+		var r SnapshotRequest
+		json.Unmarshal(b, &r)
+		out = n.HandleSnapshot(r)
+	case RPCPropose:
+		var r ProposeRequest
+		json.Unmarshal(b, &r)
+		out = n.HandlePropose(r)
+	}
+	b, _ = json.Marshal(out)
+	return json.Unmarshal(b, resp)
+}
+
+func startNode(t *testing.T, tr *memTransport, id string, members []string, dir string, threshold int) *Node {
+	n, err := NewNode(Config{
+		ID:                id,
+		Members:           members,
+		DataDir:           dir,
+		Transport:         &memCaller{tr, id},
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		SnapshotThreshold: threshold,
+		ProposeTimeout:    2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewNode errored \n\n %v", err)
+	}
+
+	tr.mu.Lock()
+	tr.nodes[id] = n
+	tr.mu.Unlock()
+	n.Start()
+	return n
+}
+
+func startCluster(t *testing.T, size, threshold int) (*memTransport, []*Node) {
+	tr := newMemTransport()
+	var members []string
+	for i := 0; i < size; i++ {
+		members = append(members, fmt.Sprintf("node%v", i))
+	}
+
+	var nodes []*Node
+	for _, m := range members {
+		nodes = append(nodes, startNode(t, tr, m, members, "", threshold))
+	}
+	return tr, nodes
+}
+
+func stopAll(nodes []*Node) {
+	for _, n := range nodes {
+		n.Stop()
+	}
+}
+
+// waitForLeader returns the single leader among the connected nodes
+func waitForLeader(t *testing.T, tr *memTransport, nodes []*Node) *Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		for _, n := range nodes {
+			tr.mu.Lock()
+			down := tr.down[n.cfg.ID]
+			tr.mu.Unlock()
+			if !down && n.Status().State == Leader {
+				leaders = append(leaders, n)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Raft nodes did not elect a single leader within 5 seconds")
+	return nil
+}
+
+func waitForRecord(t *testing.T, n *Node, id string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := n.Get(id); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Raft node %v did not apply %v within 5 seconds", n.cfg.ID, id)
+}
+
+func TestElection(t *testing.T) {
+	tr, nodes := startCluster(t, 3, 0)
+	defer stopAll(nodes)
+
+	leader := waitForLeader(t, tr, nodes)
+
+	// followers learn of the leader from its first heartbeat
+	time.Sleep(5 * leader.cfg.HeartbeatInterval)
+	for _, n := range nodes {
+		if s := n.Status(); s.Leader != leader.cfg.ID || s.Term != leader.Status().Term {
+			t.Errorf("Raft node %v does not know the leader of the term. Status: %+v", n.cfg.ID, s)
+		}
+	}
+}
+
+func TestPutCommitsOnQuorum(t *testing.T) {
+	tr, nodes := startCluster(t, 3, 0)
+	defer stopAll(nodes)
+
+	leader := waitForLeader(t, tr, nodes)
+	var follower *Node
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+
+	// writes made to a follower are forwarded to the leader
+	if err := follower.Put(cache.Record{ID: "abc", Hash: "hash"}); err != nil {
+		t.Errorf("Put errored on a follower \n\n %v", err)
+	}
+	if _, ok := leader.Get("abc"); !ok {
+		t.Errorf("Put returned before the leader applied the record")
+	}
+	for _, n := range nodes {
+		waitForRecord(t, n, "abc")
+	}
+
+	// a write given up on before it's proposed isn't
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := leader.Status().LastIndex
+	if err := leader.PutContext(ctx, cache.Record{ID: "cancelled", Hash: "hash"}); err != context.Canceled {
+		t.Errorf("PutContext proposed a write given up on. Returned: %v", err)
+	}
+	if after := leader.Status().LastIndex; after != before {
+		t.Errorf("The write given up on was appended. Last index: %v then %v", before, after)
+	}
+
+	// without a quorum the write can not commit
+	for _, n := range nodes {
+		if n != leader {
+			tr.setDown(n.cfg.ID, true)
+		}
+	}
+	if err := leader.Put(cache.Record{ID: "def", Hash: "hash"}); err == nil {
+		t.Errorf("Put committed without a quorum")
+	}
+	if _, ok := leader.Get("def"); ok {
+		t.Errorf("Leader applied a record without a quorum")
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	tr, nodes := startCluster(t, 3, 0)
+	defer stopAll(nodes)
+
+	old := waitForLeader(t, tr, nodes)
+	tr.setDown(old.cfg.ID, true)
+
+	leader := waitForLeader(t, tr, nodes)
+	if leader == old {
+		t.Fatalf("Raft nodes did not elect a new leader")
+	}
+
+	if err := leader.Put(cache.Record{ID: "abc", Hash: "hash"}); err != nil {
+		t.Errorf("Put errored on the new leader \n\n %v", err)
+	}
+
+	tr.setDown(old.cfg.ID, false)
+	waitForRecord(t, old, "abc")
+	if s := old.Status(); s.State == Leader {
+		t.Errorf("Old leader did not step down after reconnecting")
+	}
+}
+
+func TestSnapshotAndMembership(t *testing.T) {
+	tr, nodes := startCluster(t, 3, 5)
+	defer stopAll(nodes)
+
+	leader := waitForLeader(t, tr, nodes)
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(cache.Record{ID: fmt.Sprintf("id%v", i), Hash: "hash"}); err != nil {
+			t.Fatalf("Put errored \n\n %v", err)
+		}
+	}
+
+	if s := leader.Status(); s.SnapshotIndex == 0 {
+		t.Errorf("Leader did not snapshot after passing the threshold. Status: %+v", s)
+	}
+
+	// a node joining with no members receives the snapshot
+	joined := startNode(t, tr, "node3", nil, "", 5)
+	defer joined.Stop()
+	if err := leader.AddMember("node3"); err != nil {
+		t.Fatalf("AddMember errored \n\n %v", err)
+	}
+
+	waitForRecord(t, joined, "id0")
+	waitForRecord(t, joined, "id19")
+	if m := joined.Members(); len(m) != 4 {
+		t.Errorf("Joined node did not receive the configuration. Members: %v", m)
+	}
+
+	if err := leader.RemoveMember("node3"); err != nil {
+		t.Errorf("RemoveMember errored \n\n %v", err)
+	}
+	if m := leader.Members(); len(m) != 3 {
+		t.Errorf("Leader did not remove the member. Members: %v", m)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("unable to create a data directory \n\n %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := newMemTransport()
+	n := startNode(t, tr, "node0", []string{"node0"}, dir, 3)
+	waitForLeader(t, tr, []*Node{n})
+	for i := 0; i < 5; i++ {
+		if err := n.Put(cache.Record{ID: fmt.Sprintf("id%v", i), Hash: "hash"}); err != nil {
+			t.Fatalf("Put errored \n\n %v", err)
+		}
+	}
+	n.Stop()
+
+	restarted := startNode(t, tr, "node0", nil, dir, 3)
+	defer restarted.Stop()
+	waitForLeader(t, tr, []*Node{restarted})
+
+	for i := 0; i < 5; i++ {
+		waitForRecord(t, restarted, fmt.Sprintf("id%v", i))
+	}
+}
+
+func TestPersistFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("unable to create a data directory \n\n %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// a file in place of the data directory makes every write fail
+	breakDir := func(d string) {
+		os.RemoveAll(d)
+		if err := ioutil.WriteFile(d, nil, 0600); err != nil {
+			t.Fatalf("unable to replace the data directory \n\n %v", err)
+		}
+	}
+
+	tr := newMemTransport()
+	n := startNode(t, tr, "node0", []string{"node0"}, filepath.Join(dir, "node0"), 0)
+	defer n.Stop()
+	waitForLeader(t, tr, []*Node{n})
+	last := n.Status().LastIndex
+
+	breakDir(filepath.Join(dir, "node0"))
+	if err := n.Put(cache.Record{ID: "unsaved", Hash: "hash"}); err == nil {
+		t.Errorf("Put did not error when the entry could not be persisted")
+	}
+	if _, ok := n.Get("unsaved"); ok {
+		t.Errorf("Leader applied an entry it could not persist")
+	}
+	if s := n.Status(); s.LastIndex != last || s.CommitIndex != last {
+		t.Errorf("Leader kept an entry it could not persist. Status: %+v", s)
+	}
+
+	candidate, err := NewNode(Config{
+		ID:              "node1",
+		Members:         []string{"node1"},
+		DataDir:         filepath.Join(dir, "node1"),
+		Transport:       &memCaller{tr, "node1"},
+		ElectionTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewNode errored \n\n %v", err)
+	}
+	breakDir(filepath.Join(dir, "node1"))
+	candidate.Start()
+	defer candidate.Stop()
+
+	time.Sleep(300 * time.Millisecond)
+	if s := candidate.Status(); s.State != Follower || s.Term != 0 {
+		t.Errorf("Node campaigned without persisting its vote. Status: %+v", s)
+	}
+}
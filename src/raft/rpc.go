@@ -0,0 +1,267 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/peer"
+)
+
+// RPCs members send each other
+const (
+	RPCVote     = "vote"
+	RPCAppend   = "append"
+	RPCSnapshot = "snapshot"
+	RPCPropose  = "propose"
+)
+
+// PathPrefix is the path the HTTP transport serves RPCs under,
+// e.g. "/raft/vote"
+const PathPrefix = "/raft/"
+
+// VoteRequest is sent by candidates asking for a vote
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+// VoteResponse is the reply to a VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest is sent by the leader to replicate entries and as a heartbeat
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse is the reply to an AppendRequest. When it is unsuccessful
+// ConflictIndex hints where the leader should retry from
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// SnapshotRequest is sent by the leader to members missing compacted entries
+type SnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// SnapshotResponse is the reply to a SnapshotRequest
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// ProposeRequest is a write forwarded to the leader
+type ProposeRequest struct {
+	Op     string       `json:"op"`
+	Record cache.Record `json:"record"`
+	Member string       `json:"member,omitempty"`
+}
+
+// ProposeResponse is the reply to a ProposeRequest
+type ProposeResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Transport sends an RPC to a member, decoding its reply into resp
+type Transport interface {
+	Call(ctx context.Context, member, rpc string, req, resp interface{}) error
+}
+
+// HTTPTransport sends RPCs as JSON posts to PathPrefix on each member's base url,
+// authenticated as a peer of the cluster
+type HTTPTransport struct {
+	Client *http.Client
+}
+
+// NewHTTPTransport returns a new reference to an HTTPTransport
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{&http.Client{Transport: &peer.Transport{}}}
+}
+
+// Call implements Transport
+func (t *HTTPTransport) Call(ctx context.Context, member, rpc string, req, resp interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, member+PathPrefix+rpc, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := t.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("raft: %v responded %v: %v", member, res.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// HandleVote handles a VoteRequest from a candidate
+func (n *Node) HandleVote(req VoteRequest) VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return VoteResponse{n.term, false}
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+	}
+
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		if err := n.persist(); err != nil {
+			log.Printf("Raft persisting state failed: %v", err)
+			return VoteResponse{n.term, false}
+		}
+		n.resetElectionDeadline()
+		return VoteResponse{n.term, true}
+	}
+	return VoteResponse{n.term, false}
+}
+
+// HandleAppend handles an AppendRequest from the leader
+func (n *Node) HandleAppend(req AppendRequest) AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}
+	}
+	n.becomeFollower(req.Term, req.Leader)
+	n.resetElectionDeadline()
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+
+	if req.PrevLogIndex > n.snapshot.Index && n.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		// hint the first index of the conflicting term, so the
+		// leader skips the whole term rather than an entry at a time
+		conflictTerm := n.termAt(req.PrevLogIndex)
+		i := req.PrevLogIndex
+		for i > n.snapshot.Index+1 && n.termAt(i-1) == conflictTerm {
+			i--
+		}
+		return AppendResponse{Term: n.term, ConflictIndex: i}
+	}
+
+	changed := false
+	for _, e := range req.Entries {
+		// entries already in the snapshot are committed and match
+		if e.Index <= n.snapshot.Index {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.truncate(e.Index)
+		}
+		n.appendEntries(e)
+		changed = true
+	}
+
+	if changed {
+		if err := n.persist(); err != nil {
+			log.Printf("Raft persisting state failed: %v", err)
+			return AppendResponse{Term: n.term}
+		}
+	}
+
+	// only what the leader has committed and this request verified can be committed
+	commit := req.LeaderCommit
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); last < commit {
+		commit = last
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.triggerApply()
+	}
+	return AppendResponse{Term: n.term, Success: true}
+}
+
+// HandleSnapshot handles a SnapshotRequest from the leader,
+// replacing the store with the snapshot
+func (n *Node) HandleSnapshot(req SnapshotRequest) SnapshotResponse {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return SnapshotResponse{n.term}
+	}
+	n.becomeFollower(req.Term, req.Leader)
+	n.resetElectionDeadline()
+
+	s := req.Snapshot
+	if s.Index <= n.lastApplied {
+		return SnapshotResponse{n.term}
+	}
+
+	// keep any entries after the snapshot if the log agrees with it
+	if s.Index < n.lastIndex() && n.termAt(s.Index) == s.Term {
+		n.log = append([]Entry(nil), n.log[s.Index-n.snapshot.Index:]...)
+	} else {
+		n.log = nil
+	}
+
+	n.cfg.Store.Replace(s.Records)
+	n.snapshot = s
+	n.members = n.configAt(n.lastIndex())
+	if s.Index > n.commitIndex {
+		n.commitIndex = s.Index
+	}
+	n.lastApplied = s.Index
+
+	if err := n.persistSnapshot(); err != nil {
+		log.Printf("Raft persisting snapshot failed: %v", err)
+	}
+	if err := n.persist(); err != nil {
+		log.Printf("Raft persisting state failed: %v", err)
+	}
+	return SnapshotResponse{n.term}
+}
+
+// HandlePropose handles a write forwarded by another member
+func (n *Node) HandlePropose(req ProposeRequest) ProposeResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ProposeTimeout)
+	defer cancel()
+
+	if err := n.propose(ctx, req); err != nil {
+		return ProposeResponse{err.Error()}
+	}
+	return ProposeResponse{}
+}
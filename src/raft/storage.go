@@ -0,0 +1,157 @@
+package raft
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+)
+
+const (
+	stateFile    = "state.json"
+	snapshotFile = "snapshot.json"
+)
+
+// Snapshot is the state of the store at a log index,
+// replacing every entry up to and including it
+type Snapshot struct {
+	Index   uint64         `json:"index"`
+	Term    uint64         `json:"term"`
+	Members []string       `json:"members"`
+	Records []cache.Record `json:"records"`
+}
+
+// state is what must survive a restart besides the snapshot
+type state struct {
+	Term     uint64  `json:"term"`
+	VotedFor string  `json:"voted_for"`
+	Log      []Entry `json:"log"`
+}
+
+// persist writes the term, vote and log to the data directory
+// The caller must hold mu
+func (n *Node) persist() error {
+	if n.cfg.DataDir == "" {
+		return nil
+	}
+	return writeJSON(filepath.Join(n.cfg.DataDir, stateFile), state{n.term, n.votedFor, n.log})
+}
+
+// persistSnapshot writes the snapshot to the data directory
+// The caller must hold mu
+func (n *Node) persistSnapshot() error {
+	if n.cfg.DataDir == "" {
+		return nil
+	}
+	return writeJSON(filepath.Join(n.cfg.DataDir, snapshotFile), n.snapshot)
+}
+
+// restore loads the snapshot and state persisted in the data directory
+func (n *Node) restore() error {
+	if n.cfg.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(n.cfg.DataDir, 0700); err != nil {
+		return err
+	}
+
+	var snap Snapshot
+	ok, err := readJSON(filepath.Join(n.cfg.DataDir, snapshotFile), &snap)
+	if err != nil {
+		return err
+	}
+	if ok {
+		n.cfg.Store.Replace(snap.Records)
+		n.snapshot = snap
+		n.commitIndex = snap.Index
+		n.lastApplied = snap.Index
+	}
+
+	var st state
+	ok, err = readJSON(filepath.Join(n.cfg.DataDir, stateFile), &st)
+	if err != nil {
+		return err
+	}
+	if ok {
+		n.term = st.Term
+		n.votedFor = st.VotedFor
+		// a snapshot written just before a crash may cover the start of the log
+		for _, e := range st.Log {
+			if e.Index > n.snapshot.Index {
+				n.log = append(n.log, e)
+			}
+		}
+	}
+
+	n.members = n.configAt(n.lastIndex())
+	log.Printf("Raft node %v restored term %v, snapshot %v and %v log entries", n.cfg.ID, n.term, n.snapshot.Index, len(n.log))
+	return nil
+}
+
+// takeSnapshot replaces the applied entries of the log with a snapshot of the store
+// The caller must hold applyMu
+func (n *Node) takeSnapshot() {
+	n.mu.Lock()
+	snap := Snapshot{
+		Index:   n.lastApplied,
+		Term:    n.termAt(n.lastApplied),
+		Members: n.configAt(n.lastApplied),
+	}
+	n.mu.Unlock()
+
+	// the store only changes while holding applyMu, so it matches the index
+	snap.Records = []cache.Record{}
+	n.cfg.Store.Range(func(r cache.Record) bool {
+		snap.Records = append(snap.Records, r)
+		return true
+	})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log = append([]Entry(nil), n.log[snap.Index-n.snapshot.Index:]...)
+	n.snapshot = snap
+
+	if err := n.persistSnapshot(); err != nil {
+		log.Printf("Raft persisting snapshot failed: %v", err)
+	}
+	if err := n.persist(); err != nil {
+		log.Printf("Raft persisting state failed: %v", err)
+	}
+}
+
+// writeJSON atomically replaces the file with v encoded as JSON
+func writeJSON(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJSON decodes the file into v, returning false if it doesn't exist
+func readJSON(path string, v interface{}) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return true, json.NewDecoder(f).Decode(v)
+}
@@ -0,0 +1,288 @@
+/*
+Package ratelimit limits the rate of requests each client makes with token buckets.
+
+	A rule limits the requests to the paths under a prefix, optionally only
+	those of a method, to a rate per second with bursts of up to a number of
+	requests. Each client gets a bucket per rule holding up to the burst in
+	tokens, refilled at the rate, and a request is allowed while it can take
+	a token. Clients are told apart by ip or by a header such as an API key.
+	Buckets left idle until full are evicted, being the same as no bucket.
+*/
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+	"github.com/caoakleyii/cloud-jumper/src/proxy"
+)
+
+// IP keys clients by their ip, resolved through trusted proxies
+const IP = "ip"
+
+// HeaderKey prefixes the name of a header clients are keyed by, e.g. header:X-API-Key.
+// Requests without the header are keyed by ip
+const HeaderKey = "header:"
+
+// sweepInterval is how often idle buckets are evicted
+const sweepInterval = time.Minute
+
+// maxBuckets is the most buckets a rule holds for clients. Once it's reached,
+// clients it holds no bucket for share an overflow bucket, so clients changing
+// their ip or header value each request can't add buckets without bound
+const maxBuckets = 10000
+
+// overflow keys the bucket clients share once a rule holds maxBuckets
+const overflow = "overflow"
+
+// Rule limits the requests to its target
+type Rule struct {
+	pathrule.Target
+	// Rate is the requests per second refilled
+	Rate float64
+	// Burst is the most requests allowed at once
+	Burst int
+}
+
+// ParseRule parses a rule written [METHOD ]/prefix=rate:burst, e.g. POST /hash=0.5:10
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	target, limit, err := pathrule.Parse(s, "rate:burst")
+	if err != nil {
+		return r, fmt.Errorf("rate limit %q %v", s, err)
+	}
+	r.Target = target
+
+	rate, burst, _ := strings.Cut(limit, ":")
+	if r.Rate, err = strconv.ParseFloat(rate, 64); err != nil || r.Rate <= 0 || math.IsInf(r.Rate, 0) {
+		return r, fmt.Errorf("rate limit %q must have a positive rate", s)
+	}
+	if r.Burst, err = strconv.Atoi(burst); err != nil || r.Burst < 1 {
+		return r, fmt.Errorf("rate limit %q must have a burst of at least 1", s)
+	}
+	return r, nil
+}
+
+// String returns the rule as parsed by ParseRule
+func (r Rule) String() string {
+	return fmt.Sprintf("%v=%v:%v", r.Target, strconv.FormatFloat(r.Rate, 'f', -1, 64), r.Burst)
+}
+
+// window returns how long an empty bucket takes to refill
+func (r Rule) window() time.Duration {
+	return time.Duration(float64(r.Burst) / r.Rate * float64(time.Second))
+}
+
+// Config configures a Limiter
+type Config struct {
+	// Rules are checked in order, the first matching a request limits it
+	Rules []string
+	// Key is IP or HeaderKey followed by a header name
+	Key string
+}
+
+// Decision is the outcome of checking a request against its rule
+type Decision struct {
+	Allowed bool
+	Rule    Rule
+	// Remaining are the requests the client may still make at once
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until a request is allowed again, zero when this one is
+	RetryAfter time.Duration
+}
+
+// Headers sets the RateLimit and, when denied, Retry-After headers describing the decision
+func (d Decision) Headers(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Rule.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(d.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%v;w=%v", d.Rule.Burst, seconds(d.Rule.window())))
+	if !d.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	}
+}
+
+// seconds rounds the duration up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Limiter checks requests against the rules, keeping a bucket per rule and client
+type Limiter struct {
+	mu        sync.Mutex
+	key       string
+	limits    []*limit
+	lastSweep time.Time
+	// now is replaced by tests
+	now func() time.Time
+}
+
+type limit struct {
+	rule    Rule
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a new reference to a Limiter
+func New(cfg Config) (*Limiter, error) {
+	l := &Limiter{now: time.Now}
+	apply, err := l.Prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	return l, nil
+}
+
+// Validate returns an error when a rule or the key is invalid
+func Validate(cfg Config) error {
+	_, err := parse(cfg)
+	return err
+}
+
+func parse(cfg Config) ([]Rule, error) {
+	if cfg.Key != IP && (!strings.HasPrefix(cfg.Key, HeaderKey) || len(cfg.Key) == len(HeaderKey)) {
+		return nil, fmt.Errorf("rate limit key must be %v or %vName, got %q", IP, HeaderKey, cfg.Key)
+	}
+	rules := make([]Rule, 0, len(cfg.Rules))
+	for _, s := range cfg.Rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Prepare parses the config, returning a func that switches the Limiter to it.
+// The buckets of rules left unchanged are kept while the key is
+func (l *Limiter) Prepare(cfg Config) (func(), error) {
+	rules, err := parse(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		kept := make(map[Rule]*limit)
+		if cfg.Key == l.key {
+			for _, lim := range l.limits {
+				kept[lim.rule] = lim
+			}
+		}
+		limits := make([]*limit, len(rules))
+		for i, r := range rules {
+			if limits[i] = kept[r]; limits[i] == nil {
+				limits[i] = &limit{rule: r, buckets: make(map[string]*bucket)}
+			}
+		}
+		l.key, l.limits = cfg.Key, limits
+	}, nil
+}
+
+// Allow takes a token from the bucket of the request's client for the first rule
+// matching it, returning the decision and whether any rule matched
+func (l *Limiter) Allow(r *http.Request) (Decision, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lim *limit
+	for _, candidate := range l.limits {
+		if candidate.rule.Matches(r) {
+			lim = candidate
+			break
+		}
+	}
+	if lim == nil {
+		return Decision{}, false
+	}
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	rule := lim.rule
+	key := l.client(lim, r)
+	b := lim.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(rule.Burst), last: now}
+		lim.buckets[key] = b
+	}
+	b.refill(rule, now)
+
+	d := Decision{Rule: rule}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = time.Duration((float64(rule.Burst) - b.tokens) / rule.Rate * float64(time.Second))
+	return d, true
+}
+
+// client returns the key of the request's bucket for the limit. A client
+// sending the header is keyed by it, or by its ip if that has a bucket once
+// the limit is full, and clients the full limit has no bucket for overflow
+func (l *Limiter) client(lim *limit, r *http.Request) string {
+	ip := "ip:" + proxy.RealIP(r)
+	key := ip
+	if name := strings.TrimPrefix(l.key, HeaderKey); name != l.key {
+		if v := r.Header.Get(name); v != "" {
+			key = "header:" + v
+		}
+	}
+
+	if _, ok := lim.buckets[key]; ok || len(lim.buckets) < maxBuckets {
+		return key
+	}
+	if _, ok := lim.buckets[ip]; ok {
+		return ip
+	}
+	return overflow
+}
+
+// sweep evicts the buckets refilled since they were last used
+func (l *Limiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for _, lim := range l.limits {
+		for key, b := range lim.buckets {
+			if now.Sub(b.last) >= lim.rule.window() {
+				delete(lim.buckets, key)
+			}
+		}
+	}
+}
+
+// Len returns the number of buckets kept
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, lim := range l.limits {
+		n += len(lim.buckets)
+	}
+	return n
+}
+
+func (b *bucket) refill(r Rule, now time.Time) {
+	b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+	b.last = now
+}
@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/pathrule"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Rule
+		err      string
+	}{
+		{"POST /hash=0.5:10", Rule{pathrule.Target{Method: "POST", Prefix: "/hash"}, 0.5, 10}, ""},
+		{"get /stats/=100:200", Rule{pathrule.Target{Method: "GET", Prefix: "/stats"}, 100, 200}, ""},
+		{"/=10:1", Rule{pathrule.Target{}, 10, 1}, ""},
+		{"POST /Hash=1:1", Rule{pathrule.Target{Method: "POST", Prefix: "/hash"}, 1, 1}, ""},
+		{"/hash", Rule{}, "is not"},
+		{"POST hash=1:1", Rule{}, "no /prefix"},
+		{"/hash=0:1", Rule{}, "positive rate"},
+		{"/hash=1", Rule{}, "burst of at least 1"},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRule(test.s)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: ParseRule did not error with %q. Errored: %v", test.s, test.err, err)
+			}
+			continue
+		}
+		if err != nil || r != test.expected {
+			t.Errorf("%q: ParseRule returned %+v %v, expected %+v", test.s, r, err, test.expected)
+		}
+		if again, _ := ParseRule(r.String()); again != r {
+			t.Errorf("%q: String did not round trip. Returned: %q", test.s, r.String())
+		}
+	}
+}
+
+// request returns a request from the ip with the headers given as name, value pairs
+func request(method, path, ip string, headers ...string) *http.Request {
+	r, _ := http.NewRequest(method, "http://localhost"+path, nil)
+	r.RemoteAddr = ip + ":1234"
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func TestAllow(t *testing.T) {
+	l, err := New(Config{Rules: []string{"POST /hash=1:2", "/=100:100"}, Key: IP})
+	if err != nil {
+		t.Fatalf("New errored \n\n %v", err)
+	}
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+
+	for i, expected := range []bool{true, true, false} {
+		d, limited := l.Allow(request("POST", "/hash", "192.0.2.1"))
+		if !limited || d.Allowed != expected || d.Rule.Prefix != "/hash" {
+			t.Errorf("request %v: Allow returned %+v, expected allowed %v", i, d, expected)
+		}
+	}
+
+	d, _ := l.Allow(request("POST", "/hash", "192.0.2.1"))
+	if d.Remaining != 0 || d.RetryAfter != time.Second || d.Reset != 2*time.Second {
+		t.Errorf("Allow did not say when to retry. Returned: %+v", d)
+	}
+
+	// other clients and rules have their own buckets
+	if d, _ := l.Allow(request("POST", "/hash", "192.0.2.2")); !d.Allowed {
+		t.Errorf("Allow denied another client")
+	}
+	if d, _ := l.Allow(request("GET", "/hash/abc", "192.0.2.1")); !d.Allowed || d.Rule.Prefix != "" {
+		t.Errorf("Allow did not apply the next matching rule. Returned: %+v", d)
+	}
+
+	now = now.Add(time.Second)
+	if d, _ := l.Allow(request("POST", "/hash", "192.0.2.1")); !d.Allowed {
+		t.Errorf("Allow did not refill the bucket")
+	}
+
+	// buckets full again are evicted
+	now = now.Add(sweepInterval)
+	l.Allow(request("POST", "/hash", "192.0.2.3"))
+	if n := l.Len(); n != 1 {
+		t.Errorf("Idle buckets were not evicted. Buckets: %v", n)
+	}
+}
+
+func TestAllowUnmatched(t *testing.T) {
+	l, _ := New(Config{Rules: []string{"POST /hash=1:1"}, Key: IP})
+	for _, path := range []string{"/hashes", "/stats"} {
+		if _, limited := l.Allow(request("POST", path, "192.0.2.1")); limited {
+			t.Errorf("%v: Allow limited a request no rule matches", path)
+		}
+	}
+	if _, limited := l.Allow(request("GET", "/hash", "192.0.2.1")); limited {
+		t.Errorf("Allow limited a request of another method")
+	}
+	// the router matches paths whatever their case
+	if _, limited := l.Allow(request("POST", "/HASH", "192.0.2.1")); !limited {
+		t.Errorf("Allow did not limit a request to the path in upper case")
+	}
+}
+
+func TestAllowHeaderKey(t *testing.T) {
+	l, _ := New(Config{Rules: []string{"/=1:1"}, Key: HeaderKey + "X-API-Key"})
+
+	l.Allow(request("GET", "/", "192.0.2.1", "X-API-Key", "a"))
+	if d, _ := l.Allow(request("GET", "/", "192.0.2.2", "X-API-Key", "a")); d.Allowed {
+		t.Errorf("Allow did not key clients by the header")
+	}
+	if d, _ := l.Allow(request("GET", "/", "192.0.2.1", "X-API-Key", "b")); !d.Allowed {
+		t.Errorf("Allow denied another key from the same ip")
+	}
+	// without the header the ip is the key
+	if d, _ := l.Allow(request("GET", "/", "192.0.2.1")); !d.Allowed {
+		t.Errorf("Allow denied a client without the header")
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	l, _ := New(Config{Rules: []string{"/hash=1:1", "/stats=1:1"}, Key: IP})
+	l.Allow(request("GET", "/hash", "192.0.2.1"))
+	l.Allow(request("GET", "/stats", "192.0.2.1"))
+
+	if _, err := l.Prepare(Config{Rules: []string{"/hash=1:1"}, Key: "api-key"}); err == nil {
+		t.Errorf("Prepare accepted an invalid key")
+	}
+
+	apply, err := l.Prepare(Config{Rules: []string{"/hash=1:1", "/stats=2:2"}, Key: IP})
+	if err != nil {
+		t.Fatalf("Prepare errored \n\n %v", err)
+	}
+	apply()
+	if d, _ := l.Allow(request("GET", "/hash", "192.0.2.1")); d.Allowed {
+		t.Errorf("Prepare dropped the buckets of an unchanged rule")
+	}
+	if d, _ := l.Allow(request("GET", "/stats", "192.0.2.1")); !d.Allowed || d.Rule.Burst != 2 {
+		t.Errorf("Prepare did not apply the changed rule. Returned: %+v", d)
+	}
+}
+
+func TestAllowCap(t *testing.T) {
+	for _, key := range []string{IP, HeaderKey + "X-API-Key"} {
+		l, _ := New(Config{Rules: []string{"/=1:1"}, Key: key})
+		// a client changing its ip, or its key too, each request
+		client := func(i int) *http.Request {
+			ip := fmt.Sprintf("10.%v.%v.%v", i>>16&255, i>>8&255, i&255)
+			return request("GET", "/", ip, "X-API-Key", strconv.Itoa(i))
+		}
+
+		for i := 0; i < maxBuckets; i++ {
+			l.Allow(client(i))
+		}
+		if d, _ := l.Allow(client(0)); d.Allowed {
+			t.Errorf("%v: Allow did not keep the bucket of a known client", key)
+		}
+		// new clients past the cap share a bucket
+		if d, _ := l.Allow(client(maxBuckets)); !d.Allowed {
+			t.Errorf("%v: Allow denied the first client past the cap", key)
+		}
+		if d, _ := l.Allow(client(maxBuckets + 1)); d.Allowed {
+			t.Errorf("%v: Allow gave a new client past the cap its own bucket", key)
+		}
+		if n := l.Len(); n != maxBuckets+1 {
+			t.Errorf("%v: Buckets were added past the cap. Buckets: %v", key, n)
+		}
+	}
+}
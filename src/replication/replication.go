@@ -0,0 +1,246 @@
+/*
+Package replication implements primary/follower replication of the password store.
+
+	A follower streams the change log of its primary over HTTP from
+	the last offset it applied, so a dropped connection resumes where it
+	left off. One behind the changes the primary keeps starts over from a
+	snapshot. Followers only serve reads and can be promoted to primary.
+*/
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/peer"
+)
+
+// Roles an instance can have
+const (
+	Primary  = "primary"
+	Follower = "follower"
+)
+
+// LogPath is the path the primary serves its change log on, on its peer listener
+const LogPath = "/replication/log"
+
+// SnapshotHeader holds the offset a snapshot of every record is as of,
+// sent in place of changes a follower is too far behind to read
+const SnapshotHeader = "X-Replication-Snapshot"
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// ErrNotFollower is returned when promoting an instance that is already primary
+var ErrNotFollower = errors.New("replication: instance is not a follower")
+
+// Status describes the replication state of the instance
+type Status struct {
+	Role    string `json:"role"`
+	Primary string `json:"primary,omitempty"`
+	Offset  uint64 `json:"offset"`
+}
+
+// Replica applies the change log of a primary to a store
+type Replica struct {
+	Primary string
+	Store   *cache.Store
+	Client  *http.Client
+
+	offset uint64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReplica returns a new reference to a Replica of the base url of the
+// primary's peer listener provided, applying changes to s
+func NewReplica(primary string, s *cache.Store) *Replica {
+	return &Replica{
+		Primary: strings.TrimRight(primary, "/"),
+		Store:   s,
+		Client:  &http.Client{Transport: &peer.Transport{}},
+	}
+}
+
+// Offset returns the offset of the last change applied from the primary
+func (r *Replica) Offset() uint64 {
+	return atomic.LoadUint64(&r.offset)
+}
+
+// Start begins streaming the primary's change log on a separate goroutine,
+// reconnecting from the last applied offset until stopped. A replica yet to
+// apply any change empties the store first, as the log replays every record
+func (r *Replica) Start() {
+	if r.Offset() == 0 {
+		r.Store.Replace(nil)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		backoff := minBackoff
+		for {
+			err := r.pull(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err == nil {
+				backoff = minBackoff
+				continue
+			}
+
+			log.Printf("Replication from %v failed at offset %v: %v", r.Primary, r.Offset(), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}()
+}
+
+// Stop ends the stream and waits for the change being applied to finish
+func (r *Replica) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+// pull makes a single request for the change log after the current offset
+// and applies changes until the primary ends the stream
+func (r *Replica) pull(ctx context.Context) error {
+	url := fmt.Sprintf("%v%v?offset=%v", r.Primary, LogPath, r.Offset())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("primary responded %v: %v", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if at := resp.Header.Get(SnapshotHeader); at != "" {
+		return r.restore(resp.Body, at)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var c cache.Change
+		if err := dec.Decode(&c); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if c.Offset != r.Offset()+1 {
+			return fmt.Errorf("expected offset %v, received %v", r.Offset()+1, c.Offset)
+		}
+
+		r.Store.Apply(c)
+		atomic.StoreUint64(&r.offset, c.Offset)
+	}
+}
+
+// restore replaces the store with the snapshot the primary sent
+// as of the offset provided, once it has been read whole
+func (r *Replica) restore(body io.Reader, at string) error {
+	offset, err := strconv.ParseUint(at, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot offset %q", at)
+	}
+
+	var records []cache.Record
+	dec := json.NewDecoder(body)
+	for {
+		var rec cache.Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		records = append(records, rec)
+	}
+
+	r.Store.Replace(records)
+	atomic.StoreUint64(&r.offset, offset)
+	log.Printf("Restored a snapshot of %v records at offset %v from %v", len(records), offset, r.Primary)
+	return nil
+}
+
+var (
+	mu      sync.Mutex
+	replica *Replica
+)
+
+// Follow starts this instance as a follower of the primary
+// replicating into the store provided
+func Follow(primary string, s *cache.Store) {
+	mu.Lock()
+	defer mu.Unlock()
+	if replica != nil {
+		replica.Stop()
+	}
+	replica = NewReplica(primary, s)
+	replica.Start()
+	log.Printf("Following primary %v", replica.Primary)
+}
+
+// Promote stops following the primary, making this instance a primary
+// Returns the last offset applied from the old primary
+func Promote() (uint64, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if replica == nil {
+		return 0, ErrNotFollower
+	}
+	replica.Stop()
+	offset := replica.Offset()
+	log.Printf("Promoted to primary at offset %v of %v", offset, replica.Primary)
+	replica = nil
+	return offset, nil
+}
+
+// IsFollower reports whether this instance is a read only follower
+func IsFollower() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return replica != nil
+}
+
+// CurrentStatus returns the replication status of this instance,
+// primary offsets are of the store provided
+func CurrentStatus(s *cache.Store) Status {
+	mu.Lock()
+	defer mu.Unlock()
+	if replica != nil {
+		return Status{Follower, replica.Primary, replica.Offset()}
+	}
+	return Status{Role: Primary, Offset: s.Offset()}
+}
@@ -0,0 +1,91 @@
+/*
+Package requestid correlates a request with the log lines, background jobs
+and outbound calls it causes.
+
+	Every request is given an id, the one it was sent with in the X-Request-ID
+	header or a generated one, carried on its context. Log lines written with
+	Printf include the id, and requests sent through a Transport pass it on.
+*/
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// Header carries the id of a request, from the client and back in the response
+const Header = "X-Request-ID"
+
+// maxLength is the longest id accepted from a client
+const maxLength = 128
+
+type key struct{}
+
+// New returns a random id
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether an id sent by a client is safe to log and pass on,
+// short and only letters, digits and -_.:+/=
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// With returns a copy of the context carrying the id
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// From returns the id the context carries, or an empty string
+func From(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
+
+// Printf logs like log.Printf, followed by the id the context carries
+func Printf(ctx context.Context, format string, v ...interface{}) {
+	if id := From(ctx); id != "" {
+		format += " request_id=%v"
+		v = append(v, id)
+	}
+	log.Printf(format, v...)
+}
+
+// Transport is an http.RoundTripper sending the id carried by each request's
+// context in its header, unless it already has one
+type Transport struct {
+	// Base sends the requests, by default http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if id := From(req.Context()); id != "" && req.Header.Get(Header) == "" {
+		// a RoundTripper must not modify the request it's given
+		req = req.Clone(req.Context())
+		req.Header.Set(Header, id)
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,539 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/proxy"
+)
+
+// ServersOrder is the order the servers are shut down in, relative to stop hooks.
+// Stop hooks with a lower order run while the servers are still serving,
+// those with a higher order after every server has shut down
+const ServersOrder = 0
+
+// Hook is a func run when an App starts or stops
+type Hook struct {
+	Name string
+	// Order sorts the hooks, lowest first, hooks with the same order
+	// run in the order they were registered
+	Order int
+	// Timeout bounds the hook's context, when zero it only has the
+	// App's shutdown timeout
+	Timeout time.Duration
+	Fn      func(context.Context) error
+}
+
+// unreadGrace is how long a shutdown waits for accepted connections to send a request,
+// those that have sent nothing by then are closed without a response
+const unreadGrace = time.Second
+
+type service struct {
+	server   *http.Server
+	cfg      Listener
+	listener net.Listener
+	// served is closed once the server has stopped serving on the listener
+	served chan struct{}
+}
+
+// unread tracks the connections a server has accepted but not yet read a request from,
+// net/http closes rather than serves them once it is shutting down
+type unread struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// track implements the http.Server ConnState func
+func (u *unread) track(c net.Conn, state http.ConnState) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if state == http.StateNew {
+		u.conns[c] = struct{}{}
+	} else {
+		delete(u.conns, c)
+	}
+}
+
+// wait waits until every connection has been read, for at most grace
+func (u *unread) wait(ctx context.Context, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		u.mu.Lock()
+		n := len(u.conns)
+		u.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// App owns the servers of the process and the signal handling and hooks
+// around starting and stopping them. Apps are independent of each other,
+// so any number can run in the same process
+type App struct {
+	// ShutdownTimeout bounds how long the servers and stop hooks have to finish
+	ShutdownTimeout time.Duration
+	// Signals trigger a shutdown, by default interrupt and terminate
+	Signals []os.Signal
+	// Alive checks the process is working before every systemd watchdog
+	// notification, when it fails the notification is skipped
+	Alive func(context.Context) error
+	// Upgradable checks the state of the process can be handed to a new
+	// one, when it fails Upgrade returns its error without starting one
+	Upgradable func() error
+
+	mu       sync.Mutex
+	services []service
+	unread   map[*http.Server]*unread
+	handlers map[os.Signal]func()
+	starts   []Hook
+	stops    []Hook
+	trigger  chan struct{}
+	once     sync.Once
+	done     chan struct{}
+
+	upgrading bool
+	upgraded  bool
+}
+
+// NewApp returns a new reference to an App
+func NewApp(shutdownTimeout time.Duration) *App {
+	return &App{
+		ShutdownTimeout: shutdownTimeout,
+		Signals:         []os.Signal{os.Interrupt, syscall.SIGTERM},
+		handlers:        make(map[os.Signal]func()),
+		unread:          make(map[*http.Server]*unread),
+		trigger:         make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// Serve registers the server to be run by the App on the listener provided,
+// or when the listener is nil on one opened for the server's address
+func (a *App) Serve(s *http.Server, l net.Listener) {
+	if l == nil {
+		a.Listen(s, Listener{Addr: s.Addr})
+		return
+	}
+
+	addr := l.Addr().String()
+	if l.Addr().Network() == "unix" {
+		addr = unixPrefix + addr
+	}
+	a.add(service{server: s, cfg: Listener{Addr: addr}, listener: l})
+}
+
+// Listen registers the server to be run by the App on a listener opened as configured,
+// a server registered more than once serves on every one of its listeners
+func (a *App) Listen(s *http.Server, cfg Listener) {
+	a.add(service{server: s, cfg: cfg})
+}
+
+func (a *App) add(s service) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s.served = make(chan struct{})
+	a.services = append(a.services, s)
+	if a.unread[s.server] == nil {
+		a.unread[s.server] = &unread{conns: make(map[net.Conn]struct{})}
+	}
+}
+
+// Handle registers fn to be called whenever the signal is received while serving,
+// e.g. to reload the configuration on a hang up
+func (a *App) Handle(sig os.Signal, fn func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handlers[sig] = fn
+}
+
+// OnStart registers a hook run before the servers start, what it
+// starts is stopped by the stop hook of the same name
+func (a *App) OnStart(h Hook) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.starts = append(a.starts, h)
+}
+
+// OnStop registers a hook run when the App shuts down
+func (a *App) OnStop(h Hook) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stops = append(a.stops, h)
+}
+
+// Shutdown triggers a graceful shutdown of the App, it returns
+// straight away, Done is closed once the shutdown has completed
+func (a *App) Shutdown() {
+	a.once.Do(func() { close(a.trigger) })
+}
+
+// Done returns a channel closed once the App has shut down
+func (a *App) Done() <-chan struct{} {
+	return a.done
+}
+
+// Upgraded reports whether a new process has taken over the App's listeners
+func (a *App) Upgraded() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.upgraded
+}
+
+// Addrs returns the addresses the App's servers are listening on
+func (a *App) Addrs() []net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var addrs []net.Addr
+	for _, s := range a.services {
+		if s.listener != nil {
+			addrs = append(addrs, s.listener.Addr())
+		}
+	}
+	return addrs
+}
+
+// Run runs the start hooks, serves every server until a signal or
+// Shutdown triggers a shutdown, then shuts the servers down
+// gracefully and runs the stop hooks. If a start hook or
+// listener fails, Run runs the stop hooks of the start hooks
+// that ran and returns its error without serving
+func (a *App) Run() error {
+	defer close(a.done)
+
+	a.mu.Lock()
+	starts := sortHooks(a.starts)
+	stops := sortHooks(a.stops)
+	a.mu.Unlock()
+
+	var started []Hook
+	for _, h := range starts {
+		if err := runHook(context.Background(), h); err != nil {
+			return errors.Join(fmt.Errorf("start hook %v: %w", h.Name, err), a.unwind(stops, started))
+		}
+		started = append(started, h)
+	}
+
+	if err := a.listen(); err != nil {
+		return errors.Join(err, a.unwind(stops, started))
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, a.Signals...)
+	defer signal.Stop(c)
+
+	a.mu.Lock()
+	handled := make(chan os.Signal, 1)
+	for sig := range a.handlers {
+		signal.Notify(handled, sig)
+	}
+	a.mu.Unlock()
+	defer signal.Stop(handled)
+	go a.handle(handled)
+
+	a.mu.Lock()
+	// Serve sets an empty TLSConfig on plain servers, so which servers
+	// serve TLS is decided before any of them starts serving
+	secure := make(map[*http.Server]*tls.Config)
+	for srv, u := range a.unread {
+		// requests carry the trigger so the shutdown handler stops this App
+		base := srv.BaseContext
+		srv.BaseContext = func(l net.Listener) context.Context {
+			ctx := context.Background()
+			if base != nil {
+				ctx = base(l)
+			}
+			return handler.WithShutdown(ctx, a.Shutdown)
+		}
+
+		connState, track := srv.ConnState, u.track
+		srv.ConnState = func(c net.Conn, state http.ConnState) {
+			track(c, state)
+			if connState != nil {
+				connState(c, state)
+			}
+		}
+		if srv.TLSConfig != nil {
+			srv.TLSConfig = tlsConfig(srv)
+			secure[srv] = srv.TLSConfig
+		}
+	}
+
+	errs := make(chan error, len(a.services))
+	for _, s := range a.services {
+		// the plain listener is kept so it can be passed on in an upgrade
+		l := s.listener
+		if s.cfg.ProxyProtocol {
+			l = proxy.NewListener(l)
+		}
+		if cfg := secure[s.server]; cfg != nil {
+			l = tls.NewListener(l, cfg)
+		}
+
+		go func(s service) {
+			defer close(s.served)
+			log.Printf("Sever Started on %v", l.Addr())
+			// the listener is closed before shutting down, see stop
+			err := s.server.Serve(l)
+			if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+				errs <- fmt.Errorf("server %v: %w", l.Addr(), err)
+			}
+		}(s)
+	}
+	a.mu.Unlock()
+
+	if err := ready(); err != nil {
+		log.Printf("Unable to signal the parent process this one is ready: %v", err)
+	}
+	// after an upgrade this is the service's main process
+	if err := notify(fmt.Sprintf("READY=1\nMAINPID=%v", os.Getpid())); err != nil {
+		log.Printf("Unable to notify systemd this process is ready: %v", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		watching, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		go a.watchdog(watching, interval)
+	}
+
+	var err error
+	select {
+	case sig := <-c:
+		log.Printf("Received %v, shutting down", sig)
+	case <-a.trigger:
+		log.Printf("Shutdown triggered")
+	case err = <-errs:
+		log.Printf("Shutting down: %v", err)
+	}
+
+	return errors.Join(err, a.stop(stops))
+}
+
+// handle calls the handler of every signal received until the App is done
+func (a *App) handle(c chan os.Signal) {
+	for {
+		select {
+		case sig := <-c:
+			a.mu.Lock()
+			fn := a.handlers[sig]
+			a.mu.Unlock()
+			if fn != nil {
+				fn()
+			}
+		case <-a.trigger:
+			return
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// listen opens a listener for every server that wasn't given one, using the
+// listener passed by a parent process in an upgrade or the socket passed by systemd
+// bound to the server's address when there is one, and closes those opened if any fails
+func (a *App) listen() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	inherited, err := inherit()
+	if err != nil {
+		return err
+	}
+	sockets, err := activated(firstFD)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, l := range inherited {
+			l.Close()
+		}
+		for _, l := range sockets {
+			log.Printf("Closing the socket on %v passed by systemd, no server listens on it", l.Addr())
+			l.Close()
+		}
+	}()
+
+	for i, s := range a.services {
+		if s.listener != nil {
+			continue
+		}
+
+		if l, ok := inherited[s.cfg.Addr]; ok {
+			delete(inherited, s.cfg.Addr)
+			a.services[i].listener = l
+			continue
+		}
+
+		if j := matching(sockets, s.cfg.Addr); j >= 0 {
+			a.services[i].listener = sockets[j]
+			sockets = append(sockets[:j], sockets[j+1:]...)
+			continue
+		}
+
+		l, err := open(s.cfg)
+		if err != nil {
+			for _, opened := range a.services[:i] {
+				opened.listener.Close()
+			}
+			return fmt.Errorf("listen on %v: %w", s.cfg.Addr, err)
+		}
+		a.services[i].listener = l
+	}
+	return nil
+}
+
+// matching returns the index of the listener bound to the address, or -1
+func matching(listeners []net.Listener, addr string) int {
+	for i, l := range listeners {
+		if bound(addr, l.Addr()) {
+			return i
+		}
+	}
+	return -1
+}
+
+// stop runs the stop hooks, shutting the servers down between
+// those ordered before them and those ordered after
+func (a *App) stop(stops []Hook) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+	defer cancel()
+
+	// the service keeps running in the new process after an upgrade
+	if !a.Upgraded() {
+		if err := notify("STOPPING=1"); err != nil {
+			log.Printf("Unable to notify systemd this process is stopping: %v", err)
+		}
+	}
+
+	a.mu.Lock()
+	services := append([]service(nil), a.services...)
+	a.mu.Unlock()
+
+	servers := Hook{Name: "servers", Order: ServersOrder, Fn: func(ctx context.Context) error {
+		// stop accepting and let every connection accepted send its request before
+		// shutting down, as net/http drops those it reads once shutting down. Upgrades
+		// rely on this, the new process serving connections this one no longer accepts
+		for _, s := range services {
+			s.listener.Close()
+		}
+		for _, s := range services {
+			select {
+			case <-s.served:
+			case <-ctx.Done():
+			}
+		}
+
+		var errs []error
+		shutdown := make(map[*http.Server]bool)
+		for _, s := range services {
+			if shutdown[s.server] {
+				continue
+			}
+			shutdown[s.server] = true
+
+			a.mu.Lock()
+			u := a.unread[s.server]
+			a.mu.Unlock()
+			u.wait(ctx, unreadGrace)
+
+			if err := s.server.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("server on %v did not shut down gracefully: %w", s.cfg.Addr, err))
+			}
+		}
+		return errors.Join(errs...)
+	}}
+
+	i := sort.Search(len(stops), func(i int) bool { return stops[i].Order > ServersOrder })
+	hooks := append(append(append([]Hook(nil), stops[:i]...), servers), stops[i:]...)
+
+	var errs []error
+	for _, h := range hooks {
+		if err := runHook(ctx, h); err != nil {
+			log.Printf("Stop hook %v failed: %v", h.Name, err)
+			errs = append(errs, fmt.Errorf("stop hook %v: %w", h.Name, err))
+		}
+	}
+	log.Printf("Shut down in %v", time.Since(start).Round(time.Millisecond))
+	return errors.Join(errs...)
+}
+
+// unwind runs the stop hooks named after the start hooks that ran,
+// releasing what they started when the App fails to start
+func (a *App) unwind(stops, started []Hook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+	defer cancel()
+
+	names := make(map[string]bool)
+	for _, h := range started {
+		names[h.Name] = true
+	}
+
+	var errs []error
+	for _, h := range stops {
+		if !names[h.Name] {
+			continue
+		}
+		if err := runHook(ctx, h); err != nil {
+			log.Printf("Stop hook %v failed: %v", h.Name, err)
+			errs = append(errs, fmt.Errorf("stop hook %v: %w", h.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runHook runs the hook with its timeout, returning when the timeout
+// passes even if the hook's func hasn't
+func runHook(ctx context.Context, h Hook) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h.Fn(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sortHooks returns a copy of the hooks sorted by order
+func sortHooks(hooks []Hook) []Hook {
+	sorted := append([]Hook(nil), hooks...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Order < sorted[j].Order })
+	return sorted
+}
+
+// tlsConfig returns the server's TLS configuration offering the protocols it serves,
+// as http.Server.ServeTLS would. Serve only sets up HTTP/2 when the server's
+// configuration offers it, so clients can negotiate it
+func tlsConfig(s *http.Server) *tls.Config {
+	cfg := s.TLSConfig.Clone()
+	if len(cfg.NextProtos) > 0 {
+		return cfg
+	}
+	if s.Protocols == nil || s.Protocols.HTTP2() {
+		cfg.NextProtos = append(cfg.NextProtos, "h2")
+	}
+	if s.Protocols == nil || s.Protocols.HTTP1() {
+		cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
+	}
+	return cfg
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/certs"
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+)
+
+func startApp(t *testing.T) (*App, string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for the test app \n\n %v", err)
+	}
+
+	h := handler.New()
+	h.Get("/health", handler.GetHealth)
+	h.Post("/admin/shutdown", handler.Shutdown)
+
+	a := NewApp(time.Second)
+	a.Serve(&http.Server{Handler: h}, l)
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+	return a, "http://" + l.Addr().String(), errs
+}
+
+func waitForDone(t *testing.T, a *App, errs chan error) error {
+	select {
+	case <-a.Done():
+		return <-errs
+	case <-time.After(5 * time.Second):
+		t.Fatalf("App did not shut down within 5 seconds")
+	}
+	return nil
+}
+
+func TestAppsAreIndependent(t *testing.T) {
+	first, firstURL, firstErrs := startApp(t)
+	second, secondURL, secondErrs := startApp(t)
+
+	// the shutdown handler only stops the app serving it
+	resp, err := http.Post(firstURL+"/admin/shutdown", "", nil)
+	if err != nil {
+		t.Fatalf("TestAppsAreIndependent errored when making request to test app \n\n %v", err)
+	}
+	resp.Body.Close()
+	if err := waitForDone(t, first, firstErrs); err != nil {
+		t.Errorf("App Run errored \n\n %v", err)
+	}
+
+	resp, err = http.Get(secondURL + "/health")
+	if err != nil {
+		t.Fatalf("Second app stopped serving when the first shut down \n\n %v", err)
+	}
+	resp.Body.Close()
+
+	second.Shutdown()
+	second.Shutdown()
+	if err := waitForDone(t, second, secondErrs); err != nil {
+		t.Errorf("App Run errored \n\n %v", err)
+	}
+}
+
+func TestAppHooks(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, name)
+			return nil
+		}
+	}
+
+	a := NewApp(time.Second)
+	a.OnStart(Hook{Name: "second", Order: 1, Fn: record("start second")})
+	a.OnStart(Hook{Name: "first", Fn: record("start first")})
+	a.OnStop(Hook{Name: "after", Order: ServersOrder + 1, Fn: record("stop after")})
+	a.OnStop(Hook{Name: "before", Order: ServersOrder - 1, Fn: record("stop before")})
+	a.OnStop(Hook{Name: "slow", Order: ServersOrder + 2, Timeout: 20 * time.Millisecond, Fn: func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Second)
+		return nil
+	}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for the test app \n\n %v", err)
+	}
+	a.Serve(&http.Server{Handler: handler.New()}, l)
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+	a.Shutdown()
+
+	start := time.Now()
+	err = waitForDone(t, a, errs)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("App Run did not return the timed out hook's error. Returned: %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("App waited on a hook past its timeout. Took: %v", d)
+	}
+
+	expected := []string{"start first", "start second", "stop before", "stop after"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("App ran the hooks out of order. Expected: %v Returned: %v", expected, calls)
+	}
+}
+
+func TestAppStartFailure(t *testing.T) {
+	var stopped []string
+	stop := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			stopped = append(stopped, name)
+			return nil
+		}
+	}
+
+	a := NewApp(time.Second)
+	a.OnStart(Hook{Name: "started", Fn: func(context.Context) error { return nil }})
+	a.OnStart(Hook{Name: "broken", Order: 1, Fn: func(context.Context) error { return fmt.Errorf("broken") }})
+	a.OnStart(Hook{Name: "skipped", Order: 2, Fn: func(context.Context) error { return nil }})
+	a.OnStop(Hook{Name: "started", Fn: stop("started")})
+	a.OnStop(Hook{Name: "broken", Fn: stop("broken")})
+	a.OnStop(Hook{Name: "skipped", Fn: stop("skipped")})
+	a.Serve(&http.Server{Addr: "127.0.0.1:0", Handler: handler.New()}, nil)
+
+	if err := a.Run(); err == nil {
+		t.Errorf("App Run did not return the start hook's error")
+	}
+	if !reflect.DeepEqual(stopped, []string{"started"}) {
+		t.Errorf("App did not stop only the hooks that started. Stopped: %v", stopped)
+	}
+	select {
+	case <-a.Done():
+	default:
+		t.Errorf("App was not done after Run returned")
+	}
+}
+
+func TestAppHandle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for the test app \n\n %v", err)
+	}
+
+	a := NewApp(time.Second)
+	a.Serve(&http.Server{Handler: handler.New()}, l)
+	handled := make(chan struct{}, 1)
+	a.Handle(syscall.SIGHUP, func() { handled <- struct{}{} })
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+	defer func() {
+		a.Shutdown()
+		waitForDone(t, a, errs)
+	}()
+
+	// the handler is registered once the app is listening
+	for i := 0; i < 50 && len(a.Addrs()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("App did not call the handler of the signal")
+	}
+	select {
+	case <-a.Done():
+		t.Errorf("App shut down on a handled signal")
+	default:
+	}
+}
+
+func TestAppBaseContext(t *testing.T) {
+	type key struct{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for the test app \n\n %v", err)
+	}
+
+	h := handler.New()
+	h.Post("/admin/shutdown", handler.Shutdown)
+	var value interface{}
+	a := NewApp(time.Second)
+	a.Serve(&http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value = r.Context().Value(key{})
+			h.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), key{}, "base")
+		},
+	}, l)
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+
+	// the shutdown trigger is added to the server's own base context
+	resp, err := http.Post("http://"+l.Addr().String()+"/admin/shutdown", "", nil)
+	if err != nil {
+		t.Fatalf("TestAppBaseContext errored when making request to test app \n\n %v", err)
+	}
+	resp.Body.Close()
+	if err := waitForDone(t, a, errs); err != nil {
+		t.Errorf("App Run errored \n\n %v", err)
+	}
+	if value != "base" {
+		t.Errorf("App replaced the server's base context. Value: %v", value)
+	}
+}
+
+func TestAppServesAcceptedConnections(t *testing.T) {
+	a, base, errs := startApp(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatalf("unable to connect to the test app \n\n %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// the request is sent once the shutdown has begun
+	a.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+	fmt.Fprint(conn, "GET /health HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("App dropped a connection accepted before shutting down \n\n %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("App did not serve a connection accepted before shutting down. Returned: %v", resp.StatusCode)
+	}
+
+	if err := waitForDone(t, a, errs); err != nil {
+		t.Errorf("App did not shut down cleanly \n\n %v", err)
+	}
+
+	// no new connections are accepted
+	if _, err := net.Dial("tcp", strings.TrimPrefix(base, "http://")); err == nil {
+		t.Errorf("App accepted a connection after shutting down")
+	}
+}
+
+func TestAppHTTP2(t *testing.T) {
+	cert, err := certs.SelfSigned([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unable to generate a certificate \n\n %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	release := make(chan struct{})
+	h := handler.New()
+	h.Get("/health", handler.GetHealth)
+	h.Get("/stream", func(ctx *handler.Context) {
+		ctx.ResponseWriter.WriteHeader(http.StatusOK)
+		fmt.Fprintln(ctx.ResponseWriter, "first")
+		ctx.ResponseWriter.(http.Flusher).Flush()
+		<-release
+		fmt.Fprintln(ctx.ResponseWriter, "second")
+	})
+
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	tlsServer := &http.Server{Handler: h, Protocols: protocols, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	h2cServer := &http.Server{Handler: h, Protocols: protocols}
+
+	a := NewApp(time.Second)
+	a.Listen(tlsServer, Listener{Addr: "127.0.0.1:0"})
+	a.Listen(h2cServer, Listener{Addr: "127.0.0.1:0"})
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+	defer func() {
+		a.Shutdown()
+		waitForDone(t, a, errs)
+	}()
+
+	var addrs []net.Addr
+	for start := time.Now(); len(addrs) < 2 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		addrs = a.Addrs()
+	}
+
+	h2c := &http.Protocols{}
+	h2c.SetUnencryptedHTTP2(true)
+	clients := []struct {
+		name string
+		url  string
+		c    *http.Client
+	}{
+		{"tls", "https://" + addrs[0].String(), &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		}}},
+		{"h2c", "http://" + addrs[1].String(), &http.Client{Transport: &http.Transport{Protocols: h2c}}},
+	}
+
+	for _, client := range clients {
+		resp, err := client.c.Get(client.url + "/health")
+		if err != nil {
+			t.Errorf("%v: App did not serve http/2 \n\n %v", client.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("%v: App did not negotiate http/2. Proto: %v", client.name, resp.Proto)
+		}
+	}
+
+	// streamed responses are flushed as they're written
+	resp, err := clients[1].c.Get(clients[1].url + "/stream")
+	if err != nil {
+		t.Fatalf("App did not serve the stream over http/2 \n\n %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); line != "first\n" {
+		t.Errorf("The stream was not flushed over http/2. Read: %q %v", line, err)
+	}
+	close(release)
+	if line, _ := r.ReadString('\n'); line != "second\n" {
+		t.Errorf("The stream did not finish over http/2. Read: %q", line)
+	}
+}
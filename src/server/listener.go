@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixPrefix prefixes the address of a unix domain socket
+const unixPrefix = "unix:"
+
+// Listener configures an address a server listens on
+type Listener struct {
+	// Addr is a TCP host:port, unix:/path for a unix domain socket
+	// or unix:@name for an abstract socket on linux
+	Addr string
+	// Mode, Owner and Group set the permissions of a unix domain socket's file,
+	// by default it has those of any file created by the process
+	Mode  os.FileMode
+	Owner string
+	Group string
+	// ProxyProtocol reads the PROXY protocol header every connection starts with
+	ProxyProtocol bool
+}
+
+// network returns the network and address to listen on of a listener address
+func network(addr string) (string, string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// bound reports whether the listener is bound to the address
+func bound(addr string, l net.Addr) bool {
+	netw, a := network(addr)
+	if netw != l.Network() {
+		return false
+	}
+	if netw == "unix" {
+		return a == l.String()
+	}
+	return sameAddr(a, l)
+}
+
+// open listens on the listener's address, setting the permissions of a unix domain socket
+func open(cfg Listener) (net.Listener, error) {
+	netw, addr := network(cfg.Addr)
+	if netw == "unix" && !strings.HasPrefix(addr, "@") {
+		if err := removeStale(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(netw, addr)
+	if err != nil {
+		return nil, err
+	}
+	if netw == "unix" && !strings.HasPrefix(addr, "@") {
+		if err := chmod(addr, cfg); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStale removes the file of a unix domain socket nothing is listening on,
+// left behind when a process exits without closing its listener
+func removeStale(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// chmod sets the mode and ownership of a unix domain socket's file
+func chmod(path string, cfg Listener) error {
+	if cfg.Mode != 0 {
+		if err := os.Chmod(path, cfg.Mode); err != nil {
+			return err
+		}
+	}
+	if cfg.Owner == "" && cfg.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		u, err := user.Lookup(cfg.Owner)
+		if err != nil {
+			if u, err = user.LookupId(cfg.Owner); err != nil {
+				return fmt.Errorf("socket owner %q: %w", cfg.Owner, err)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(cfg.Group); err != nil {
+				return fmt.Errorf("socket group %q: %w", cfg.Group, err)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,143 @@
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+)
+
+// unixClient returns a client sending every request over the unix domain socket
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cj.sock")
+	abstract := "@cloud-jumper-test-" + strconv.Itoa(os.Getpid())
+
+	h := handler.New()
+	h.Get("/health", handler.GetHealth)
+	s := &http.Server{Handler: h}
+
+	a := NewApp(time.Second)
+	a.Listen(s, Listener{Addr: "127.0.0.1:0"})
+	a.Listen(s, Listener{Addr: unixPrefix + path, Mode: 0660})
+	a.Listen(s, Listener{Addr: unixPrefix + abstract})
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+
+	var tcp string
+	for start := time.Now(); tcp == "" && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		for _, addr := range a.Addrs() {
+			if addr.Network() == "tcp" {
+				tcp = addr.String()
+			}
+		}
+	}
+
+	clients := map[string]*http.Client{
+		"tcp":      {Transport: &http.Transport{DisableKeepAlives: true}},
+		"unix":     unixClient(path),
+		"abstract": unixClient(abstract),
+	}
+	for name, c := range clients {
+		resp, err := c.Get("http://" + tcp + "/health")
+		if err != nil {
+			t.Errorf("The %v listener did not serve \n\n %v", name, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("The socket file was not created \n\n %v", err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("The socket file's mode was not set. Mode: %v", info.Mode().Perm())
+	}
+
+	// a socket in use isn't replaced
+	if _, err := open(Listener{Addr: unixPrefix + path}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("open replaced a socket in use. Error: %v", err)
+	}
+
+	a.Shutdown()
+	if err := waitForDone(t, a, errs); err != nil {
+		t.Errorf("App Run errored \n\n %v", err)
+	}
+	for name, c := range clients {
+		if resp, err := c.Get("http://" + tcp + "/health"); err == nil {
+			resp.Body.Close()
+			t.Errorf("The %v listener still served after the shutdown", name)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("The socket file was left behind. Error: %v", err)
+	}
+}
+
+func TestOpenStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cj.sock")
+
+	// a socket left behind by a process that didn't close its listener
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unable to listen \n\n %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = open(Listener{Addr: unixPrefix + path})
+	if err != nil {
+		t.Fatalf("open did not replace the stale socket \n\n %v", err)
+	}
+	l.Close()
+
+	// a file that isn't a socket is left alone
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0600)
+	if _, err := open(Listener{Addr: unixPrefix + file}); err == nil {
+		t.Errorf("open replaced a file that isn't a socket")
+	}
+}
+
+func TestBound(t *testing.T) {
+	tcp, _ := net.ResolveTCPAddr("tcp", "[::]:8080")
+	unix := &net.UnixAddr{Name: "/run/cj.sock", Net: "unix"}
+	tests := []struct {
+		addr  string
+		l     net.Addr
+		bound bool
+	}{
+		{":8080", tcp, true},
+		{":8080", unix, false},
+		{"unix:/run/cj.sock", unix, true},
+		{"unix:/run/other.sock", unix, false},
+		{"unix:/run/cj.sock", tcp, false},
+	}
+	for _, test := range tests {
+		if bound := bound(test.addr, test.l); bound != test.bound {
+			t.Errorf("bound(%v, %v) returned %v", test.addr, test.l, bound)
+		}
+	}
+}
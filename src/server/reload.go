@@ -0,0 +1,84 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/caoakleyii/cloud-jumper/src/admin"
+	"github.com/caoakleyii/cloud-jumper/src/config"
+)
+
+// Preparer checks the settings it applies from a loaded configuration are valid,
+// returning a func that applies them
+type Preparer func(*config.Config) (func(), error)
+
+// Reloader re-reads the configuration and applies the settings
+// that can change while running. Every Preparer has to succeed
+// before any setting is applied, so a reload applies all or nothing
+type Reloader struct {
+	load func() (*config.Config, error)
+
+	mu        sync.Mutex
+	running   *config.Config
+	preparers []Preparer
+}
+
+// NewReloader returns a new reference to a Reloader of the running configuration,
+// re-read with the load func provided
+func NewReloader(running *config.Config, load func() (*config.Config, error)) *Reloader {
+	return &Reloader{load: load, running: running}
+}
+
+// OnReload registers a Preparer called with the loaded configuration on every reload
+func (r *Reloader) OnReload(p Preparer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.preparers = append(r.preparers, p)
+}
+
+// Reload loads and validates the configuration, then applies the settings
+// that can change while running, reporting those that require a restart
+func (r *Reloader) Reload() (admin.ReloadReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loaded, err := r.load()
+	if err != nil {
+		return admin.ReloadReport{}, err
+	}
+
+	reloadable, restart := config.Changes(r.running, loaded)
+	report := admin.ReloadReport{Applied: []string{}, RequiresRestart: []string{}}
+	report.RequiresRestart = append(report.RequiresRestart, restart...)
+	if len(reloadable) == 0 {
+		return report, nil
+	}
+
+	// settings that require a restart are kept from the running configuration,
+	// which may not be valid alongside the reloaded ones
+	merged := config.Merge(r.running, loaded)
+	if err := merged.Validate(); err != nil {
+		return admin.ReloadReport{}, err
+	}
+	applies := make([]func(), 0, len(r.preparers))
+	for _, p := range r.preparers {
+		apply, err := p(merged)
+		if err != nil {
+			return admin.ReloadReport{}, err
+		}
+		applies = append(applies, apply)
+	}
+
+	for _, apply := range applies {
+		apply()
+	}
+	r.running = merged
+	report.Applied = append(report.Applied, reloadable...)
+	return report, nil
+}
+
+// Running returns the configuration currently applied
+func (r *Reloader) Running() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/caoakleyii/cloud-jumper/src/config"
+)
+
+func TestReload(t *testing.T) {
+	running, _, _ := config.Load(nil, func(string) string { return "" })
+	args := []string{"-salt-length", "48", "-addr", ":9000"}
+	r := NewReloader(running, func() (*config.Config, error) {
+		cfg, _, err := config.Load(args, func(string) string { return "" })
+		return cfg, err
+	})
+
+	salt := 0
+	failing := false
+	r.OnReload(func(c *config.Config) (func(), error) {
+		return func() { salt = c.Hashing.SaltLength }, nil
+	})
+	r.OnReload(func(c *config.Config) (func(), error) {
+		if failing {
+			return nil, errors.New("failing")
+		}
+		return func() {}, nil
+	})
+
+	// nothing is applied unless every preparer succeeds
+	failing = true
+	if _, err := r.Reload(); err == nil {
+		t.Errorf("Reload did not return the preparer's error")
+	}
+	if salt != 0 || r.Running().Hashing.SaltLength != 32 {
+		t.Errorf("Reload applied settings although a preparer failed")
+	}
+
+	failing = false
+	report, err := r.Reload()
+	if err != nil {
+		t.Fatalf("Reload errored \n\n %v", err)
+	}
+	if salt != 48 || r.Running().Hashing.SaltLength != 48 {
+		t.Errorf("Reload did not apply the reloadable setting. Salt Length: %v", salt)
+	}
+	if strings.Join(report.Applied, ",") != "salt-length" || strings.Join(report.RequiresRestart, ",") != "addr" {
+		t.Errorf("Reload did not report the changed settings. Report: %+v", report)
+	}
+	if r.Running().Addr != ":8080" {
+		t.Errorf("Reload applied a setting requiring a restart. Addr: %v", r.Running().Addr)
+	}
+
+	// an invalid configuration is rejected
+	args = []string{"-salt-length", "2"}
+	if _, err := r.Reload(); err == nil {
+		t.Errorf("Reload did not reject an invalid configuration")
+	}
+	if r.Running().Hashing.SaltLength != 48 {
+		t.Errorf("Reload applied an invalid configuration")
+	}
+}
+
+func TestReloadValidatesMerged(t *testing.T) {
+	running, _, err := config.Load([]string{"-tls-dev"}, func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("Load errored \n\n %v", err)
+	}
+	// valid on its own, but tls-dev requires a restart to turn off
+	r := NewReloader(running, func() (*config.Config, error) {
+		cfg, _, err := config.Load([]string{"-tls-cert", "cert.pem", "-tls-key", "key.pem"}, func(string) string { return "" })
+		return cfg, err
+	})
+	prepared := false
+	r.OnReload(func(c *config.Config) (func(), error) {
+		prepared = true
+		return func() {}, nil
+	})
+
+	if _, err := r.Reload(); err == nil || !strings.Contains(err.Error(), "tls.dev") {
+		t.Errorf("Reload did not reject the merged configuration. Error: %v", err)
+	}
+	if prepared || r.Running().TLS.Cert != "" {
+		t.Errorf("Reload prepared or applied an invalid merged configuration")
+	}
+}
@@ -2,31 +2,114 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
-	"os"
-	"os/signal"
+	"strings"
 
+	"github.com/caoakleyii/cloud-jumper/src/admin"
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+	"github.com/caoakleyii/cloud-jumper/src/config"
+	"github.com/caoakleyii/cloud-jumper/src/gossip"
 	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/health"
+	"github.com/caoakleyii/cloud-jumper/src/jobs"
 	"github.com/caoakleyii/cloud-jumper/src/middleware"
+	"github.com/caoakleyii/cloud-jumper/src/raft"
 )
 
 // UseRoutes registers paths with the
 // proper handler funcs
 func UseRoutes(h *handler.APIHandler) {
 
-	h.Any("/shutdown", handler.Shutdown)
 	h.Post("/hash", handler.PostPassword)
 	h.Get("/hash/:id", handler.GetPassword)
 	h.Get("/health", handler.GetHealth)
+	h.Get("/livez", handler.GetLivez)
+	h.Get("/readyz", handler.GetReadyz)
 	h.Get("/stats", handler.GetStastics)
 }
 
+// UsePeerRoutes registers the paths other nodes call, including the password
+// paths they forward requests to and the raft rpcs, with the proper handler
+// funcs, to be served on the peer listener
+func UsePeerRoutes(h *handler.APIHandler) {
+
+	h.Post("/hash", handler.PostPassword)
+	h.Get("/hash/:id", handler.GetPassword)
+	h.Get("/replication/log", handler.StreamChanges)
+	h.Post("/cluster/records", handler.ReceiveRecords)
+	h.Post("/raft/:rpc", handler.RaftRPC)
+}
+
+// UseAdminRoutes registers the admin paths with the
+// proper handler funcs, to be served on the admin listener
+func UseAdminRoutes(h *handler.APIHandler) {
+
+	h.Post("/admin/shutdown", handler.Shutdown)
+	h.Post("/admin/drain", handler.Drain)
+	h.Post("/admin/reload", handler.Reload)
+	h.Post("/admin/maintenance", handler.Maintenance)
+	h.Get("/admin/export", handler.ExportPasswords)
+	h.Post("/admin/import", handler.ImportPasswords)
+	h.Get("/admin/replication", handler.GetReplicationStatus)
+	h.Post("/admin/promote", handler.Promote)
+	h.Get("/admin/cluster", handler.GetCluster)
+	h.Post("/admin/rebalance", handler.Rebalance)
+	h.Get("/admin/raft", handler.GetRaftStatus)
+	h.Post("/admin/raft/members", handler.AddRaftMember)
+	h.Post("/admin/raft/members/remove", handler.RemoveRaftMember)
+	h.Get("/admin/members", handler.GetMembers)
+}
+
 // UseMiddleware registerse any premiddleware
-// and middleware with the handler
-func UseMiddleware(h *handler.APIHandler) {
-	h.Pre(middleware.PreStatistics)
-	h.Use(middleware.Statistics)
+// and middleware enabled in the config with the handler
+func UseMiddleware(h *handler.APIHandler, cfg config.Middleware) {
+	if cfg.Statistics {
+		h.Pre(middleware.PreStatistics)
+		h.Use(middleware.Statistics)
+	}
+}
+
+// UseHealthChecks registers the liveness and readiness checks
+// of the store, job queue and cluster peers
+func UseHealthChecks(r *health.Registry) {
+	// a store whose lock can't be taken won't recover without a restart
+	r.Live(health.Check{Name: "store", Fn: func(context.Context) error {
+		cache.InMemoryPasswordStorage.Len()
+		return nil
+	}})
+
+	r.Ready(health.Check{Name: "drain", Fn: func(context.Context) error {
+		if admin.Draining() {
+			return errors.New("draining")
+		}
+		return nil
+	}})
+	r.Ready(health.Check{Name: "maintenance", Fn: func(context.Context) error {
+		if admin.Maintenance() {
+			return errors.New("under maintenance")
+		}
+		return nil
+	}})
+	r.Ready(health.Check{Name: "store", Fn: func(context.Context) error {
+		if n, ok := cache.PasswordStorage.(*raft.Node); ok && n.Status().Leader == "" {
+			return errors.New("no raft leader")
+		}
+		return nil
+	}})
+	r.Ready(health.Check{Name: "jobs", Fn: func(context.Context) error {
+		if jobs.Default.Closed() {
+			return errors.New("not accepting hash jobs")
+		}
+		return nil
+	}})
+	r.Ready(health.Check{Name: "peers", Fn: func(context.Context) error {
+		if gossip.Isolated() {
+			return errors.New("every other cluster member is dead")
+		}
+		return nil
+	}})
 }
 
 /*
@@ -34,29 +117,39 @@ func UseMiddleware(h *handler.APIHandler) {
 
 	The http.Server.Shutdown() method provides a
 	graceful shutdown with the release of go 1.8
-	The server is being run on a seperate goroutine
-	while the app is waiting on a exit signal to update
-	the blocking channel. The current context has no timeout
-	and will defer the cancel for any existing child context,
-	after the shutdown returns.
+	The servers are run by an App, which waits for an exit
+	signal or a shutdown trigger. The instance drains first
+	so no new work is accepted, then the servers and the
+	background hash jobs share the timeout to finish what's in flight.
 */
-// UseGracefulShutdown shuts down the server
-// without interrupting any active connections
-func UseGracefulShutdown(s *http.Server) {
-	// create a channel, for an os signal, setup a notify
-	// to listen for a kill or interrupt signal
-	signal.Notify(handler.CSignal, os.Kill, os.Interrupt)
-
-	// block current thread
-	<-handler.CSignal
-
-	// close global channel
-	close(handler.CSignal)
-
-	// kill or interrrupt signal was sent, continue with graceful shut down
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	if err := s.Shutdown(ctx); err != nil {
-		log.Fatal(err)
-	}
+// UseGracefulShutdown registers the stop hooks that drain the instance
+// before the servers shut down and wait for the background hash jobs after.
+// The drain state and job queue are shared by the process, so a start hook
+// undoes what an earlier App's shutdown left behind
+func UseGracefulShutdown(a *App) {
+	a.OnStart(Hook{Name: "accept work", Fn: func(context.Context) error {
+		admin.Resume()
+		jobs.Default.Open()
+		return nil
+	}})
+
+	a.OnStop(Hook{Name: "drain", Order: ServersOrder - 1, Fn: func(context.Context) error {
+		// after an upgrade the new process is serving, so requests
+		// still reaching this one shouldn't be turned away
+		if a.Upgraded() {
+			return nil
+		}
+		admin.Drain()
+		return nil
+	}})
+
+	a.OnStop(Hook{Name: "jobs", Order: ServersOrder + 1, Fn: func(ctx context.Context) error {
+		summary := jobs.Default.Shutdown(ctx)
+		log.Printf("Hash jobs pending: %v completed: %v failed: %v flushed: %v lost: %v",
+			summary.Pending, summary.Completed, summary.Failed, summary.Flushed, summary.Lost)
+		if summary.Lost > 0 {
+			return fmt.Errorf("passwords lost: %v", strings.Join(summary.LostIDs, ","))
+		}
+		return nil
+	}})
 }
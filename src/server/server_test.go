@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+	"github.com/caoakleyii/cloud-jumper/src/hasher"
+	"github.com/caoakleyii/cloud-jumper/src/health"
+)
+
+func TestGracefulShutdownRestart(t *testing.T) {
+	policy := hasher.CurrentPolicy()
+	defer hasher.SetPolicy(policy)
+	fast := policy
+	fast.StoreDelay = 10 * time.Millisecond
+	hasher.SetPolicy(fast)
+
+	UseHealthChecks(health.Default)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen for the test app \n\n %v", err)
+		}
+		h := handler.New()
+		UseRoutes(h)
+		a := NewApp(time.Second)
+		a.Serve(&http.Server{Handler: h}, l)
+		UseGracefulShutdown(a)
+
+		errs := make(chan error, 1)
+		go func() { errs <- a.Run() }()
+		base := "http://" + l.Addr().String()
+
+		// an App started after another stopped isn't left draining
+		resp, err := http.PostForm(base+"/hash", url.Values{"password": {"angryMonkey"}})
+		if err != nil {
+			t.Fatalf("App %v: POST /hash errored \n\n %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("App %v: POST /hash responded %v", i, resp.StatusCode)
+		}
+		resp, err = http.Get(base + "/readyz")
+		if err != nil {
+			t.Fatalf("App %v: GET /readyz errored \n\n %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("App %v: GET /readyz responded %v", i, resp.StatusCode)
+		}
+
+		a.Shutdown()
+		if err := waitForDone(t, a, errs); err != nil {
+			t.Errorf("App %v: Run errored \n\n %v", i, err)
+		}
+	}
+}
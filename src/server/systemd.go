@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// activated returns the sockets systemd passed this process through LISTEN_FDS,
+// starting at the descriptor first, removing them from the environment so
+// they aren't passed on to processes started by this one
+func activated(first int) ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// the sockets were passed to another process when the pid isn't ours
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := first; fd < first+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("socket %v passed by systemd: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sameAddr reports whether the listener is bound to the address a server is configured with,
+// a server without a host or with an unspecified IP matching a listener on every interface
+func sameAddr(configured string, l net.Addr) bool {
+	host, port, err := net.SplitHostPort(configured)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(l.String())
+	if err != nil || lport != port {
+		return false
+	}
+
+	ip, lip := net.ParseIP(host), net.ParseIP(lhost)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		return lip != nil && lip.IsUnspecified()
+	}
+	return host == lhost || (ip != nil && ip.Equal(lip))
+}
+
+// notify sends the state to the service manager over NOTIFY_SOCKET, see sd_notify(3).
+// It does nothing when the process isn't run by a service manager
+func notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// an abstract socket starts with a null byte rather than an @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the service manager expects a watchdog
+// notification, from WATCHDOG_USEC, or zero when it doesn't
+func watchdogInterval() time.Duration {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	n, err := strconv.Atoi(usec)
+	if err != nil || n <= 0 {
+		log.Printf("Ignoring invalid WATCHDOG_USEC %q", usec)
+		return 0
+	}
+	return time.Duration(n) * time.Microsecond
+}
+
+// watchdog notifies the service manager at half its watchdog interval until the
+// context is done, skipping notifications while the App's Alive check fails so
+// the service manager restarts a process that has stopped working
+func (a *App) watchdog(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if a.Alive != nil {
+			check, cancel := context.WithTimeout(ctx, interval/2)
+			err := a.Alive(check)
+			cancel()
+			if err != nil {
+				log.Printf("Skipping the watchdog notification, not alive: %v", err)
+				continue
+			}
+		}
+		if err := notify("WATCHDOG=1"); err != nil {
+			log.Printf("Unable to notify the watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/handler"
+)
+
+// fakeNotifySocket listens where NOTIFY_SOCKET points, as systemd would
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen for notifications \n\n %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// receive returns the next notification, or an empty string when none is sent within the timeout
+func receive(conn *net.UnixConn, timeout time.Duration) string {
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(b)
+	if err != nil {
+		return ""
+	}
+	return string(b[:n])
+}
+
+func runApp(t *testing.T, alive func(context.Context) error) (*App, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for the test app \n\n %v", err)
+	}
+
+	a := NewApp(time.Second)
+	a.Alive = alive
+	a.Serve(&http.Server{Handler: handler.New()}, l)
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.Run() }()
+	return a, errs
+}
+
+func TestNotify(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "50000")
+
+	a, errs := runApp(t, nil)
+
+	ready := receive(conn, 5*time.Second)
+	if ready != "READY=1\nMAINPID="+strconv.Itoa(os.Getpid()) {
+		t.Errorf("App did not notify it is ready. Notified: %q", ready)
+	}
+	if state := receive(conn, time.Second); state != "WATCHDOG=1" {
+		t.Errorf("App did not notify the watchdog. Notified: %q", state)
+	}
+
+	a.Shutdown()
+	// skip any watchdog notifications sent before the shutdown
+	state := receive(conn, time.Second)
+	for state == "WATCHDOG=1" {
+		state = receive(conn, time.Second)
+	}
+	if state != "STOPPING=1" {
+		t.Errorf("App did not notify it is stopping. Notified: %q", state)
+	}
+	waitForDone(t, a, errs)
+}
+
+func TestWatchdogAlive(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "50000")
+
+	a, errs := runApp(t, func(context.Context) error { return errors.New("wedged") })
+	defer func() {
+		a.Shutdown()
+		waitForDone(t, a, errs)
+	}()
+
+	receive(conn, 5*time.Second)
+	if state := receive(conn, 200*time.Millisecond); state != "" {
+		t.Errorf("App notified the watchdog while not alive. Notified: %q", state)
+	}
+}
+
+func TestActivated(t *testing.T) {
+	// sockets are passed at consecutive descriptors, well clear of those in use
+	const first = 200
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen \n\n %v", err)
+		}
+		f, _ := l.(*net.TCPListener).File()
+		if err := syscall.Dup3(int(f.Fd()), first+i, 0); err != nil {
+			t.Fatalf("unable to place the socket at its descriptor \n\n %v", err)
+		}
+		f.Close()
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+	}
+
+	// sockets passed to another process are left alone
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	if listeners, err := activated(first); err != nil || listeners != nil {
+		t.Errorf("activated used sockets passed to another process. Returned: %v %v", listeners, err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	listeners, err := activated(first)
+	if err != nil {
+		t.Fatalf("activated errored \n\n %v", err)
+	}
+	for i, l := range listeners {
+		defer l.Close()
+		if l.Addr().String() != addrs[i] {
+			t.Errorf("activated did not return the socket passed. Expected: %v | Returned: %v", addrs[i], l.Addr())
+		}
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("activated did not return every socket passed. Returned: %v", listeners)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("activated left the sockets in the environment")
+	}
+
+	// the sockets serve
+	go http.Serve(listeners[0], handler.New())
+	resp, err := http.Get("http://" + addrs[0] + "/")
+	if err != nil {
+		t.Fatalf("the socket passed did not serve \n\n %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		configured string
+		listener   string
+		same       bool
+	}{
+		{":8080", "[::]:8080", true},
+		{":8080", "0.0.0.0:8080", true},
+		{"0.0.0.0:8080", "[::]:8080", true},
+		{":8080", "127.0.0.1:8080", false},
+		{":8080", "[::]:8081", false},
+		{"127.0.0.1:8081", "127.0.0.1:8081", true},
+		{"127.0.0.1:8081", "[::]:8081", false},
+		{"[::1]:8081", "[::1]:8081", true},
+	}
+	for _, test := range tests {
+		addr, _ := net.ResolveTCPAddr("tcp", test.listener)
+		if same := sameAddr(test.configured, addr); same != test.same {
+			t.Errorf("sameAddr(%v, %v) returned %v", test.configured, test.listener, same)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// Environment variables a re-executed process inherits its parent's listeners through
+const (
+	// listenAddrsEnv lists the address of each server whose
+	// listener is passed, in the order of their descriptors
+	listenAddrsEnv = "CLOUD_JUMPER_LISTEN_ADDRS"
+	// readyFDEnv is the descriptor the process writes to once it is serving
+	readyFDEnv = "CLOUD_JUMPER_READY_FD"
+)
+
+// firstFD is the descriptor of the first file passed to a child process
+const firstFD = 3
+
+// ErrUpgrading is returned by Upgrade while another upgrade is in progress
+var ErrUpgrading = errors.New("an upgrade is already in progress")
+
+// filer is a listener whose socket can be passed to another process
+type filer interface {
+	File() (*os.File, error)
+}
+
+// inherit returns the listeners passed by a parent process by the address
+// of the server they belong to, removing them from the environment so
+// they aren't passed on again
+func inherit() (map[string]net.Listener, error) {
+	addrs := os.Getenv(listenAddrsEnv)
+	if addrs == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenAddrsEnv)
+
+	listeners := make(map[string]net.Listener)
+	for i, addr := range strings.Split(addrs, ",") {
+		f := os.NewFile(uintptr(firstFD+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners[addr] = l
+	}
+	return listeners, nil
+}
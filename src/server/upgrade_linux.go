@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Upgrade starts a new process from the current executable with the same arguments,
+// passing it the App's listeners, and waits until it is serving on them. Once
+// Upgrade returns the new process is accepting connections alongside this one,
+// which can then shut down gracefully without the ports ever closing.
+// If the new process exits or isn't serving within the shutdown timeout,
+// it is killed and this process carries on serving
+func (a *App) Upgrade() error {
+	if a.Upgradable != nil {
+		if err := a.Upgradable(); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	if a.upgrading {
+		a.mu.Unlock()
+		return ErrUpgrading
+	}
+	a.upgrading = true
+	services := append([]service(nil), a.services...)
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		a.upgrading = false
+		a.mu.Unlock()
+	}()
+
+	var files []*os.File
+	var addrs []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, s := range services {
+		l, ok := s.listener.(filer)
+		if !ok {
+			return fmt.Errorf("listener %v can't be passed to another process", s.listener.Addr())
+		}
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		addrs = append(addrs, s.cfg.Addr)
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		listenAddrsEnv+"="+strings.Join(addrs, ","),
+		readyFDEnv+"="+strconv.Itoa(firstFD+len(files)),
+	)
+
+	err = cmd.Start()
+	// only the child holds the write end, so a read returns once it is ready or has exited
+	readyW.Close()
+	// starting the process put the sockets, shared with this process's
+	// listeners, into blocking mode, which would block their accepts
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	signalled := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		signalled <- err
+	}()
+
+	select {
+	case err := <-signalled:
+		if err == nil {
+			log.Printf("Upgraded to pid %v", cmd.Process.Pid)
+			// the new process serves on the socket files, so they're
+			// kept when this process closes its listeners
+			for _, s := range services {
+				if l, ok := s.listener.(*net.UnixListener); ok {
+					l.SetUnlinkOnClose(false)
+				}
+			}
+			a.mu.Lock()
+			a.upgraded = true
+			a.mu.Unlock()
+			return nil
+		}
+		if err != io.EOF {
+			cmd.Process.Kill()
+			return err
+		}
+		// the pipe closed without a write, the child exited
+		return fmt.Errorf("new process exited before it was ready: %w", <-exited)
+	case err := <-exited:
+		return fmt.Errorf("new process exited before it was ready: %w", err)
+	case <-time.After(a.ShutdownTimeout):
+		cmd.Process.Kill()
+		return errors.New("new process was not ready within the shutdown timeout")
+	}
+}
+
+// ready tells the parent process that started this one in an upgrade that it is serving
+func ready() error {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %v %q", readyFDEnv, fd)
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
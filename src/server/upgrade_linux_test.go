@@ -0,0 +1,20 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpgradeNotUpgradable(t *testing.T) {
+	refused := errors.New("refused")
+	a := NewApp(time.Second)
+	a.Upgradable = func() error { return refused }
+
+	if err := a.Upgrade(); err != refused {
+		t.Errorf("Upgrade did not return the Upgradable error. Returned: %v", err)
+	}
+	if a.Upgraded() {
+		t.Errorf("App was upgraded without being upgradable")
+	}
+}
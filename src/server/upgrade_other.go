@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+// Upgrade is only supported on linux
+func (a *App) Upgrade() error {
+	return errors.New("upgrades are only supported on linux")
+}
+
+func ready() error {
+	return nil
+}
@@ -0,0 +1,314 @@
+/*
+Package transfer implements the export and import of the password store.
+
+	Records are written and read as newline delimited JSON or CSV,
+	one record per line, so stores of any size can be streamed
+	between environments or kept as backups.
+*/
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+)
+
+// Supported export and import formats
+const (
+	NDJSON = "ndjson"
+	CSV    = "csv"
+)
+
+// Conflict policies used when an imported id already exists
+const (
+	Skip      = "skip"
+	Overwrite = "overwrite"
+	Fail      = "fail"
+)
+
+// flushEvery is how many records are written between flushes
+// when the export writer supports flushing
+const flushEvery = 100
+
+var csvHeader = []string{"id", "hash", "created_at"}
+
+// ErrConflict is returned by Import when the fail policy is used
+// and an imported id already exists
+var ErrConflict = errors.New("transfer: record already exists")
+
+// StoreError is returned by Import when the storage backend fails to store a record
+type StoreError struct {
+	ID  string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("transfer: storing %v failed: %v", e.ID, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// Report summarizes the result of an import
+type Report struct {
+	Total       int      `json:"total"`
+	Created     int      `json:"created"`
+	Overwritten int      `json:"overwritten"`
+	Skipped     int      `json:"skipped"`
+	Conflicts   []string `json:"conflicts"`
+	DryRun      bool     `json:"dry_run"`
+}
+
+// ValidFormat reports whether format is a supported format
+func ValidFormat(format string) bool {
+	return format == NDJSON || format == CSV
+}
+
+// ValidPolicy reports whether policy is a supported conflict policy
+func ValidPolicy(policy string) bool {
+	return policy == Skip || policy == Overwrite || policy == Fail
+}
+
+// ContentType returns the mime type for the format provided
+func ContentType(format string) string {
+	if format == CSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// Export streams every record in the store to w in the format provided.
+// If w can be flushed, it is flushed as records are written
+func Export(w io.Writer, s cache.Storage, format string) error {
+	enc, err := newEncoder(w, format)
+	if err != nil {
+		return err
+	}
+
+	f, _ := w.(interface{ Flush() })
+	n := 0
+	s.Range(func(r cache.Record) bool {
+		if err = enc.Encode(r); err != nil {
+			return false
+		}
+		n++
+		if f != nil && n%flushEvery == 0 {
+			if err = enc.Flush(); err != nil {
+				return false
+			}
+			f.Flush()
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = enc.Flush(); err != nil {
+		return err
+	}
+	if f != nil {
+		f.Flush()
+	}
+	return nil
+}
+
+// Import reads records in the format provided from r and stores them in s,
+// resolving existing ids with the conflict policy provided.
+// The whole input is validated before the store is changed, so a malformed
+// file or a conflict under the fail policy leaves the store untouched,
+// however a storage backend failing part way, with a StoreError, leaves the records
+// before it stored. The records are held until then, so callers bound the input's size.
+// When dryRun is true the report is built but nothing is stored
+func Import(r io.Reader, s cache.Storage, format, policy string, dryRun bool) (Report, error) {
+	report := Report{Conflicts: []string{}, DryRun: dryRun}
+	if !ValidPolicy(policy) {
+		return report, fmt.Errorf("transfer: unknown conflict policy %q", policy)
+	}
+
+	dec, err := newDecoder(r, format)
+	if err != nil {
+		return report, err
+	}
+
+	var pending []cache.Record
+	seen := make(map[string]bool)
+	for {
+		rec, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Total++
+
+		_, exists := s.Get(rec.ID)
+		if exists || seen[rec.ID] {
+			report.Conflicts = append(report.Conflicts, rec.ID)
+			switch policy {
+			case Skip:
+				report.Skipped++
+				continue
+			case Overwrite:
+				report.Overwritten++
+			}
+		} else {
+			report.Created++
+		}
+		seen[rec.ID] = true
+		pending = append(pending, rec)
+	}
+
+	if policy == Fail && len(report.Conflicts) > 0 {
+		return report, ErrConflict
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, rec := range pending {
+		if err := s.Put(rec); err != nil {
+			return report, &StoreError{rec.ID, err}
+		}
+	}
+	return report, nil
+}
+
+type encoder interface {
+	Encode(cache.Record) error
+	Flush() error
+}
+
+type decoder interface {
+	Decode() (cache.Record, error)
+}
+
+func newEncoder(w io.Writer, format string) (encoder, error) {
+	switch format {
+	case NDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonEncoder{bw, json.NewEncoder(bw)}, nil
+	case CSV:
+		return &csvEncoder{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("transfer: unknown format %q", format)
+}
+
+func newDecoder(r io.Reader, format string) (decoder, error) {
+	switch format {
+	case NDJSON:
+		return &ndjsonDecoder{s: bufio.NewScanner(r)}, nil
+	case CSV:
+		c := csv.NewReader(r)
+		c.FieldsPerRecord = len(csvHeader)
+		return &csvDecoder{r: c}, nil
+	}
+	return nil, fmt.Errorf("transfer: unknown format %q", format)
+}
+
+type ndjsonEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) Encode(r cache.Record) error {
+	return e.enc.Encode(r)
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type csvEncoder struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (e *csvEncoder) Encode(r cache.Record) error {
+	if !e.wroteHeader {
+		e.wroteHeader = true
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	return e.w.Write([]string{r.ID, r.Hash, r.CreatedAt.Format(time.RFC3339Nano)})
+}
+
+func (e *csvEncoder) Flush() error {
+	// an empty store still exports the header
+	if !e.wroteHeader {
+		e.wroteHeader = true
+		if err := e.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonDecoder struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func (d *ndjsonDecoder) Decode() (cache.Record, error) {
+	var r cache.Record
+	for d.s.Scan() {
+		d.line++
+		b := d.s.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return r, fmt.Errorf("transfer: line %v: %v", d.line, err)
+		}
+		return r, validate(r, d.line)
+	}
+	if err := d.s.Err(); err != nil {
+		return r, err
+	}
+	return r, io.EOF
+}
+
+type csvDecoder struct {
+	r    *csv.Reader
+	line int
+}
+
+func (d *csvDecoder) Decode() (cache.Record, error) {
+	var r cache.Record
+	row, err := d.r.Read()
+	d.line++
+	if err != nil {
+		return r, err
+	}
+
+	if d.line == 1 && row[0] == csvHeader[0] {
+		return d.Decode()
+	}
+
+	r.ID, r.Hash = row[0], row[1]
+	if row[2] != "" {
+		r.CreatedAt, err = time.Parse(time.RFC3339Nano, row[2])
+		if err != nil {
+			return r, fmt.Errorf("transfer: line %v: %v", d.line, err)
+		}
+	}
+	return r, validate(r, d.line)
+}
+
+func validate(r cache.Record, line int) error {
+	if r.ID == "" || r.Hash == "" {
+		return fmt.Errorf("transfer: line %v: record requires an id and hash", line)
+	}
+	return nil
+}
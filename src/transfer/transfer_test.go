@@ -0,0 +1,93 @@
+package transfer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caoakleyii/cloud-jumper/src/cache"
+)
+
+func seededStore() *cache.Store {
+	s := cache.NewStore()
+	s.Put(cache.Record{ID: "abc123", Hash: "hashA", CreatedAt: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)})
+	s.Put(cache.Record{ID: "def456", Hash: "hashB", CreatedAt: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)})
+	return s
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{NDJSON, CSV} {
+		var buf bytes.Buffer
+		if err := Export(&buf, seededStore(), format); err != nil {
+			t.Errorf("Export errored for format %v \n\n %v", format, err)
+		}
+
+		s := cache.NewStore()
+		report, err := Import(&buf, s, format, Skip, false)
+		if err != nil {
+			t.Errorf("Import errored for format %v \n\n %v", format, err)
+		}
+
+		if report.Total != 2 || report.Created != 2 {
+			t.Errorf("Import did not create every exported record for format %v. Report: %+v", format, report)
+		}
+
+		r, ok := s.Get("def456")
+		if !ok || r.Hash != "hashB" || !r.CreatedAt.Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Errorf("Import did not restore the record and metadata for format %v. Returned: %+v", format, r)
+		}
+	}
+}
+
+func TestImportPolicies(t *testing.T) {
+	in := `{"id":"abc123","hash":"new"}` + "\n" + `{"id":"ghi789","hash":"hashC"}` + "\n"
+
+	s := seededStore()
+	report, err := Import(strings.NewReader(in), s, NDJSON, Skip, false)
+	if err != nil {
+		t.Errorf("Import errored with skip policy \n\n %v", err)
+	}
+	if r, _ := s.Get("abc123"); r.Hash != "hashA" || report.Skipped != 1 || report.Created != 1 {
+		t.Errorf("Import with skip policy replaced an existing record. Report: %+v", report)
+	}
+
+	s = seededStore()
+	report, err = Import(strings.NewReader(in), s, NDJSON, Overwrite, false)
+	if err != nil {
+		t.Errorf("Import errored with overwrite policy \n\n %v", err)
+	}
+	if r, _ := s.Get("abc123"); r.Hash != "new" || report.Overwritten != 1 {
+		t.Errorf("Import with overwrite policy did not replace an existing record. Report: %+v", report)
+	}
+
+	s = seededStore()
+	_, err = Import(strings.NewReader(in), s, NDJSON, Fail, false)
+	if err != ErrConflict {
+		t.Errorf("Import with fail policy did not return ErrConflict. Returned: %v", err)
+	}
+	if _, ok := s.Get("ghi789"); ok {
+		t.Errorf("Import with fail policy stored records before failing")
+	}
+
+	s = seededStore()
+	report, err = Import(strings.NewReader(in), s, NDJSON, Overwrite, true)
+	if err != nil {
+		t.Errorf("Import errored with dry run \n\n %v", err)
+	}
+	if _, ok := s.Get("ghi789"); ok || report.Created != 1 || !report.DryRun {
+		t.Errorf("Import with dry run stored records or reported incorrectly. Report: %+v", report)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	s := seededStore()
+	in := `{"id":"ghi789","hash":"hashC"}` + "\n" + `{"id":""}` + "\n"
+
+	if _, err := Import(strings.NewReader(in), s, NDJSON, Skip, false); err == nil {
+		t.Errorf("Import did not return an error for a record without an id")
+	}
+	if _, ok := s.Get("ghi789"); ok {
+		t.Errorf("Import stored records from a malformed file")
+	}
+}
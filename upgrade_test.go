@@ -0,0 +1,201 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address with a port nothing is listening on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to find a free port \n\n %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// logWatcher keeps a process's log and reports lines matching a pattern
+type logWatcher struct {
+	pattern *regexp.Regexp
+	matches chan []string
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (w *logWatcher) watch(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		w.mu.Lock()
+		w.lines = append(w.lines, scanner.Text())
+		w.mu.Unlock()
+		if m := w.pattern.FindStringSubmatch(scanner.Text()); m != nil {
+			w.matches <- m
+		}
+	}
+}
+
+// print logs the lines kept so far, to explain a failure
+func (w *logWatcher) print(t *testing.T) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, l := range w.lines {
+		t.Log(l)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the server binary")
+	}
+
+	bin := t.TempDir() + "/cloud-jumper"
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("unable to build the server \n\n %v %s", err, out)
+	}
+
+	// with the memory backend only a follower, which resyncs from its primary, can upgrade
+	env := append(os.Environ(), "CLOUD_JUMPER_CLUSTER_SECRET=secret")
+	peerAddr := freeAddr(t)
+	primary := exec.Command(bin, "-addr", freeAddr(t), "-admin-addr", freeAddr(t), "-peer-addr", peerAddr)
+	primary.Env = env
+	if err := primary.Start(); err != nil {
+		t.Fatalf("unable to start the primary \n\n %v", err)
+	}
+	defer primary.Wait()
+	defer primary.Process.Kill()
+
+	addr := freeAddr(t)
+	cmd := exec.Command(bin, "-addr", addr, "-admin-addr", freeAddr(t), "-hash-delay", "0s", "-follow", "http://"+peerAddr)
+	cmd.Env = env
+	// the log is read from a pipe the test owns, as the new process
+	// keeps writing to it after the old one has exited
+	stderr, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unable to create a pipe \n\n %v", err)
+	}
+	defer stderr.Close()
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		t.Fatalf("unable to start the server \n\n %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	logs := &logWatcher{pattern: regexp.MustCompile(`Upgraded to pid (\d+)`), matches: make(chan []string, 1)}
+	go logs.watch(stderr)
+	defer func() {
+		if t.Failed() {
+			logs.print(t)
+		}
+	}()
+
+	// new connections for every request, so each one tests the listener
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	url := fmt.Sprintf("http://%v/health", addr)
+	for i := 0; ; i++ {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server did not start \n\n %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var requests, failures atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				requests.Add(1)
+				resp, err := client.Get(url)
+				if err != nil {
+					failures.Add(1)
+					t.Logf("request failed during the upgrade: %v", err)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGUSR2)
+
+	var child int
+	select {
+	case m := <-logs.matches:
+		child, _ = strconv.Atoi(m[1])
+	case <-time.After(10 * time.Second):
+		t.Fatalf("server did not upgrade")
+	}
+	defer syscall.Kill(child, syscall.SIGKILL)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("old process did not exit cleanly \n\n %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("old process did not exit after the upgrade")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if failures.Load() > 0 {
+		t.Errorf("TestUpgrade failed %v of %v requests during the upgrade", failures.Load(), requests.Load())
+	}
+
+	// the new process serves on the same port, and shuts down like any other
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("new process is not serving \n\n %v", err)
+	}
+	resp.Body.Close()
+
+	syscall.Kill(child, syscall.SIGTERM)
+	for i := 0; i < 100; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("new process did not shut down on terminate")
+}